@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+//===================================================================================================
+//                                ECRITURE ATOMIQUE
+//===================================================================================================
+
+// Un fichier téléchargé est d'abord écrit dans .<fichier>.<aléatoire>.part, relu et vérifié chunk par chunk
+// contre les hash reçus, synchronisé sur le disque puis renommé : un fichier à son nom final est toujours complet.
+// Le nom aléatoire (os.CreateTemp) évite d'écraser ou de supprimer une vraie entrée "<fichier>.part" du pair.
+
+var keepPartFiles = flag.Bool("keep-part", false, "keep .part files of downloads that failed, for inspection")
+
+const partSuffix = ".part"
+
+// partPattern est le motif os.CreateTemp du fichier temporaire de filePath
+func partPattern(filePath string) string {
+	return "." + filepath.Base(filePath) + ".*" + partSuffix
+}
+
+// fileChunk repère un chunk d'un fichier téléchargé : son hash (vérifié pendant la collecte) et sa taille
+type fileChunk struct {
+	Hash []byte
+	Size int
+}
+
+// writeFileAtomic écrit data à filePath en passant par un fichier .part vérifié contre chunks
+func writeFileAtomic(filePath string, data []byte, chunks []fileChunk) error {
+	part, err := writePart(filePath, data)
+	if part == "" {
+		return err
+	}
+	if err == nil {
+		err = verifyPart(part, chunks)
+	}
+	if err == nil {
+		err = os.Rename(part, filePath)
+	}
+	if err != nil {
+		if !*keepPartFiles {
+			os.Remove(part)
+		}
+		return err
+	}
+	emitProgress(progressWrite, nil, int64(len(data)), filePath)
+	return syncDir(filepath.Dir(filePath))
+}
+
+// keepPartial garde ce qui a été reçu d'un fichier dont le téléchargement a échoué, si -keep-part est donné
+func keepPartial(filePath string, data []byte) {
+	if *keepPartFiles {
+		writePart(filePath, data)
+	}
+}
+
+// writePart écrit data dans un nouveau fichier temporaire à côté de filePath et renvoie son nom
+// ("" s'il n'a pas pu être créé)
+func writePart(filePath string, data []byte) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(filePath), partPattern(filePath))
+	if err != nil {
+		return "", err
+	}
+	err = f.Chmod(0644) //CreateTemp crée en 0600
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	return f.Name(), err
+}
+
+// verifyPart relit le fichier écrit et vérifie que chaque chunk a bien le hash attendu
+func verifyPart(part string, chunks []fileChunk) error {
+	written, err := os.ReadFile(part)
+	if err != nil {
+		return err
+	}
+	for i, c := range chunks {
+		if c.Size > len(written) {
+			return fmt.Errorf("%v: truncated at chunk %d", part, i)
+		}
+		hash := sha256.Sum256(append([]byte{chunkType}, written[:c.Size]...))
+		if !bytes.Equal(hash[:], c.Hash) {
+			return fmt.Errorf("%v: chunk %d does not match its hash", part, i)
+		}
+		written = written[c.Size:]
+	}
+	if len(written) != 0 {
+		return fmt.Errorf("%v: %d unexpected trailing bytes", part, len(written))
+	}
+	return nil
+}
+
+// syncDir rend le renommage durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
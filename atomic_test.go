@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	a, aPart := filepath.Join(dir, "a"), filepath.Join(dir, "a.part")
+	//le pair a deux entrées "a" et "a.part" : écrire l'une ne doit pas toucher l'autre
+	if err := writeFileAtomic(aPart, []byte("sibling"), chunksOf([]byte("sibling"))); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("content of a")
+	if err := writeFileAtomic(a, data, chunksOf(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(a); string(got) != string(data) {
+		t.Fatalf("a contains %q", got)
+	}
+	if got, _ := os.ReadFile(aPart); string(got) != "sibling" {
+		t.Fatalf("a.part contains %q", got)
+	}
+	if info, err := os.Stat(a); err != nil || info.Mode().Perm() != 0644 {
+		t.Fatalf("a written with %v (%v)", info.Mode(), err)
+	}
+
+	//un échec de vérification ne laisse que les deux entrées
+	if err := writeFileAtomic(a, []byte("corrupted"), chunksOf(data)); err == nil {
+		t.Fatalf("corrupted file accepted")
+	}
+	if got, _ := os.ReadFile(a); string(got) != string(data) {
+		t.Fatalf("a replaced by a file that failed verification: %q", got)
+	}
+	if names := dirNames(t, dir); len(names) != 2 {
+		t.Fatalf("directory contains %v after a failure", names)
+	}
+
+	//avec -keep-part, ce qui a été reçu est gardé à part, sans écraser a.part
+	saved := *keepPartFiles
+	*keepPartFiles = true
+	defer func() { *keepPartFiles = saved }()
+	keepPartial(a, []byte("partial"))
+	if got, _ := os.ReadFile(aPart); string(got) != "sibling" {
+		t.Fatalf("keepPartial overwrote a.part with %q", got)
+	}
+	kept, _ := filepath.Glob(filepath.Join(dir, partPattern(a)))
+	if len(kept) != 1 {
+		t.Fatalf("kept part files %v", kept)
+	}
+	if got, _ := os.ReadFile(kept[0]); string(got) != "partial" {
+		t.Fatalf("%v contains %q", kept[0], got)
+	}
+}
+
+// chunksOf découpe data comme un fichier du protocole
+func chunksOf(data []byte) []fileChunk {
+	chunks := make([]fileChunk, 0)
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		hash := sha256.Sum256(append([]byte{chunkType}, data[:n]...))
+		chunks = append(chunks, fileChunk{hash[:], n})
+		data = data[n:]
+	}
+	return chunks
+}
+
+func dirNames(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
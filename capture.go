@@ -0,0 +1,569 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===================================================================================================
+//                                CAPTURE DES DATAGRAMMES
+//===================================================================================================
+
+// Avec -capture fichier, chaque datagramme envoyé ou reçu est enregistré avec l'heure, l'adresse du pair et
+// les champs de l'en-tête ; avec -trace, il est aussi décrit dans le journal (voir dissect.go). Un fichier .pcapng s'ouvre dans Wireshark (paquets IP/UDP reconstitués, sens dans
+// epb_flags, résumé du message en commentaire) ; sinon on écrit une ligne JSON par datagramme.
+// La commande replay relit l'un ou l'autre format (voir replay.go).
+
+var captureFile = flag.String("capture", "", "record every datagram sent and received (pcap-ng if the file ends in .pcapng, JSON lines otherwise)")
+
+const (
+	captureSend = "send"
+	captureRecv = "recv"
+)
+
+// capturedPacket est un datagramme enregistré ; Local est vide quand l'adresse locale n'est pas connue
+type capturedPacket struct {
+	Time  time.Time
+	Dir   string //captureSend, captureRecv, ou vide si la capture ne le dit pas
+	Local string
+	Peer  string
+	Data  []byte
+}
+
+// captureLine est la forme JSON d'un capturedPacket
+type captureLine struct {
+	Time   time.Time `json:"time"`
+	Dir    string    `json:"dir"`
+	Local  string    `json:"local,omitempty"`
+	Peer   string    `json:"peer"`
+	Id     string    `json:"id,omitempty"`
+	Type   *int      `json:"type,omitempty"`
+	Length *int      `json:"length,omitempty"`
+	Data   string    `json:"data"` //datagramme complet en hexadécimal
+	Info   string    `json:"info,omitempty"`
+}
+
+type captureWriter interface {
+	write(p capturedPacket) error
+}
+
+var capture = struct {
+	sync.Mutex
+	w captureWriter
+	f *os.File //fichier de -capture, fermé par closeCapture
+}{}
+
+var traceMessages = flag.Bool("trace", false, "log a one-line description of every datagram sent and received")
+
+// initCapture ouvre le fichier de -capture et, avec -trace, ajoute le journal ; les datagrammes de tous
+// les Transport ouverts ensuite y sont enregistrés
+func initCapture() {
+	writers := make(teeCapture, 0)
+	var file *os.File
+	if *captureFile != "" {
+		f, err := os.Create(*captureFile)
+		if err != nil {
+			slog.Error("Capture", "file", *captureFile, "err", err)
+		} else if strings.HasSuffix(*captureFile, ".pcapng") {
+			w, err := newPcapngWriter(f)
+			if err != nil {
+				slog.Error("Capture", "file", *captureFile, "err", err)
+				f.Close()
+			} else {
+				writers = append(writers, w)
+				file = f
+			}
+		} else {
+			writers = append(writers, &jsonCaptureWriter{f})
+			file = f
+		}
+	}
+	if *traceMessages {
+		writers = append(writers, logCaptureWriter{})
+	}
+	if len(writers) == 0 {
+		return
+	}
+	capture.Lock()
+	capture.w = writers
+	capture.f = file
+	capture.Unlock()
+
+	dial := dialTransport
+	dialTransport = func(addr string) (Transport, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return capturingTransport{conn}, nil
+	}
+}
+
+// recordPacket enregistre data, échangé sur conn dans le sens dir
+func recordPacket(dir string, conn Transport, data []byte) {
+	capture.Lock()
+	defer capture.Unlock()
+	if capture.w == nil {
+		return
+	}
+	p := capturedPacket{Time: clock.Now(), Dir: dir, Peer: conn.RemoteAddr().String(), Data: append([]byte(nil), data...)}
+	if la, ok := conn.(interface{ LocalAddr() net.Addr }); ok {
+		p.Local = la.LocalAddr().String()
+	}
+	if err := capture.w.write(p); err != nil {
+		slog.Error("Capture failed, recording stopped", "err", err)
+		capture.w = nil
+	}
+}
+
+// closeCapture arrête l'enregistrement et ferme le fichier de -capture, à l'arrêt du programme
+func closeCapture() {
+	capture.Lock()
+	defer capture.Unlock()
+	capture.w = nil
+	if capture.f != nil {
+		if err := capture.f.Close(); err != nil {
+			slog.Error("Capture", "file", *captureFile, "err", err)
+		}
+		capture.f = nil
+	}
+}
+
+// capturingTransport enregistre ce qui passe par le Transport qu'il enveloppe
+type capturingTransport struct {
+	Transport
+}
+
+func (c capturingTransport) Read(b []byte) (int, error) {
+	n, err := c.Transport.Read(b)
+	if err == nil {
+		recordPacket(captureRecv, c.Transport, b[:n])
+	}
+	return n, err
+}
+
+func (c capturingTransport) Write(b []byte) (int, error) {
+	n, err := c.Transport.Write(b)
+	if err == nil {
+		recordPacket(captureSend, c.Transport, b)
+	}
+	return n, err
+}
+
+// teeCapture écrit chaque datagramme dans plusieurs captures
+type teeCapture []captureWriter
+
+func (tc teeCapture) write(p capturedPacket) error {
+	for _, w := range tc {
+		if err := w.write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logCaptureWriter décrit chaque datagramme dans le journal (-trace)
+type logCaptureWriter struct{}
+
+func (logCaptureWriter) write(p capturedPacket) error {
+	slog.Info(dissectLine(p.Data), append([]any{"dir", p.Dir, "peer", p.Peer}, datagramAttrs(p.Data)...)...)
+	return nil
+}
+
+//===================================================================================================
+// JSON
+
+type jsonCaptureWriter struct {
+	w io.Writer
+}
+
+func (j *jsonCaptureWriter) write(p capturedPacket) error {
+	line := captureLine{Time: p.Time, Dir: p.Dir, Local: p.Local, Peer: p.Peer, Data: hex.EncodeToString(p.Data), Info: dissectLine(p.Data)}
+	if len(p.Data) >= 7 {
+		typ, length := int(p.Data[4]), int(binary.BigEndian.Uint16(p.Data[5:7]))
+		line.Id, line.Type, line.Length = hex.EncodeToString(p.Data[:4]), &typ, &length
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append(b, '\n')) //une seule écriture par ligne : rien à vider si le programme s'arrête
+	return err
+}
+
+func readJSONCapture(r io.Reader) ([]capturedPacket, error) {
+	packets := make([]capturedPacket, 0)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for i := 1; scanner.Scan(); i++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line captureLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i, err)
+		}
+		data, err := hex.DecodeString(line.Data)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i, err)
+		}
+		packets = append(packets, capturedPacket{line.Time, line.Dir, line.Local, line.Peer, data})
+	}
+	return packets, scanner.Err()
+}
+
+// readCapture lit une capture pcap-ng ou JSON, reconnue à son premier octet
+func readCapture(file string) ([]capturedPacket, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err == nil && binary.LittleEndian.Uint32(magic) == pcapngSHB {
+		return readPcapng(r)
+	}
+	return readJSONCapture(r)
+}
+
+//===================================================================================================
+// pcap-ng (https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-00.html)
+
+const (
+	pcapngSHB       = 0x0A0D0D0A //Section Header Block
+	pcapngIDB       = 0x00000001 //Interface Description Block
+	pcapngEPB       = 0x00000006 //Enhanced Packet Block
+	pcapngByteOrder = 0x1A2B3C4D
+
+	pcapngOptEnd      = 0
+	pcapngOptComment  = 1
+	pcapngOptUserAppl = 4 //dans le SHB
+	pcapngOptName     = 2 //dans l'IDB
+	pcapngOptTsresol  = 9 //dans l'IDB
+	pcapngOptFlags    = 2 //dans l'EPB
+
+	pcapngInbound  = 1
+	pcapngOutbound = 2
+
+	linktypeEthernet = 1
+	linktypeRaw      = 101 //paquets IPv4 ou IPv6 sans en-tête de liaison
+)
+
+type pcapngWriter struct {
+	w io.Writer
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := &pcapngWriter{w}
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], pcapngByteOrder)
+	binary.LittleEndian.PutUint16(shb[4:], 1) //version 1.0
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+	shb = appendPcapngOption(shb, pcapngOptUserAppl, []byte("tp_chroboczek"))
+	shb = appendPcapngOption(shb, pcapngOptEnd, nil)
+	if err := p.block(pcapngSHB, shb); err != nil {
+		return nil, err
+	}
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linktypeRaw)
+	idb = appendPcapngOption(idb, pcapngOptName, []byte("udp"))
+	idb = appendPcapngOption(idb, pcapngOptEnd, nil)
+	if err := p.block(pcapngIDB, idb); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	head := make([]byte, 4)
+	binary.LittleEndian.PutUint16(head[0:], code)
+	binary.LittleEndian.PutUint16(head[2:], uint16(len(value)))
+	b = append(append(b, head...), value...)
+	return append(b, make([]byte, (4-len(value)%4)%4)...)
+}
+
+// block écrit un bloc de type typ et de contenu body (déjà aligné sur 4 octets)
+func (p *pcapngWriter) block(typ uint32, body []byte) error {
+	b := make([]byte, 8, 12+len(body))
+	binary.LittleEndian.PutUint32(b[0:], typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(12+len(body)))
+	b = append(b, body...)
+	b = append(b, b[4:8]...) //la longueur est répétée en fin de bloc
+	_, err := p.w.Write(b)
+	return err
+}
+
+func (p *pcapngWriter) write(pk capturedPacket) error {
+	local, peer := udpAddrOrZero(pk.Local), udpAddrOrZero(pk.Peer)
+	src, dst, flags := local, peer, uint32(pcapngOutbound)
+	if pk.Dir == captureRecv {
+		src, dst, flags = peer, local, pcapngInbound
+	}
+	packet := ipUDPPacket(src, dst, pk.Data)
+
+	ts := uint64(pk.Time.UnixMicro())
+	epb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(len(packet)))
+	epb = append(epb, packet...)
+	epb = append(epb, make([]byte, (4-len(packet)%4)%4)...)
+	flagsB := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flagsB, flags)
+	epb = appendPcapngOption(epb, pcapngOptFlags, flagsB)
+	epb = appendPcapngOption(epb, pcapngOptComment, []byte(dissectLine(pk.Data)))
+	epb = appendPcapngOption(epb, pcapngOptEnd, nil)
+	return p.block(pcapngEPB, epb)
+}
+
+func udpAddrOrZero(s string) *net.UDPAddr {
+	if addr, err := net.ResolveUDPAddr("udp", s); err == nil && s != "" {
+		return addr
+	}
+	return &net.UDPAddr{IP: net.IPv4zero}
+}
+
+// ipUDPPacket reconstitue le paquet IP/UDP qui a transporté data, en IPv4 si les deux adresses le permettent
+func ipUDPPacket(src, dst *net.UDPAddr, data []byte) []byte {
+	udp := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(data)))
+	udp = append(udp, data...)
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(src4, dst4, udp))
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000) //Don't Fragment
+		ip[8], ip[9] = 64, 17                      //TTL, UDP
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], uint16(^onesSum(0, ip)))
+		return append(ip, udp...)
+	}
+	src16, dst16 := src.IP.To16(), dst.IP.To16()
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(src16, dst16, udp))
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6], ip[7] = 17, 64 //UDP, hop limit
+	copy(ip[8:], src16)
+	copy(ip[24:], dst16)
+	return append(ip, udp...)
+}
+
+func onesSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return sum
+}
+
+// udpChecksum calcule la somme de contrôle UDP avec le pseudo-en-tête IPv4 ou IPv6
+func udpChecksum(src, dst net.IP, udp []byte) uint16 {
+	pseudo := append(append([]byte(nil), src...), dst...)
+	if len(src) == 4 {
+		pseudo = append(pseudo, 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	} else {
+		pseudo = append(pseudo, byte(len(udp)>>24), byte(len(udp)>>16), byte(len(udp)>>8), byte(len(udp)), 0, 0, 0, 17)
+	}
+	sum := uint16(^onesSum(onesSum(0, pseudo), udp))
+	if sum == 0 {
+		return 0xffff
+	}
+	return sum
+}
+
+type pcapngInterface struct {
+	linktype uint16
+	tsUnit   time.Duration //durée d'une unité d'horodatage
+}
+
+// readPcapng lit les datagrammes UDP d'une capture pcap-ng (la nôtre, ou celle d'un autre outil sur une
+// interface Ethernet ou IP brute) ; les autres paquets sont ignorés
+func readPcapng(r io.Reader) ([]capturedPacket, error) {
+	packets := make([]capturedPacket, 0)
+	var order binary.ByteOrder = binary.LittleEndian
+	interfaces := make([]pcapngInterface, 0)
+	head := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, head); err == io.EOF {
+			return packets, nil
+		} else if err != nil {
+			return nil, err
+		}
+		typ := order.Uint32(head[0:])
+		if typ == pcapngSHB { //l'ordre des octets est donné par chaque section, juste après la longueur
+			var magic [4]byte
+			if _, err := io.ReadFull(r, magic[:]); err != nil {
+				return nil, err
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic[:]) == pcapngByteOrder:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic[:]) == pcapngByteOrder:
+				order = binary.BigEndian
+			default:
+				return nil, fmt.Errorf("not a pcap-ng file")
+			}
+			interfaces = interfaces[:0]
+		}
+		length := int(order.Uint32(head[4:]))
+		if length < 12 || length%4 != 0 || length > 1<<24 {
+			return nil, fmt.Errorf("bad pcap-ng block length %d", length)
+		}
+		rest := length - 8
+		if typ == pcapngSHB {
+			rest -= 4
+		}
+		block := make([]byte, rest)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, err
+		}
+		body := block[:len(block)-4]
+		switch typ {
+		case pcapngSHB:
+			if len(body) < 12 {
+				return nil, fmt.Errorf("short section header")
+			}
+		case pcapngIDB:
+			if len(body) < 8 {
+				return nil, fmt.Errorf("short interface description")
+			}
+			iface := pcapngInterface{order.Uint16(body[0:]), time.Microsecond}
+			forEachPcapngOption(order, body[8:], func(code uint16, value []byte) {
+				if code == pcapngOptTsresol && len(value) == 1 {
+					iface.tsUnit = tsresolUnit(value[0])
+				}
+			})
+			interfaces = append(interfaces, iface)
+		case pcapngEPB:
+			if len(body) < 20 {
+				return nil, fmt.Errorf("short enhanced packet block")
+			}
+			id := int(order.Uint32(body[0:]))
+			if id >= len(interfaces) {
+				return nil, fmt.Errorf("packet on unknown interface %d", id)
+			}
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			caplen := int(order.Uint32(body[12:]))
+			if caplen > len(body)-20 {
+				return nil, fmt.Errorf("bad captured length %d", caplen)
+			}
+			dir := ""
+			forEachPcapngOption(order, body[20+(caplen+3)/4*4:], func(code uint16, value []byte) {
+				if code == pcapngOptFlags && len(value) == 4 {
+					switch order.Uint32(value) & 3 {
+					case pcapngInbound:
+						dir = captureRecv
+					case pcapngOutbound:
+						dir = captureSend
+					}
+				}
+			})
+			src, dst, data, ok := parseIPUDP(interfaces[id].linktype, body[20:20+caplen])
+			if !ok {
+				continue
+			}
+			p := capturedPacket{Time: time.Unix(0, 0).Add(time.Duration(ts) * interfaces[id].tsUnit), Dir: dir, Data: data}
+			if dir == captureRecv {
+				p.Local, p.Peer = dst.String(), src.String()
+			} else { //envoyé, ou sens inconnu : l'émetteur est pris comme adresse locale
+				p.Local, p.Peer = src.String(), dst.String()
+			}
+			packets = append(packets, p)
+		}
+	}
+}
+
+func forEachPcapngOption(order binary.ByteOrder, opts []byte, f func(code uint16, value []byte)) {
+	for len(opts) >= 4 {
+		code, n := order.Uint16(opts[0:]), int(order.Uint16(opts[2:]))
+		if code == pcapngOptEnd || 4+n > len(opts) {
+			return
+		}
+		f(code, opts[4:4+n])
+		opts = opts[4+(n+3)/4*4:]
+	}
+}
+
+// tsresolUnit décode l'option if_tsresol : 10^-v secondes, ou 2^-v si le bit de poids fort est mis
+func tsresolUnit(v byte) time.Duration {
+	unit := float64(time.Second)
+	for i := 0; i < int(v&0x7f); i++ {
+		if v&0x80 != 0 {
+			unit /= 2
+		} else {
+			unit /= 10
+		}
+	}
+	if unit < 1 {
+		return 1
+	}
+	return time.Duration(unit)
+}
+
+// parseIPUDP extrait les adresses et la charge utile d'un paquet UDP
+func parseIPUDP(linktype uint16, frame []byte) (*net.UDPAddr, *net.UDPAddr, []byte, bool) {
+	if linktype == linktypeEthernet {
+		if len(frame) < 14 {
+			return nil, nil, nil, false
+		}
+		frame = frame[14:]
+	} else if linktype != linktypeRaw {
+		return nil, nil, nil, false
+	}
+	if len(frame) < 1 {
+		return nil, nil, nil, false
+	}
+	var srcIP, dstIP net.IP
+	var udp []byte
+	switch frame[0] >> 4 {
+	case 4:
+		ihl := int(frame[0]&0x0f) * 4
+		if len(frame) < 20 || ihl < 20 || len(frame) < ihl || frame[9] != 17 {
+			return nil, nil, nil, false
+		}
+		srcIP, dstIP, udp = net.IP(frame[12:16]), net.IP(frame[16:20]), frame[ihl:]
+	case 6:
+		if len(frame) < 40 || frame[6] != 17 {
+			return nil, nil, nil, false
+		}
+		srcIP, dstIP, udp = net.IP(frame[8:24]), net.IP(frame[24:40]), frame[40:]
+	default:
+		return nil, nil, nil, false
+	}
+	if len(udp) < 8 {
+		return nil, nil, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(udp[4:]))
+	if length < 8 || length > len(udp) {
+		return nil, nil, nil, false
+	}
+	src := &net.UDPAddr{IP: append(net.IP(nil), srcIP...), Port: int(binary.BigEndian.Uint16(udp[0:]))}
+	dst := &net.UDPAddr{IP: append(net.IP(nil), dstIP...), Port: int(binary.BigEndian.Uint16(udp[2:]))}
+	return src, dst, append([]byte(nil), udp[8:length]...), true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// captureTo enregistre avec w les datagrammes des Transport ouverts ensuite, jusqu'à la fin du test
+func captureTo(t *testing.T, w captureWriter) {
+	dial := dialTransport
+	dialTransport = func(addr string) (Transport, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return capturingTransport{conn}, nil
+	}
+	capture.Lock()
+	capture.w = w
+	capture.Unlock()
+	t.Cleanup(func() {
+		dialTransport = dial
+		capture.Lock()
+		capture.w = nil
+		capture.Unlock()
+	})
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 3)
+	tree, err := BuildMerkleTree(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := newSimNet(44)
+	peer := newSimPeer(tree)
+	peerAddr := sn.Node("192.0.2.10", nil).Listen(8443, peer.handle)
+	client := sn.Node("198.51.100.7", nil)
+	defer useSimNet(sn, client)()
+	*maxAttempts = 30
+
+	var jsonBuf, pcapBuf bytes.Buffer
+	pw, err := newPcapngWriter(&pcapBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	captureTo(t, teeCapture{&jsonCaptureWriter{&jsonBuf}, pw})
+	simDownload(t, sn, client, peerAddr.String(), filepath.Join(t.TempDir(), "root"))
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "c.jsonl"), jsonBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "c.pcapng"), pcapBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fromJSON, err := readCapture(filepath.Join(dir, "c.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPcap, err := readCapture(filepath.Join(dir, "c.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fromJSON) == 0 || len(fromJSON) != len(fromPcap) {
+		t.Fatalf("%d datagrams in JSON, %d in pcap-ng", len(fromJSON), len(fromPcap))
+	}
+	for i, p := range fromJSON {
+		q := fromPcap[i]
+		if p.Dir != q.Dir || p.Peer != q.Peer || !bytes.Equal(p.Data, q.Data) || !p.Time.Truncate(1000).Equal(q.Time) {
+			t.Fatalf("datagram %d: %+v in JSON, %+v in pcap-ng", i, p, q)
+		}
+	}
+
+	//les pertes et les doublons du réseau ne sont pas des problèmes
+	rp := newReplayer()
+	for _, p := range fromPcap {
+		if verdict, problem := rp.packet(p); problem {
+			t.Fatalf("replay of %v: %v", dissectLine(p.Data), verdict)
+		}
+	}
+
+	//un Datum altéré est signalé
+	for _, p := range fromJSON {
+		if p.Dir == captureRecv && len(p.Data) > 7+32+1 && p.Data[4] == 131 {
+			p.Data = append([]byte(nil), p.Data...)
+			p.Data[len(p.Data)-1] ^= 1
+			if _, problem := newReplayer().packet(p); !problem {
+				t.Fatalf("corrupted Datum not reported")
+			}
+			break
+		}
+	}
+}
+
+func TestReplayUnanswered(t *testing.T) {
+	rp := newReplayer()
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 10; i++ { //des PublicKey sans réponse, d'Id différents
+		data := []byte{0, 0, 0, byte(i), 1, 0, 0}
+		rp.packet(capturedPacket{Time: start.Add(time.Duration(i) * time.Millisecond), Dir: captureSend, Peer: "192.0.2.10:8443", Data: data})
+	}
+	reqs := rp.unanswered()
+	if len(reqs) != 10 {
+		t.Fatalf("%d unanswered requests, want 10", len(reqs))
+	}
+	for i, req := range reqs {
+		if !req.time.Equal(start.Add(time.Duration(i) * time.Millisecond)) {
+			t.Fatalf("request %d sent at %v, not in capture order", i, req.time)
+		}
+	}
+}
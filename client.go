@@ -2,20 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -33,14 +38,16 @@ var jchPeersAddr = "https://jch.irif.fr:8082/peers/"
 var jchRootAddr = "https://jch.irif.fr:8082/peers/jch.irif.fr/root"
 var jchAddr = "https://jch.irif.fr:8082/peers/jch.irif.fr/addresses"
 
+// Id n'est plus que l'Id de secours de newID : chaque requête a son propre Id, tiré par newID, pour que
+// les sessions en parallèle (passerelle, navigateur, swarm) n'écrivent jamais une variable partagée
 var Id = []byte{byte(0x4), byte(0x8), byte(0xf), byte(0x10)}
 
 func newID() []byte {
 	new_id := make([]byte, 4)
 	_, err := rand.Read(new_id)
 	if err != nil {
-		fmt.Println("error new Id:", err)
-		return Id
+		slog.Warn("Random Id unavailable, using the fallback Id", "err", err)
+		return append([]byte(nil), Id...)
 	}
 	return new_id
 }
@@ -49,11 +56,10 @@ func newID() []byte {
 //						UDP Message
 //================================================================================
 
-func UDPInit(url string) *net.UDPConn {
-	raddr, _ := net.ResolveUDPAddr("udp", url)
-	conn, errD := net.DialUDP("udp", nil, raddr)
+func UDPInit(url string) Transport {
+	conn, errD := dialTransport(url)
 	if errD != nil {
-		log.Printf("Connection error %v\n", errD)
+		slog.Warn("Connection error", "addr", url, "err", errD)
 		return nil
 	}
 	return conn
@@ -63,145 +69,248 @@ func NewMessage(I []byte, T []byte, B []byte, privK *ecdsa.PrivateKey) Message {
 	Longueur := make([]byte, 2)
 	sig := make([]byte, 0, 64)
 	signature := make([]byte, 0)
-	if len(I) != 4 {
-		log.Fatal("Invalid Id length on message initialisation")
-	}
-	if len(T) != 1 {
-		log.Fatal("Invalid Type length on message initialisation")
+	if len(I) != 4 || len(T) != 1 { //erreur de programmation, pas une donnée reçue
+		panic(fmt.Sprintf("NewMessage: Id of %d bytes and Type of %d bytes, want 4 and 1", len(I), len(T)))
 	}
 	binary.BigEndian.PutUint16(Longueur[0:], uint16(len(B)))
 	if privK != nil {
-		data := append(I, T...)
+		data := append(append([]byte(nil), I...), T...) //copie : I peut être une tranche d'un tampon plus grand
 		data = append(data, Longueur...)
 		data = append(data, B...)
 		sign := sha256.Sum256(data)
 		r, s, err := ecdsa.Sign(rand.Reader, privK, sign[:])
-		if err != nil {
-			log.Fatal("Error while signing message")
+		if err != nil { //le message part sans signature, le pair le refusera
+			slog.Error("Signing failed, message sent unsigned", idAttr(I), typeAttr(T[0]), "err", err)
+		} else {
+			sig1 := r.FillBytes(sig[:32])
+			sig2 := s.FillBytes(sig[32:64])
+			signature = append(signature, sig1...)
+			signature = append(signature, sig2...)
 		}
-		sig1 := r.FillBytes(sig[:32])
-		sig2 := s.FillBytes(sig[32:64])
-		signature = append(signature, sig1...)
-		signature = append(signature, sig2...)
 	}
 	mess := Message{I, T, Longueur, B, signature}
 	return mess
 }
 
 func MessageToBytes(mess Message) []byte {
-	ret := append(mess.Id, mess.Type...)
+	ret := make([]byte, 0, 7+len(mess.Body)+len(mess.Sign))
+	ret = append(ret, mess.Id...)
+	ret = append(ret, mess.Type...)
 	ret = append(ret, mess.Length...)
 	ret = append(ret, mess.Body...)
 	ret = append(ret, mess.Sign...)
 	return ret
 }
 
-func BytesToMessage(tab []byte, pubK *ecdsa.PublicKey) Message {
+var errBadSignature = errors.New("invalid signature")
+
+// parseMessage décode un datagramme reçu. Le datagramme vient du réseau : il peut être tronqué ou annoncer
+// une longueur plus grande que ce qui a été reçu. Si pubK est donnée, le message doit être suivi d'une
+// signature valide. Les champs du message sont des copies, tab peut être réutilisé ensuite.
+func parseMessage(tab []byte, pubK *ecdsa.PublicKey) (Message, error) {
+	if len(tab) < 7 {
+		return Message{}, fmt.Errorf("message too short (%d bytes)", len(tab))
+	}
+	length := int(binary.BigEndian.Uint16(tab[5:7]))
+	if len(tab) < length+7 {
+		return Message{}, fmt.Errorf("message announces %d bytes of body, got %d", length, len(tab)-7)
+	}
 	signature := make([]byte, 0, 64)
-	var r, s big.Int
-	length := binary.BigEndian.Uint16(tab[5:7])
 	if pubK != nil {
-		if len(tab) != int(length)+7+64 {
-			log.Fatal("Message is not of appropriate length for signed message")
+		if len(tab) != length+7+64 {
+			return Message{}, fmt.Errorf("message is not of appropriate length for signed message")
 		}
+		var r, s big.Int
 		data := sha256.Sum256(tab[:length+7])
-		signature = tab[length+7:]
+		signature = append(signature, tab[length+7:]...)
 		r.SetBytes(signature[:32])
 		s.SetBytes(signature[32:64])
-		ok := ecdsa.Verify(pubK, data[:], &r, &s)
-		if !ok {
-			log.Fatal("Invalid signature")
+		if !ecdsa.Verify(pubK, data[:], &r, &s) {
+			return Message{}, errBadSignature
+		}
+	}
+	mess := Message{
+		Id:     append([]byte(nil), tab[:4]...),
+		Type:   append([]byte(nil), tab[4:5]...),
+		Length: append([]byte(nil), tab[5:7]...),
+		Body:   append(make([]byte, 0, length), tab[7:length+7]...),
+		Sign:   signature,
+	}
+	return mess, nil
+}
+
+// BytesToMessage décode tab ; un datagramme mal formé ou mal signé est remplacé par un message d'erreur
+// (type 254) qui ne correspond à aucune requête en attente
+func BytesToMessage(tab []byte, pubK *ecdsa.PublicKey) Message {
+	return messageFrom(nil, tab, pubK)
+}
+
+// messageFrom est BytesToMessage pour un datagramme reçu de addr : s'il est mal formé ou mal signé,
+// il compte pour le bannissement temporaire de l'adresse (voir limits.go)
+func messageFrom(addr net.Addr, tab []byte, pubK *ecdsa.PublicKey) Message {
+	mess, err := parseMessage(tab, pubK)
+	if err != nil {
+		slog.Warn("Dropping malformed message", append(datagramAttrs(tab), peerAttr(addr), "err", err)...)
+		strike(addr, err)
+		if err == errBadSignature {
+			metrics.badSignatures.inc("")
+		} else {
+			metrics.malformed.inc("")
+		}
+		id := make([]byte, 4)
+		if len(tab) >= 4 {
+			copy(id, tab[:4])
 		}
+		return NewMessage(id, []byte{254}, []byte(err.Error()), nil)
 	}
-	mess := NewMessage(tab[:4], tab[4:5], tab[7:length+7], nil)
 	return mess
 }
 
 // génère message d'erreur à partir d'un message erroné
-func ErrorMessageSender(mess Message, str string, conn *net.UDPConn, privK *ecdsa.PrivateKey) {
+func ErrorMessageSender(mess Message, str string, conn Transport, privK *ecdsa.PrivateKey) {
 	mess.Type[0] = byte(254)
 	tmp := []byte(str)
 	mess.Body = tmp
 	mess = NewMessage(mess.Id, mess.Type, mess.Body, privK)
 	MessageSender(conn, mess)
-	Id = newID() //Actualisation de Id
 }
 
 func TypeChecker(mess Message, typ int16) bool {
 	typB := make([]byte, 1)
 	typB[0] = byte(typ)
 	if !bytes.Equal(mess.Type, typB) {
-		log.Printf("Unvalid type : expected %v, got %v\n", typB, mess.Type)
 		if mess.Type[0] == 254 {
-			log.Printf("%v\n", string(mess.Body))
+			slog.Info("Unexpected reply", "want", messageTypeName(typB[0]), idAttr(mess.Id), typeAttr(mess.Type[0]), "error", string(mess.Body))
+		} else {
+			slog.Info("Unexpected reply", "want", messageTypeName(typB[0]), idAttr(mess.Id), typeAttr(mess.Type[0]))
 		}
 		return false
 	}
 	return true
 }
 
-func MessageSender(conn *net.UDPConn, mess Message) {
+func MessageSender(conn Transport, mess Message) {
 	byt := MessageToBytes(mess)
 	_, err := conn.Write(byt)
 	if err != nil {
-		log.Printf("Failed to send message %v to connexion %v", mess, conn)
+		slog.Warn("Send failed", append(datagramAttrs(byt), peerAttr(conn.RemoteAddr()), "err", err)...)
 		return
 	}
+	countDatagram(metrics.sent, byt)
+	slog.Debug("Sent", append(datagramAttrs(byt), peerAttr(conn.RemoteAddr()))...)
 }
 
-func MessageListener(conn *net.UDPConn, sended Message, repeat bool, pubK *ecdsa.PublicKey) Message {
-	messB := make([]byte, 1064)
-	err := conn.SetReadDeadline(time.Now().Add(2000 * time.Millisecond))
-	if err != nil {
-		log.Fatalf("Timeout Set error %d\n", err)
-	}
-	var i int = 0
-	var j int = 0
+// MessageListener attend un message sur conn. Si repeat est vrai, sended est retransmis à chaque timeout,
+// au plus maxAttempts fois ; le délai d'attente s'adapte au RTT mesuré avec ce pair (voir rtt.go).
+func MessageListener(conn Transport, sended Message, repeat bool, pubK *ecdsa.PublicKey) Message {
+	messB := make([]byte, 1064+64) //Datum le plus long, avec sa signature
+	est := rttFor(conn.RemoteAddr())
+	wait := est.timeout()
+	start := clock.Now()
+	retransmitted := false
 
-	//attente exponentielle d'une réponse
 	var errRead error
-	for j < 5 {
-		var delay int = 2
-		for i < 5 {
-			_, errRead = conn.Read(messB)
-			if errRead != nil {
-				err = conn.SetReadDeadline(time.Now().Add(time.Duration(delay) * 200 * time.Millisecond))
-				if err != nil {
-					log.Fatalf("Timeout Set error %d\n", err)
-				}
-				delay *= 2
-				i++
-			} else {
-				//fmt.Printf("\n\n%v\n\n", messB)
+	n := 0
+	for attempt := 1; ; attempt++ {
+		err := conn.SetReadDeadline(clock.Now().Add(wait))
+		if err != nil { //socket fermée : personne ne répondra
+			slog.Error("Cannot set read deadline", peerAttr(conn.RemoteAddr()), "err", err)
+			errRead = err
+			break
+		}
+		n, errRead = conn.Read(messB)
+		for errRead == nil {
+			countDatagram(metrics.received, messB[:n])
+			slog.Debug("Received", append(datagramAttrs(messB[:n]), peerAttr(conn.RemoteAddr()))...)
+			if !admitDatagram(conn.RemoteAddr(), messB[:n]) { //adresse bannie ou au-delà de ses limites (voir limits.go)
+				n, errRead = conn.Read(messB)
+				continue
+			}
+			if awaitsRoot(sended, messB[:n]) || !serveRequest(conn, messB[:n]) { //un GetDatum du pair n'est pas notre réponse
 				break
 			}
+			n, errRead = conn.Read(messB)
 		}
 		if errRead == nil {
 			break
 		}
-		if !repeat { //si on decide de ne pas répéter la requette on s'arrête là
+		if attempt >= *maxAttempts {
 			break
 		}
-		if i == 5 {
-			MessageSender(conn, sended)
+		if !repeat { //si on decide de ne pas répéter la requette on se contente d'attendre plus longtemps,
+			wait = clampRTO(2 * wait) //sans toucher au délai du pair : rien n'a été réémis
 		} else {
-			break
+			est.backoff() //seule une retransmission double le délai du pair (RFC 6298)
+			wait = est.timeout()
+			slog.Info("No answer, retransmitting", peerAttr(conn.RemoteAddr()), idAttr(sended.Id), typeAttr(sended.Type[0]), "attempt", attempt+1, "max", *maxAttempts, "timeout", est.timeout())
+			MessageSender(conn, sended)
+			retransmitted = true
+			metrics.retransmits.inc(messageTypeName(sended.Type[0]))
+			if sended.Type[0] == 3 { //GetDatum
+				emitProgress(progressRetransmit, sended.Body, 0, "")
+			}
 		}
-		j++
 	}
 	if errRead != nil { //Si on à la fin on a toujours pas réussi à écouter un message
+		metrics.timeouts.inc(messageTypeName(sended.Type[0]))
 		messB[4] = byte(254)
 		rep := []byte("Pas de réponse")
 		binary.BigEndian.PutUint16(messB[5:7], uint16(len(rep)))
 		errMess := NewMessage(messB[:4], messB[4:5], rep, nil)
 		return errMess
 	}
-	//on va tronquer messB car on risque des pbs de diff entre la longueur de messB (1024) et la longueur réelle du message
-	mess := BytesToMessage(messB, pubK)
+	mess := messageFrom(conn.RemoteAddr(), messB[:n], pubK)
+	//Règle de Karn : pas de mesure si la requête a été retransmise
+	if repeat && !retransmitted && bytes.Equal(mess.Id, sended.Id) {
+		est.sample(clock.Now().Sub(start))
+	}
+	if sended.Type[0] == 0 && mess.Type[0] == 128 && bytes.Equal(mess.Id, sended.Id) { //HelloReply à notre Hello
+		validateSource(conn.RemoteAddr())
+	}
 	return mess
 }
 
-func NATTravMessage(peeraddr [][]byte, connJCH *net.UDPConn, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) *net.UDPConn {
+// natTraversalBody code addr ("hôte:port") comme dans une demande de traversée de NAT : l'adresse IP
+// (4 octets pour IPv4, 16 pour IPv6) suivie du port sur 2 octets
+func natTraversalBody(addr string) ([]byte, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := udpAddr.IP.To4() //ResolveUDPAddr renvoie les adresses IPv4 sur 16 octets
+	if ip == nil {
+		ip = udpAddr.IP.To16()
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("no IP address in %q", addr)
+	}
+	body := make([]byte, len(ip)+2)
+	copy(body, ip)
+	binary.BigEndian.PutUint16(body[len(ip):], uint16(udpAddr.Port))
+	return body, nil
+}
+
+// parseNATAddress décode une adresse codée par natTraversalBody, comme celle que le serveur relaie
+func parseNATAddress(body []byte) (*net.UDPAddr, error) {
+	if len(body) != 4+2 && len(body) != 16+2 {
+		return nil, fmt.Errorf("bad NAT traversal address length %d", len(body))
+	}
+	ip := append(net.IP(nil), body[:len(body)-2]...)
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(body[len(body)-2:]))}, nil
+}
+
+// answerHello répond au Hello reçu sur conn par un HelloReply signé, et le renvoie. Le HelloReply reprend le corps
+// du Hello : pour l'anti-amplification on ne compte pas sa signature, sinon un Hello non signé avec un nom court
+// (7+4+n+64 > 3*(7+4+n)) resterait sans réponse et la traversée de NAT échouerait
+func answerHello(conn Transport, hello Message, privK *ecdsa.PrivateKey) Message {
+	reply := NewMessage(hello.Id, []byte{128}, hello.Body, privK)
+	if admitReply(conn.RemoteAddr(), 7+len(reply.Body)) {
+		MessageSender(conn, reply)
+	}
+	return reply
+}
+
+func NATTravMessage(peeraddr [][]byte, connJCH Transport, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) Transport {
 	//Préparation du message à envoyer au serveur
 	T := make([]byte, 1)
 	I := make([]byte, 4)
@@ -217,32 +326,31 @@ func NATTravMessage(peeraddr [][]byte, connJCH *net.UDPConn, privK *ecdsa.Privat
 
 	Type := make([]byte, 1)
 	Type[0] = 0
-	helloMess := NewMessage(Id, Type, hello, privK)
+	helloMess := NewMessage(newID(), Type, hello, privK)
 	//Fin préparation du Hello
 
 	checker := false
 	cmptr := 0
 
 	for !checker && (cmptr < len(peeraddr)) {
-		addr, _ := net.ResolveUDPAddr("udp", string(peeraddr[cmptr]))
-		fmt.Printf("len : %v addr : %v addr bytes : %v\n", len(addr.IP), addr.IP, []byte(addr.IP))
-		test_port := make([]byte, 2)
-		binary.BigEndian.PutUint16(test_port[0:], uint16(addr.Port))
-		fmt.Printf("port : %v port bytes %v\n", addr.Port, test_port)
-
-		ip := append([]byte(addr.IP), test_port...)
-		mess.Body = ip
+		ip, err := natTraversalBody(string(peeraddr[cmptr]))
+		if err != nil {
+			cmptr++
+			continue
+		}
+		addr, _ := parseNATAddress(ip)
+		mess = NewMessage(mess.Id, mess.Type, ip, privK)
 
-		fmt.Printf("Message construit : %v\n\n", mess)
+		slog.Debug("NAT traversal request", "to", addr, idAttr(mess.Id))
 
 		//Envoie de la requette de traversée de NAT au serveur
 		MessageSender(connJCH, mess) //Envoyé à jch obiligatoirement
 
 		//Attente que la demande soit transmise au client par le serveur
-		time.Sleep(1 * time.Second)
+		clock.Sleep(1 * time.Second)
 		//Envoi d'un Hello au client
 		//Initialisation de la connexion avec le client
-		connP2P, errD := net.DialUDP("udp", nil, addr)
+		connP2P, errD := dialTransport(addr.String())
 		if errD == nil {
 
 			//Envoi du Hello
@@ -253,14 +361,14 @@ func NATTravMessage(peeraddr [][]byte, connJCH *net.UDPConn, privK *ecdsa.Privat
 			rep := MessageListener(connP2P, helloMess, false, bobK)
 			//si on a un retour
 			if (rep.Type[0] == 0) && !(bytes.Equal(rep.Id[:4], make([]byte, 4))) { //Message hello et Id non nul
-				rep.Type[0] = 128 //type de hello reply, on utilise rep car il y a deja le bon id dedans
-				rep = NewMessage(rep.Id, rep.Type, rep.Body, privK)
-				MessageSender(connP2P, rep) //On envoie un hello reply au hello qu'on vient de recevoir
+				rep = answerHello(connP2P, rep, privK) //On envoie un hello reply au hello qu'on vient de recevoir
 				//on peut aussi écouter le helloReply qu'on est censés recevoir en retour de notre hello
 				rep = MessageListener(connP2P, rep, true, nil)
 				//fmt.Printf("HelloReply mess normalement : %v\n", rep)
 				if !bytes.Equal(rep.Id[:4], Id_tmp_client1) {
-					fmt.Printf("Erreur : Helloreply avec le mauvais Id\n")
+					slog.Warn("HelloReply with the wrong Id", peerAttr(connP2P.RemoteAddr()), idAttr(rep.Id))
+				} else if rep.Type[0] == 128 {
+					validateSource(connP2P.RemoteAddr())
 				}
 
 				//à ce moment là le NAT est traversé, on peut dialoguer directement avec le client, je pense qu'il faudrait faire un return connP2P
@@ -268,7 +376,6 @@ func NATTravMessage(peeraddr [][]byte, connJCH *net.UDPConn, privK *ecdsa.Privat
 			}
 
 			//et sinon, si on n'a pas réussi les étapes précédentes, on passe à l'adresse suivante.
-		} else {
 			connP2P.Close()
 		}
 		cmptr++
@@ -276,95 +383,170 @@ func NATTravMessage(peeraddr [][]byte, connJCH *net.UDPConn, privK *ecdsa.Privat
 	return nil
 }
 
+// checkHash vérifie que le corps d'un Datum (hash puis valeur) correspond à son hash ; faux s'il est trop court
 func checkHash(mess Message) bool {
+	if len(mess.Body) < 32 {
+		return false
+	}
 	check := sha256.Sum256(mess.Body[32:])
 	return bytes.Equal(check[:], mess.Body[:32])
 }
 
-func collectDataFile(mess Message, conn *net.UDPConn, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, out *[]byte) { //c'est en fait un deep first search
-	if !TypeChecker(mess, 131) { //Il faut que ce soit un message Datum
-		ErrorMessageSender(mess, "Bad type\n", conn, privK)
+var errNoDatum = errors.New("peer has no datum for this hash")
+var errBadHash = errors.New("datum does not match requested hash")
+var errBadDatum = errors.New("malformed datum")
+
+// checkDatumReply vérifie que response est un Datum pour hash, dont la valeur est bien formée : après elle,
+// response.Body[32:] est une valeur que checkDatum accepte
+func checkDatumReply(response Message, hash []byte) error {
+	if len(response.Type) == 1 && response.Type[0] == 132 { //NoDatum
+		return errNoDatum
 	}
-	dataType := mess.Body[32] //c'est à cet endroit qu'est codé le type de data, après les 32 premiers octet du hash de notre requette
-	if dataType == 2 {        //On est dans un directory
-		log.Printf("You are not in a File or BigFile\n")
-		return
+	if !TypeChecker(response, 131) {
+		return fmt.Errorf("no datum for %x", hash)
 	}
-	if dataType == 1 { //On est dans un BigFile
-		nbNodes := (binary.BigEndian.Uint16(mess.Length) - 33) / 32 //le - 33 est du au fait que la réponse contient le hash que l'on a demandé, ensuite dans un chunk, il n'y a que des hash, pas de noms d'où la division par 32 et non 64
-		for i := 0; i < int(nbNodes); i++ {
-			//Faire getdatum
-			Type := make([]byte, 1)
-			Type[0] = 3 //getDatum
-			Id = newID()
-			giveMeData := NewMessage(Id, Type, mess.Body[33+32*i:33+32*(i+1)], privK)
-
-			nb_try := 0
-			MessageSender(conn, giveMeData)
-			response := MessageListener(conn, giveMeData, true, bobK)
-			for !checkHash(response) && (nb_try < 10) {
-				log.Printf("Bad hash")
-				MessageSender(conn, giveMeData)
-				response = MessageListener(conn, giveMeData, true, bobK)
+	if len(response.Body) < 33 || !checkHash(response) || !bytes.Equal(response.Body[:32], hash) {
+		return errBadHash
+	}
+	if checkDatum(response.Body[32:]) != nil {
+		return errBadDatum
+	}
+	return nil
+}
 
+// getDatum envoie un GetDatum pour hash et renvoie le Datum reçu, après avoir vérifié qu'il correspond bien à hash
+func getDatum(conn Transport, hash []byte, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) (Message, error) {
+	Type := make([]byte, 1)
+	Type[0] = 3 //getDatum
+	giveMeData := NewMessage(newID(), Type, hash, privK)
+
+	emitProgress(progressQueued, nil, 1, "")
+	emitProgress(progressRequest, hash, 0, "")
+	MessageSender(conn, giveMeData)
+	response := MessageListener(conn, giveMeData, true, bobK)
+	if err := checkDatumReply(response, hash); err != nil {
+		switch err {
+		case errBadHash:
+			metrics.badHashes.inc("")
+		case errBadDatum:
+			slog.Warn("Malformed datum", peerAttr(conn.RemoteAddr()), hashAttr(hash), "err", checkDatum(response.Body[32:]))
+			metrics.malformed.inc("")
+		}
+		return response, err
+	}
+	emitProgress(progressReceive, hash, int64(len(response.Body)-32), "")
+	metrics.bytesDownloaded.add("", uint64(len(response.Body)-32))
+	datums.put(peerNameOf(conn.RemoteAddr()), hash, response.Body[32:])
+	return response, nil
+}
+
+// collectDataFile reconstitue dans out le contenu du File ou BigFile mess, et note dans chunks le hash et la taille
+// de chaque chunk. L'arbre est parcouru niveau par niveau : tous les fils d'un niveau sont demandés en même temps
+// (voir fetchDatums), et chaque Datum reçu est vérifié contre le hash demandé.
+func collectDataFile(ctx context.Context, mess Message, conn Transport, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, out *[]byte, chunks *[]fileChunk) error {
+	if !TypeChecker(mess, 131) { //Il faut que ce soit un message Datum
+		ErrorMessageSender(mess, "Bad type\n", conn, privK)
+		return fmt.Errorf("not a datum")
+	}
+	nodes := []Message{mess}
+	for {
+		//hash de tous les fils des BigFile du niveau courant
+		hashes := make([][]byte, 0)
+		for _, n := range nodes {
+			dataType := n.Body[32] //c'est à cet endroit qu'est codé le type de data, après les 32 premiers octet du hash de notre requette
+			if dataType == 2 {     //On est dans un directory
+				slog.Warn("Not a File or BigFile", hashAttr(n.Body[:32]))
+				return fmt.Errorf("not a file")
+			}
+			if dataType == 1 { //BigFile : après le hash et le type il n'y a que des hash, pas de noms
+				for i := 33; i+32 <= len(n.Body); i += 32 {
+					hashes = append(hashes, n.Body[i:i+32])
+				}
 			}
-			collectDataFile(response, conn, privK, bobK, out)
 		}
+		if len(hashes) == 0 {
+			break //il ne reste que des chunks
+		}
+		fetched, err := fetchDatums(ctx, conn, hashes, privK, bobK)
+		if err != nil {
+			return err
+		}
+		next := make([]Message, 0, len(hashes))
+		for _, n := range nodes {
+			if n.Body[32] != 1 {
+				next = append(next, n)
+				continue
+			}
+			for i := 33; i+32 <= len(n.Body); i += 32 {
+				next = append(next, fetched[string(n.Body[i:i+32])])
+			}
+		}
+		nodes = next
+	}
+	for _, n := range nodes { //dataType = 0 on est donc dans un chunk
+		*out = append(*out, n.Body[33:]...)
+		*chunks = append(*chunks, fileChunk{n.Body[:32], len(n.Body) - 33})
+	}
+	return nil
+}
+
+func collectDirectory(ctx context.Context, mess Message, conn Transport, fileName string, filePath string, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, dl *download) {
+	if ctx.Err() != nil { //arrêt demandé : ce qui reste n'est pas téléchargé
+		dl.failed = append(dl.failed, filePath)
 		return
-	} else { //dataType = 0 on est donc dans un chunk
-		*out = append(*out, mess.Body[33:]...)
+	}
+	//On n'écrit jamais en dehors du dossier de téléchargement
+	if err := insideDir(dl.root, filePath); err != nil {
+		dl.reject(filePath, err.Error())
 		return
 	}
-
-}
-func collectDirectory(mess Message, conn *net.UDPConn, fileName string, filePath string, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) {
+	dl.manifest = append(dl.manifest, manifestLine(mess.Body[:32], filePath, dl.root))
 	if mess.Body[32] != 2 {
 		//On est sur un File ou big file
+		emitProgress(progressFile, mess.Body[:32], 0, filePath)
 		out := make([]byte, 0)
-		collectDataFile(mess, conn, privK, bobK, &out)
-		//Création du fichier dans lequel on va écrire les données
-		f, errr := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0755) //Création du fichier dans lequel on va écrire les données
-		if errr != nil {
-			fmt.Printf("Err open\n")
-			log.Fatal(errr)
+		chunks := make([]fileChunk, 0)
+		err := collectDataFile(ctx, mess, conn, privK, bobK, &out, &chunks)
+		if err == nil {
+			err = writeFileAtomic(filePath, out, chunks)
+		} else {
+			keepPartial(filePath, out)
 		}
-		//écriture dans le fichier
-		_, errr = f.Write(out)
-		if errr != nil {
-			fmt.Printf("Err write\n")
-			log.Fatal(errr)
+		if err != nil {
+			slog.Warn("Download failed", "path", filePath, "err", err)
+			dl.failed = append(dl.failed, filePath)
 		}
-
-		f.Close()
 		return
 	} else {
 		//Création du répertoire avec le nom fileName
 		err := os.MkdirAll(filePath, 0755)
 		if err != nil {
-			log.Printf("Erreur création de dossier")
-		}
-		nb_nodes := (binary.BigEndian.Uint16(mess.Length) - 33) / 64
-		for i := 0; i < int(nb_nodes); i++ {
-			//Faire getdatum
-			Type := make([]byte, 1)
-			Type[0] = 3 //getDatum
-			Length := make([]byte, 2)
-			binary.BigEndian.PutUint16(Length[0:], uint16(32)) //Lenght = 32
-
-			giveMeData := NewMessage(Id, Type, mess.Body[33+64*(i+1)-32:33+64*(i+1)], privK) //On met le bon hash dedans
-			new_fileName := string(mess.Body[33+64*i : 33+64*i+32])
-			new_fileName = strings.Trim(new_fileName, string(0))
-
-			new_filePath := filePath + "/" + new_fileName
-
-			MessageSender(conn, giveMeData)
-			Id = newID()
-			response := MessageListener(conn, giveMeData, true, bobK)
-			if !checkHash(response) {
-				log.Printf("Bad hash")
-				return
-			}
-			collectDirectory(response, conn, new_fileName, new_filePath, privK, bobK)
+			slog.Warn("Cannot create directory", "err", err)
+		}
+		entries, err := parseDirectory(mess.Body[32:])
+		if err != nil {
+			dl.reject(filePath, err.Error())
+			return
+		}
+		//Les noms viennent du pair : on refuse ceux qui pourraient sortir du dossier
+		entries, rejected := filterEntries(entries)
+		for _, r := range rejected {
+			dl.reject(filePath, r)
+		}
+		//On demande toutes les entrées du répertoire d'un coup
+		hashes := make([][]byte, 0, len(entries))
+		for _, e := range entries {
+			hashes = append(hashes, e.Hash)
+		}
+		fetched, err := fetchDatums(ctx, conn, hashes, privK, bobK)
+		if err != nil {
+			slog.Warn("Download failed", "path", filePath, "err", err)
+			dl.failed = append(dl.failed, filePath)
+			return
+		}
+		for _, e := range entries {
+			new_filePath := filePath + "/" + e.Name
+			collectDirectory(ctx, fetched[string(e.Hash)], conn, e.Name, new_filePath, privK, bobK, dl)
 		}
 	}
 }
@@ -379,13 +561,13 @@ func HttpRequest(method, addr string, client http.Client) ([]byte, error) {
 	bodyIfErr := make([]byte, 1)
 
 	if err != nil {
-		log.Printf("NewRequest: %v", err)
+		slog.Warn("HTTP request", "method", method, "url", addr, "err", err)
 		return bodyIfErr, err
 	}
 
 	r, err := client.Do(req)
 	if err != nil {
-		log.Printf("Get: %v", err)
+		slog.Warn("HTTP request", "method", method, "url", addr, "err", err)
 		return bodyIfErr, err
 	}
 
@@ -393,7 +575,7 @@ func HttpRequest(method, addr string, client http.Client) ([]byte, error) {
 	r.Body.Close()
 
 	if err != nil {
-		log.Printf("Read: %v", err)
+		slog.Warn("HTTP response", "method", method, "url", addr, "err", err)
 		return bodyIfErr, err
 	}
 
@@ -412,31 +594,38 @@ func ParseREST(body []byte) [][]byte {
 	return ids
 }
 
-func PeerSelector(ids [][]byte, client http.Client) ([][]byte, string, string) {
+func PeerSelector(ctx context.Context, out io.Writer, ids [][]byte, client http.Client) ([][]byte, string, string, error) {
 	for i, id := range ids {
-		fmt.Printf("%v %v: %v\n", i, "peers", string(id))
+		fmt.Fprintf(out, "%v %v: %v\n", i, "peers", string(id))
+	}
+	fmt.Fprintf(out, "\n\nQuel pair voulez vous contacter?\nEntrez le numéro du pair\n")
+	j, err := readNumber(ctx)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if j < 0 || j >= len(ids) {
+		return nil, "", "", fmt.Errorf("no peer number %d", j)
 	}
-	fmt.Printf("\n\nQuel pair voulez vous contacter?\nEntrez le numéro du pair\n")
-	var j int
-	fmt.Scanf("%d", &j)
 	peerAddr := jchPeersAddr + string(ids[j])
 	addr := peerAddr + "/addresses"
 
-	fmt.Printf("Vous allez contacter %v\n", string(ids[j]))
+	fmt.Fprintf(out, "Vous allez contacter %v\n", string(ids[j]))
 
 	reponse, err := HttpRequest("GET", addr, client)
 	if err != nil {
-		log.Fatalf("Error get peers addresses: %v\n", err)
+		return nil, "", "", fmt.Errorf("addresses of %v: %w", string(ids[j]), err)
 	}
 	reponse2 := ParseREST(reponse)
-	return reponse2, peerAddr, string(ids[j])
+	return reponse2, peerAddr, string(ids[j]), nil
 }
 
 //===================================================================================================
 //                                SUBROUTINES
 //===================================================================================================
 
-func HelloRepeater(conn *net.UDPConn, ourPrivKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) {
+// HelloRepeater envoie un Hello au serveur toutes les 30 secondes, en répondant entre temps aux GetDatum,
+// jusqu'à l'annulation de ctx
+func HelloRepeater(ctx context.Context, conn Transport, ourPrivKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) {
 	ext := make([]byte, 4)
 	name := "panic"
 	hello := append(ext, []byte(name)...)
@@ -446,242 +635,327 @@ func HelloRepeater(conn *net.UDPConn, ourPrivKey *ecdsa.PrivateKey, bobK *ecdsa.
 	Length := make([]byte, 2)
 	binary.BigEndian.PutUint16(Length[0:], uint16(len(hello)))
 
-	for {
-		Id = newID()
-		helloMess := NewMessage(Id, Type, hello, ourPrivKey)
+	for ctx.Err() == nil {
+		helloMess := NewMessage(newID(), Type, hello, ourPrivKey)
 		MessageSender(conn, helloMess)
 		response := MessageListener(conn, helloMess, true, bobK)
+		if ctx.Err() != nil { //la socket a été fermée par l'arrêt
+			return
+		}
 
 		if !TypeChecker(response, 128) {
 			ErrorMessageSender(response, "Bad type\n", conn, ourPrivKey)
 		}
 		if !bytes.Equal(response.Id[:4], helloMess.Id[:4]) {
-			log.Printf("HelloReply avec mauvais ID\n")
+			slog.Warn("HelloReply with the wrong Id", peerAttr(conn.RemoteAddr()), idAttr(response.Id))
 		}
-		time.Sleep(30 * time.Second)
+		serveFor(ctx, conn, 30*time.Second) //en attendant le prochain Hello, on répond aux GetDatum
 	}
 }
 
-func dataReceiver(client http.Client, privateKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, pubK []byte) {
-	//Tout ce qui suit sera fait en boucle
-	for {
+// connectPeer essaie les adresses du pair une à une jusqu'à réussir Hello, PublicKey et Root,
+// renvoie nil si aucune adresse n'a fonctionné
+func connectPeer(peerName string, peertableAddr [][]byte, privateKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, pubK []byte, rootHash []byte) Transport {
+	ext := make([]byte, 4)
+	name := "panic"
+	hello := append(ext, []byte(name)...)
+
+	Type := make([]byte, 1)
+	Type[0] = 0
+
+	var connP2P Transport
+	for _, addr := range peertableAddr {
+		helloMess := NewMessage(newID(), Type, hello, privateKey)
+
+		connP2P = UDPInit(string(addr))
+		if connP2P == nil { //Si l'établissement de la connexion a échoué, on abandonne et on passe à l'adresse suivante
+			continue
+		}
+
+		MessageSender(connP2P, helloMess)                           //Il faut d'abord dire bonjour, sinon pas content
+		response := MessageListener(connP2P, helloMess, true, bobK) //Helloreply
+		if !TypeChecker(response, 128) || !bytes.Equal(helloMess.Id[:4], response.Id[:4]) {
+			slog.Info("Connection attempt failed", "peer", peerName, "addr", string(addr), "stage", "Hello")
+			connP2P.Close()
+			continue
+		}
+		//pubKey
+		response = MessageListener(connP2P, helloMess, false, bobK)
+		if !TypeChecker(response, 1) {
+			slog.Info("Connection attempt failed", "peer", peerName, "addr", string(addr), "stage", "PublicKey")
+			connP2P.Close()
+			continue
+		}
+		slog.Debug("Public key received", "peer", peerName, "key", hex.EncodeToString(response.Body))
+		//Pubkeyreply
+		T := make([]byte, 1)
+		T[0] = byte(129)
+		response = NewMessage(response.Id, T, pubK, privateKey)
+		MessageSender(connP2P, response)
+
+		//Root / rootreply , il faut le faire aussi entre pairs
+		response = MessageListener(connP2P, response, false, bobK)
+		if !TypeChecker(response, 2) {
+			slog.Info("Connection attempt failed", "peer", peerName, "addr", string(addr), "stage", "Root")
+			connP2P.Close()
+			continue
+		}
+		T[0] = byte(130)
+		response = NewMessage(response.Id, T, rootHash, privateKey)
+		MessageSender(connP2P, response)
+		setPeerName(connP2P.RemoteAddr(), peerName)
+		return connP2P //Si on a réussi toutes ces étapes on peut arrếter d'essayer toutes les adresses
+	}
+	return nil
+}
+
+// rootRequest demande au pair son hash racine (Root / RootReply), ourRoot est le nôtre
+func rootRequest(conn Transport, ourRoot []byte, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) ([]byte, error) {
+	Type := make([]byte, 1)
+	Type[0] = 2 //Root
+	rootMess := NewMessage(newID(), Type, ourRoot, privK)
+	MessageSender(conn, rootMess)
+	response := MessageListener(conn, rootMess, true, bobK)
+	if !TypeChecker(response, 130) || len(response.Body) != 32 {
+		return nil, fmt.Errorf("no RootReply")
+	}
+	return response.Body, nil
+}
+
+// emptyRootHash est le hash annoncé tant que l'on n'exporte rien
+func emptyRootHash() []byte {
+	hashEmptyRoot := make([]byte, 32)
+	//var hashEmptyRootStr string = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	//c'est sale de le faire à la main mais c'est pour le test
+	binary.BigEndian.PutUint64(hashEmptyRoot[0:8], uint64(0xe3b0c44298fc1c14))
+	binary.BigEndian.PutUint64(hashEmptyRoot[8:16], uint64(0x9afbf4c8996fb924))
+	binary.BigEndian.PutUint64(hashEmptyRoot[16:24], uint64(0x27ae41e4649b934c))
+	binary.BigEndian.PutUint64(hashEmptyRoot[24:32], uint64(0xa495991b7852b856))
+	return hashEmptyRoot
+}
+
+// dataReceiver est la navigation par menus ; ils sont écrits sur out (voir humanOutput)
+func dataReceiver(ctx context.Context, out io.Writer, client http.Client, privateKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, pubK []byte) {
+	//Tout ce qui suit sera fait en boucle, jusqu'à l'arrêt du programme
+	for ctx.Err() == nil {
 		//Récup des pairs REST
 		body, err := HttpRequest("GET", jchPeersAddr, client)
 		if err != nil {
-			log.Printf("Error get peers : %v\n", err)
+			slog.Warn("Cannot get the peer list", "err", err)
+			sleepContext(ctx, 5*time.Second)
 			continue
-		} else {
-			//Affichage pairs et choix du pair scanf et récupération des adresses ip du pair sélectionné
-			fmt.Printf("\n\n\n\n\n\n\n\n")
-			peertable := ParseREST(body)
-
-			peertableAddr, peerURL, peerName := PeerSelector(peertable, client)
+		}
+		//Affichage pairs et choix du pair scanf et récupération des adresses ip du pair sélectionné
+		fmt.Fprintf(out, "\n\n\n\n\n\n\n\n")
+		peertable := ParseREST(body)
 
-			hashEmptyRoot := make([]byte, 32)
-			binary.BigEndian.PutUint64(hashEmptyRoot[0:8], uint64(0xe3b0c44298fc1c14))
-			binary.BigEndian.PutUint64(hashEmptyRoot[8:16], uint64(0x9afbf4c8996fb924))
-			binary.BigEndian.PutUint64(hashEmptyRoot[16:24], uint64(0x27ae41e4649b934c))
-			binary.BigEndian.PutUint64(hashEmptyRoot[24:32], uint64(0xa495991b7852b856))
+		peertableAddr, peerURL, peerName, err := PeerSelector(ctx, out, peertable, client)
+		if ctx.Err() != nil || errors.Is(err, io.EOF) { //arrêt demandé ou entrée standard fermée
+			return
+		}
+		if err != nil {
+			slog.Warn("Peer selection failed", "err", err)
+			continue
+		}
+		if err := checkEntryName(peerName); err != nil { //le nom du pair sert de nom de dossier
+			slog.Warn("Peer name refused", "peer", peerName, "err", err)
+			continue
+		}
 
-			//création du hellomessage
+		//Tentative de co à l'une des adresses du pair (UDP)
+		connP2P := connectPeer(peerName, peertableAddr, privateKey, bobK, pubK, ourRoot())
+		if connP2P == nil {
+			slog.Warn("Every address tried, cannot connect", "peer", peerName)
+			continue
+		}
+		//On ne réalise la suite que si l'on a réussi à se connecter
+		if !browsePeer(ctx, out, connP2P, client, peerURL, peerName, privateKey, bobK) {
+			return
+		}
+	}
+}
 
-			ext := make([]byte, 4)
-			name := "panic"
-			hello := append(ext, []byte(name)...)
+// browsePeer fait parcourir à l'utilisateur l'arbre du pair puis télécharge ce qu'il a choisi, et ferme conn ;
+// renvoie faux si la navigation doit s'arrêter (arrêt demandé, réponse invalide ou entrée standard fermée)
+func browsePeer(ctx context.Context, out io.Writer, connP2P Transport, client http.Client, peerURL, peerName string, privateKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) bool {
+	stop := closeOnCancel(ctx, connP2P) //un téléchargement en cours s'interrompt dès l'arrêt demandé
+	defer func() {
+		stop()
+		connP2P.Close()
+	}()
+
+	//récupération root du pair
+	rootURL := peerURL + "/root"
+	body, err := HttpRequest("GET", rootURL, client)
+	if err != nil {
+		slog.Warn("Cannot get the root", "peer", peerName, "err", err)
+		return true
+	}
 
-			Type := make([]byte, 1)
-			Type[0] = 0
-			Length := make([]byte, 2)
-			binary.BigEndian.PutUint16(Length[0:], uint16(len(hello)))
+	hash := body //hash contient le hash de root pour l'instant
+	fileName := "root"
+	filePath := "/root"
 
-			//Tentative de co à l'une des adresses du pair (UDP)
-			var connP2P *net.UDPConn
-			var connected bool = false
-			for _, addr := range peertableAddr {
-				Id = newID()
+	var response Message
+	collected_directory := 0
 
-				helloMess := NewMessage(Id, Type, hello, privateKey)
+	for { //Tant que l'on est dans un répertoire, on affiche son contenu à l'utilisateur
+		//getDatum vérifie le type, la longueur, le hash demandé et la forme de la valeur : rien n'est découpé à la main
+		response, err = getDatum(connP2P, hash, privateKey, bobK)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err != nil {
+			slog.Warn("No datum", "peer", peerName, hashAttr(hash), "err", err)
+			return false
+		}
+		if response.Body[32] != directoryType {
+			break //un File ou un BigFile, téléchargé ci-dessous
+		}
+		fmt.Fprintf(out, "\n\nVous êtes dans %v\n\n", filePath)
+		entries, err := parseDirectory(response.Body[32:])
+		if err != nil {
+			slog.Warn("Malformed directory", "peer", peerName, hashAttr(hash), "err", err)
+			return false
+		}
+		entries, rejected := filterEntries(entries)
+		for _, r := range rejected {
+			fmt.Fprintf(out, "Entrée refusée : %v\n", r)
+		}
+		nb_node := len(entries)
+		for i, e := range entries {
+			fmt.Fprintf(out, "élément %v : %v\n", i, e.Name)
+		}
+		fmt.Fprintf(out, "\nPour descendre dans l'arborescence, entrez le numéro correspondant (entre %d et %d)\n", 0, nb_node-1)
+		fmt.Fprintf(out, "Pour télécharger le dossier complet, entrez %d\n", nb_node)
+		k, err := readNumber(ctx)
+		for err == nil && (k > nb_node || k < 0) {
+			fmt.Fprintf(out, "Entrez un nombre entre 0 et %d\n", nb_node)
+			k, err = readNumber(ctx)
+		}
+		if err != nil {
+			return false
+		}
+		if k != nb_node {
+			//On va garder en mémoire le nom du fichier/dossier vers lequel on se dirige, de cette manière on pourra nommer le fichier correctment dans notre machine
+			fileName = entries[k].Name
+			hash = entries[k].Hash //On met à jour le hash de la donnée que l'on veut récupérer
+			filePath = filePath + "/" + fileName
+		} else {
+			//On télécharge tout le dossier
+			resetProgress()
+			downloadDirectory(ctx, out, connP2P, response, peerName, fileName, privateKey, bobK)
+			doneProgress()
+			collected_directory = 1
+			break //Et on arrête la descente dans l'arborescence
+		}
+	}
+	if collected_directory != 1 {
+		//Sortie de la boucle, donc si nous n'avon spas télécharger un dossier complet, nous somme dans un BigFile ou un file
+		resetProgress()
+		downloadFile(ctx, connP2P, response, peerName, fileName, privateKey, bobK)
+		doneProgress()
+	}
+	fmt.Fprintf(out, "%v\n", sessionStats(connP2P.RemoteAddr()))
+	return ctx.Err() == nil
+}
 
-				connP2P = UDPInit(string(addr))
-				if connP2P == nil { //Si l'établissement de la connexion a échoué, on abandonne et on passe à l'adresse suivante
-					continue
-				}
+// downloadDirectory télécharge le répertoire response dans downlaod_from_<pair>/<fileName>,
+// ou ne récupère que ce qui a changé s'il y est déjà ; les changements et les échecs sont écrits sur out
+func downloadDirectory(ctx context.Context, out io.Writer, conn Transport, response Message, peerName, fileName string, privateKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) error {
+	dirPath := "./" + "downlaod_from_" + peerName + "/" + fileName
+	if _, err := os.Stat(dirPath); err == nil {
+		//Déjà téléchargé : on ne récupère que ce qui a changé
+		changes, err := updateDirectory(ctx, conn, response.Body[:32], dirPath, privateKey, bobK, false)
+		if err != nil {
+			slog.Warn("Update failed", "path", dirPath, "err", err)
+		}
+		for _, c := range changes {
+			fmt.Fprintf(out, "%v %v\n", c.Kind, c.Path)
+		}
+		return err
+	}
+	dl := newDownload(dirPath)
+	collectDirectory(ctx, response, conn, fileName, dirPath, privateKey, bobK, dl)
+	if err := writeManifest(dirPath, dl.manifest); err != nil {
+		slog.Warn("Cannot write manifest", "path", dirPath, "err", err)
+	}
+	for _, r := range dl.rejected {
+		fmt.Fprintf(out, "Entrée refusée : %v\n", r)
+	}
+	for _, f := range dl.failed {
+		fmt.Fprintf(out, "Echec du téléchargement : %v\n", f)
+	}
+	if len(dl.failed) > 0 {
+		return fmt.Errorf("%d files could not be downloaded", len(dl.failed))
+	}
+	return nil
+}
 
-				MessageSender(connP2P, helloMess)                           //Il faut d'abord dire bonjour, sinon pas content
-				response := MessageListener(connP2P, helloMess, true, bobK) //Helloreply
-				if !TypeChecker(response, 128) || !bytes.Equal(helloMess.Id[:4], response.Id[:4]) {
-					log.Printf("Tentative de connexion échouée, au stade Hello\n")
-					connP2P.Close()
-
-				} else {
-					//pubKey
-					response = MessageListener(connP2P, helloMess, false, bobK)
-					if !TypeChecker(response, 1) {
-						log.Printf("Tentative de connexion échouée, au stade pubkey\n")
-						connP2P.Close()
-					} else {
-						fmt.Printf("Pubkey : %v\n", response.Body)
-						//Pubkeyreply
-						//pubKey, _ := projetcrypto.ECDHGen()
-						Type := make([]byte, 1)
-						Type[0] = byte(129)
-						//B := make([]byte, 0) //potentiel pubK pour passer en mode non signé
-						response = NewMessage(response.Id, Type, pubK, privateKey)
-
-						MessageSender(connP2P, response)
-
-						//Root / rootreply , il faut le faire aussi entre pairs
-						response = MessageListener(connP2P, response, false, bobK)
-						if !TypeChecker(response, 2) {
-							log.Printf("Tentative de connexion échouée, au stade root\n")
-							connP2P.Close()
-						} else {
-							T := make([]byte, 1)
-							T[0] = byte(130)
-							response = NewMessage(response.Id, T, hashEmptyRoot, privateKey)
-							MessageSender(connP2P, response)
-							connected = true
-							break //Si on a réussi toutes ces étapes on peut arrếter d'essayer toutes les adresses
-						}
-					}
-				}
-			}
-			defer connP2P.Close()
-			if connected { //On ne réalise la suite que si l'on a réussi à se connecter
-				//récupération root du pair
-				rootURL := peerURL + "/root"
-				body, err = HttpRequest("GET", rootURL, client)
-				if err != nil {
-					log.Fatalf("Error get root : %v\n", err)
-					continue
-				}
+// downloadFile télécharge le File ou BigFile response dans downlaod_from_<pair>/<fileName>
+func downloadFile(ctx context.Context, conn Transport, response Message, peerName, fileName string, privateKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) error {
+	out := make([]byte, 0)
+	chunks := make([]fileChunk, 0)
+	filePath := "./" + "downlaod_from_" + peerName + "/" + fileName
+	emitProgress(progressFile, response.Body[:32], 0, filePath)
 
-				hash := body //hash contient le hash de root pour l'instant
-				fileName := "root"
-				filePath := "/root"
-
-				nodeType := byte(2) //directory
-
-				//Préparation des messages get datum
-				Type[0] = 3                                        //getDatum
-				binary.BigEndian.PutUint16(Length[0:], uint16(32)) //Lenght = 32
-				var response Message
-				collected_directory := 0
-				Id = newID()
-				giveMeData := NewMessage(Id, Type, hash, privateKey)
-
-				for nodeType == 2 { //Tant que l'on est dans un répertoire, on affiche son contenu à l'utilisateur
-					fmt.Printf("\n\nVous êtes dans %v\n\n", filePath)
-
-					MessageSender(connP2P, giveMeData)                          //On envoie la requette
-					response = MessageListener(connP2P, giveMeData, true, bobK) //On recoit la réponse
-
-					if !TypeChecker(response, 131) { //Vérification que c'est bien un datum
-						log.Printf("No datum..\n")
-						return
-					}
-
-					if !checkHash(response) {
-						log.Printf("Bad hash in response")
-						return
-					}
-					nodeType = response.Body[32]
-					if nodeType == 2 {
-						nb_node := (binary.BigEndian.Uint16(response.Length) - 33) / 64
-						for i := 0; uint16(i) < nb_node; i++ {
-							fmt.Printf("élément %v : %v\n", i, string(response.Body[33+64*i:33+64*i+32]))
-						}
-						fmt.Printf("\nPour descendre dans l'arborescence, entrez le numéro correspondant (entre %d et %d)\n", 0, nb_node-1)
-						fmt.Printf("Pour télécharger le dossier complet, entrez %d\n", nb_node)
-						var k int = int(nb_node) + 1
-						fmt.Scanf("%d", &k)
-						for k > int(nb_node) {
-							fmt.Printf("Entrez un nombre entre 0 et %d\n", nb_node)
-							fmt.Scanf("%d", &k)
-						}
-						if k != int(nb_node) {
-							Id = newID()
-							giveMeData = NewMessage(Id, Type, response.Body[33+64*(k+1)-32:33+64*(k+1)], privateKey) //On met à jour le hash de la donnée que l'on veut récupérer
-							//On va garder en mémoire le nom du fichier/dossier vers lequel on se dirige, de cette manière on pourra nommer le fichier correctment dans notre machine
-							fileName = string(response.Body[33+64*(k+1)-64 : 33+64*(k+1)-32])
-							fileName = strings.Trim(fileName, string(0))
-							filePath = filePath + "/" + fileName
-						} else {
-							//On télécharge tout le dossier
-							collectDirectory(response, connP2P, fileName, "./"+"downlaod_from_"+peerName+"/"+fileName, privateKey, bobK)
-							collected_directory = 1
-							break //Et on arrête la descente dans l'arborescence
-						}
-
-					}
-				}
-				if collected_directory != 1 {
-					//Sortie de la boucle, donc si nous n'avon spas télécharger un dossier complet, nous somme dans un BigFile ou un file
-					out := make([]byte, 0)
-					collectDataFile(response, connP2P, privateKey, bobK, &out)
-
-					//Création du fichier dans lequel on va écrire les données
-					err := os.MkdirAll("./"+"downlaod_from_"+peerName, 0755)
-					if err != nil {
-						log.Printf("Erreur création de dossier")
-					}
-					f, errr := os.OpenFile("./"+"downlaod_from_"+peerName+"/"+fileName, os.O_CREATE|os.O_RDWR, 0755) //Création du fichier dans lequel on va écrire les données
-					if errr != nil {
-						fmt.Printf("Err open\n")
-						log.Fatal(err)
-					}
-					//écriture dans le fichier
-					_, err = f.Write(out)
-					if err != nil {
-						fmt.Printf("Err write\n")
-						log.Fatal(err)
-					}
-
-					f.Close()
-				}
-			} else {
-				log.Printf("Toutes les adresses ont été testées, impossible de se connecter\n")
-			}
-		}
+	//Création du dossier dans lequel on va écrire le fichier (fileName peut être un chemin dans l'arbre du pair)
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		slog.Warn("Cannot create directory", "err", err)
+	}
+	err = collectDataFile(ctx, response, conn, privateKey, bobK, &out, &chunks)
+	if err == nil {
+		err = writeFileAtomic(filePath, out, chunks)
+	} else {
+		keepPartial(filePath, out)
 	}
+	if err != nil {
+		slog.Warn("Download failed", "path", filePath, "err", err)
+	}
+	return err
 }
 
 //==================================================================================================
-func main() {
-
-	//=============================================================================================
-	// Generation de notre signature
-	//=============================================================================================
 
+// newKeys génère notre paire de clés de signature, pubK est la clé publique au format du protocole (X || Y)
+func newKeys() (*ecdsa.PrivateKey, []byte) {
 	//pubK, privK := projetcrypto.ECDHGen()
 	privK, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	publicKey := privK.PublicKey
 	pubK := make([]byte, 64)
 	publicKey.X.FillBytes(pubK[:32])
 	publicKey.Y.FillBytes(pubK[32:])
+	return privK, pubK
+}
 
-	var bobK *ecdsa.PublicKey
-	bobK = nil
-
-	var wg sync.WaitGroup
+// parsePublicKey décode une clé publique au format du protocole (X || Y) ; une clé nulle (pair qui ne
+// signe pas) ou qui n'est pas sur la courbe est refusée
+func parsePublicKey(b []byte) (*ecdsa.PublicKey, error) {
+	if len(b) != 64 {
+		return nil, fmt.Errorf("public key of %d bytes", len(b))
+	}
+	var x, y big.Int
+	x.SetBytes(b[:32])
+	y.SetBytes(b[32:])
+	if !elliptic.P256().IsOnCurve(&x, &y) {
+		return nil, fmt.Errorf("public key is not on P-256")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}, nil
+}
 
-	//Préparation des requettes REST
+func restClient() *http.Client {
 	transport := http.DefaultTransport.(*http.Transport)
 	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	client := &http.Client{
 		Transport: transport,
 		Timeout:   50 * time.Second,
 	}
+	return client
+}
 
-	hashEmptyRoot := make([]byte, 32)
-	//var hashEmptyRootStr string = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
-	//c'est sale de le faire à la main mais c'est pour le test
-	binary.BigEndian.PutUint64(hashEmptyRoot[0:8], uint64(0xe3b0c44298fc1c14))
-	binary.BigEndian.PutUint64(hashEmptyRoot[8:16], uint64(0x9afbf4c8996fb924))
-	binary.BigEndian.PutUint64(hashEmptyRoot[16:24], uint64(0x27ae41e4649b934c))
-	binary.BigEndian.PutUint64(hashEmptyRoot[24:32], uint64(0xa495991b7852b856))
-
-	//Enregistrement auprès du serveur
+// registerToServer s'enregistre auprès du serveur (Hello, PublicKey, Root), renvoie nil si impossible
+func registerToServer(privK *ecdsa.PrivateKey, pubK []byte, bobK *ecdsa.PublicKey, rootHash []byte) Transport {
 	ext := make([]byte, 4)
 	name := "panic"
 	hello := append(ext, []byte(name)...)
@@ -693,9 +967,8 @@ func main() {
 
 	conn := UDPInit(serveurUrl)
 	if conn == nil {
-		log.Fatalf("Impossible de s'enregistrer sur serveur\n")
+		return nil
 	}
-	defer conn.Close()
 
 	MessageSender(conn, helloMess)
 	response := MessageListener(conn, helloMess, true, bobK)
@@ -724,17 +997,112 @@ func main() {
 		ErrorMessageSender(response, "Bad type\n", conn, privK)
 	}
 	response.Type[0] = byte(130)
-	response = NewMessage(response.Id, response.Type, hashEmptyRoot, privK)
+	response = NewMessage(response.Id, response.Type, rootHash, privK)
 	MessageSender(conn, response)
+	return conn
+}
 
-	wg.Add(1)
-	go HelloRepeater(conn, privK, bobK)
-	defer wg.Done()
+//==================================================================================================
+func main() {
+
+	flag.Parse()
+	if err := initLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	initProgress()
+	initCapture()
+	initMetrics() //après initCapture : la capture doit voir la socket UDP elle-même
+	initLimits()  //les réponses des pairs que l'on contacte ne prennent pas de jeton
+	ctx, cancel := shutdownContext()
+
+	//Commandes annexes (verify, diff, replay et decode fonctionnent hors ligne)
+	status := 0
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "verify":
+			status = verifyMain(flag.Args()[1:])
+		case "diff":
+			status = diffMain(flag.Args()[1:])
+		case "mirror":
+			status = mirrorMain(ctx, flag.Args()[1:])
+		case "swarm":
+			status = swarmMain(ctx, flag.Args()[1:])
+		case "replay":
+			status = replayMain(flag.Args()[1:])
+		case "decode":
+			status = decodeMain(flag.Args()[1:])
+		default:
+			slog.Error("Unknown command", "command", flag.Arg(0))
+			status = 2
+		}
+	} else {
+		status = clientMain(ctx, cancel)
+	}
+	cancel(nil)
+	closeCapture()
+	os.Exit(exitStatus(ctx, status))
+}
+
+// shutdownGrace est le temps laissé à la navigation pour s'arrêter, par exemple au milieu d'une connexion à un pair
+const shutdownGrace = 5 * time.Second
 
+// clientMain est le client interactif : enregistrement auprès du serveur, Hello périodiques, navigation dans les
+// arbres des pairs (menus ou -tui) et passerelle HTTP (-http), jusqu'à la fin de la navigation ou l'arrêt demandé
+func clientMain(ctx context.Context, cancel context.CancelCauseFunc) int {
+
+	//=============================================================================================
+	// Generation de notre signature
+	//=============================================================================================
+
+	privK, pubK := newKeys()
+	initDatumStore()
+	initExports(privK)
+
+	var bobK *ecdsa.PublicKey
+	bobK = nil
+
+	//Préparation des requettes REST
+	client := restClient()
+
+	//Enregistrement auprès du serveur
+	conn := registerToServer(privK, pubK, bobK, ourRoot())
+	if conn == nil {
+		slog.Error("Cannot register with the server")
+		return 1
+	}
+	closeOnCancel(ctx, conn) //débloque HelloRepeater s'il attend une réponse
+
+	var wg sync.WaitGroup
 	wg.Add(1)
-	go dataReceiver(*client, privK, bobK, pubK)
-	defer wg.Done()
+	go func() {
+		defer wg.Done()
+		HelloRepeater(ctx, conn, privK, bobK)
+	}()
+
+	//Passerelle HTTP (avec -http)
+	startGateway(ctx, *client, privK, bobK, pubK)
+
+	browsed := make(chan struct{})
+	go func() {
+		defer close(browsed)
+		if *tuiMode {
+			tuiBrowser(ctx, humanOutput(), *client, privK, bobK, pubK)
+		} else {
+			dataReceiver(ctx, humanOutput(), *client, privK, bobK, pubK)
+		}
+		cancel(nil) //fin de la navigation : on arrête aussi les Hello et la passerelle
+	}()
+
+	<-ctx.Done()
+	select {
+	case <-browsed:
+	case <-time.After(shutdownGrace):
+		slog.Warn("Browser did not stop in time, exiting anyway")
+	}
 	wg.Wait()
+	conn.Close()
+	return 0
 }
 
 //##########################################################################################################################################################################
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+//===================================================================================================
+//                                CONTROLE DE CONGESTION
+//===================================================================================================
+
+// Pour les téléchargements, plusieurs GetDatum sont envoyés sans attendre les réponses.
+// Le nombre de requêtes en vol est limité par une fenêtre AIMD par session, comme TCP :
+// +1 par réponse tant que l'on est sous ssthresh (slow start), +1/cwnd ensuite, et divisée par 2 sur un timeout.
+
+const (
+	initialWindow  = 2
+	maxWindow      = 128
+	initialSSThres = 32
+)
+
+type congestionWindow struct {
+	mu       sync.Mutex
+	cwnd     float64
+	ssthresh float64
+	sent     int //requêtes envoyées, retransmissions comprises
+	lost     int //requêtes parties en timeout ou avec une mauvaise réponse
+	lastCut  time.Time
+}
+
+func newCongestionWindow() *congestionWindow {
+	return &congestionWindow{cwnd: initialWindow, ssthresh: initialSSThres}
+}
+
+func (w *congestionWindow) window() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int(w.cwnd)
+}
+
+func (w *congestionWindow) onSend() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sent++
+}
+
+// onReply agrandit la fenêtre pour une réponse arrivée à temps
+func (w *congestionWindow) onReply() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cwnd < w.ssthresh {
+		w.cwnd++
+	} else {
+		w.cwnd += 1 / w.cwnd
+	}
+	if w.cwnd > maxWindow {
+		w.cwnd = maxWindow
+	}
+}
+
+// onLoss divise la fenêtre par 2, au plus une fois par rto (plusieurs pertes d'une même salve ne comptent qu'une fois)
+func (w *congestionWindow) onLoss(rto time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lost++
+	if clock.Now().Sub(w.lastCut) < rto {
+		return
+	}
+	w.lastCut = clock.Now()
+	w.ssthresh = w.cwnd / 2
+	if w.ssthresh < 1 {
+		w.ssthresh = 1
+	}
+	w.cwnd = w.ssthresh
+}
+
+func (w *congestionWindow) lossRate() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.sent == 0 {
+		return 0
+	}
+	return float64(w.lost) / float64(w.sent)
+}
+
+var windowTable = struct {
+	sync.Mutex
+	peers map[string]*congestionWindow
+}{peers: make(map[string]*congestionWindow)}
+
+// windowFor renvoie la fenêtre de la session avec le pair d'adresse addr
+func windowFor(addr net.Addr) *congestionWindow {
+	key := ""
+	if addr != nil {
+		key = addr.String()
+	}
+	windowTable.Lock()
+	defer windowTable.Unlock()
+	w, ok := windowTable.peers[key]
+	if !ok {
+		w = newCongestionWindow()
+		windowTable.peers[key] = w
+	}
+	return w
+}
+
+// sessionStats résume l'état de la session avec le pair d'adresse addr
+func sessionStats(addr net.Addr) string {
+	srtt, rttvar := rttFor(addr).smoothed()
+	w := windowFor(addr)
+	return fmt.Sprintf("peer %v: srtt %v rttvar %v rto %v cwnd %d loss %.1f%%",
+		addr, srtt, rttvar, rttFor(addr).timeout(), w.window(), 100*w.lossRate())
+}
+
+type pendingRequest struct {
+	seq           int //ordre de première émission
+	hash          []byte
+	mess          Message
+	sentAt        time.Time
+	attempts      int
+	retransmitted bool
+}
+
+// fetchDatums récupère les Datum de tous les hash, en gardant jusqu'à cwnd GetDatum en vol.
+// Les réponses sont associées aux requêtes par leur Id ; le résultat est indexé par string(hash).
+func fetchDatums(ctx context.Context, conn Transport, hashes [][]byte, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) (map[string]Message, error) {
+	results, missing := fetchDatumsPartial(ctx, conn, hashes, privK, bobK)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%x: %w", missing[0].Hash, missing[0].Err)
+	}
+	return results, nil
+}
+
+// sortedRequests renvoie les requêtes en vol de la plus ancienne à la plus récente
+func sortedRequests(pending map[string]*pendingRequest) []*pendingRequest {
+	reqs := make([]*pendingRequest, 0, len(pending))
+	for _, req := range pending {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].seq < reqs[j].seq })
+	return reqs
+}
+
+// missingDatum est un hash que le pair n'a pas pu fournir
+type missingDatum struct {
+	Hash []byte
+	Err  error //errNoDatum, errBadHash, errBadDatum, errTimeout, ou la cause de l'annulation du contexte
+}
+
+var errTimeout = errors.New("no answer")
+
+// fetchDatumsPartial est fetchDatums, mais continue quand un hash ne peut pas être obtenu et renvoie
+// la liste de ces hash, pour pouvoir les demander à un autre pair. Si ctx est annulé, ou si la socket est fermée
+// ou en erreur, tout ce qui n'est pas encore arrivé est manquant.
+func fetchDatumsPartial(ctx context.Context, conn Transport, hashes [][]byte, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) (map[string]Message, []missingDatum) {
+	est := rttFor(conn.RemoteAddr())
+	cw := windowFor(conn.RemoteAddr())
+	results := make(map[string]Message, len(hashes))
+	missing := make([]missingDatum, 0)
+	requested := make(map[string]bool, len(hashes))
+	pending := make(map[string]*pendingRequest)
+	queue := make([][]byte, 0, len(hashes))
+	for _, h := range hashes {
+		if !requested[string(h)] { //on ne demande pas deux fois le même hash
+			requested[string(h)] = true
+			queue = append(queue, h)
+		}
+	}
+	Type := make([]byte, 1)
+	Type[0] = 3 //getDatum
+	emitProgress(progressQueued, nil, int64(len(queue)), "")
+
+	send := func(req *pendingRequest) {
+		req.sentAt = clock.Now()
+		req.attempts++
+		cw.onSend()
+		if req.attempts == 1 {
+			emitProgress(progressRequest, req.hash, 0, "")
+		} else {
+			emitProgress(progressRetransmit, req.hash, 0, "")
+			metrics.retransmits.inc(messageTypeName(3))
+		}
+		MessageSender(conn, req.mess)
+	}
+
+	//giveUp déclare manquant tout ce qui n'est pas encore arrivé
+	giveUp := func(err error) {
+		for _, req := range sortedRequests(pending) {
+			missing = append(missing, missingDatum{req.hash, err})
+		}
+		for _, h := range queue {
+			missing = append(missing, missingDatum{h, err})
+		}
+	}
+
+	messB := make([]byte, 1064+64) //Datum plein et signature
+	for len(queue) > 0 || len(pending) > 0 {
+		if ctx.Err() != nil {
+			giveUp(context.Cause(ctx))
+			break
+		}
+		//On remplit la fenêtre
+		for len(pending) < cw.window() && len(queue) > 0 {
+			req := &pendingRequest{seq: len(requested) - len(queue), hash: queue[0], mess: NewMessage(newID(), Type, queue[0], privK)}
+			queue = queue[1:]
+			pending[string(req.mess.Id)] = req
+			send(req)
+		}
+
+		//On attend jusqu'à l'expiration de la plus ancienne requête
+		rto := est.timeout()
+		deadline := clock.Now().Add(rto)
+		for _, req := range pending {
+			if req.sentAt.Add(rto).Before(deadline) {
+				deadline = req.sentAt.Add(rto)
+			}
+		}
+		err := conn.SetReadDeadline(deadline)
+		if err != nil {
+			slog.Error("Cannot set read deadline", peerAttr(conn.RemoteAddr()), "err", err)
+		}
+		n, errRead := conn.Read(messB)
+		if ne, ok := errRead.(net.Error); errRead != nil && !(ok && ne.Timeout()) {
+			//socket fermée ou en erreur : personne ne répondra, inutile de retransmettre
+			if ctx.Err() != nil {
+				errRead = context.Cause(ctx)
+			} else {
+				slog.Error("Cannot read", peerAttr(conn.RemoteAddr()), "err", errRead)
+			}
+			giveUp(errRead)
+			break
+		}
+		if errRead != nil {
+			//Timeout : retransmission des requêtes expirées
+			now := clock.Now()
+			resent := false
+			for _, req := range sortedRequests(pending) { //dans l'ordre d'envoi, pour que les tests soient reproductibles
+				if now.Sub(req.sentAt) < rto {
+					continue
+				}
+				cw.onLoss(rto)
+				if req.attempts >= *maxAttempts {
+					delete(pending, string(req.mess.Id))
+					missing = append(missing, missingDatum{req.hash, errTimeout})
+					metrics.timeouts.inc(messageTypeName(3))
+					continue
+				}
+				req.retransmitted = true
+				send(req)
+				resent = true
+			}
+			if resent { //le délai n'est doublé que si quelque chose a été réémis
+				est.backoff()
+			}
+			continue
+		}
+
+		countDatagram(metrics.received, messB[:n])
+		if !admitDatagram(conn.RemoteAddr(), messB[:n]) {
+			continue //adresse bannie ou au-delà de ses limites
+		}
+		if serveRequest(conn, messB[:n]) {
+			continue //GetDatum du pair, pas une réponse
+		}
+		mess := messageFrom(conn.RemoteAddr(), append([]byte(nil), messB[:n]...), bobK) //copie : messB est réutilisé pour la lecture suivante
+		req, ok := pending[string(mess.Id)]
+		if !ok {
+			continue //réponse en double ou en retard à une requête déjà servie
+		}
+		if mess.Type[0] == 132 { //NoDatum
+			delete(pending, string(mess.Id))
+			missing = append(missing, missingDatum{req.hash, errNoDatum})
+			continue
+		}
+		if mess.Type[0] != 131 || len(mess.Body) < 33 || !checkHash(mess) || !bytes.Equal(mess.Body[:32], req.hash) {
+			slog.Warn("Bad hash in reply", peerAttr(conn.RemoteAddr()), idAttr(mess.Id), typeAttr(mess.Type[0]), hashAttr(req.hash))
+			if mess.Type[0] == 131 {
+				metrics.badHashes.inc("")
+			}
+			cw.onLoss(rto)
+			if req.attempts >= *maxAttempts {
+				delete(pending, string(mess.Id))
+				missing = append(missing, missingDatum{req.hash, errBadHash})
+				continue
+			}
+			req.retransmitted = true
+			send(req)
+			continue
+		}
+		delete(pending, string(mess.Id))
+		if err := checkDatum(mess.Body[32:]); err != nil { //le hash est bon : redemander donnerait le même Datum
+			slog.Warn("Malformed datum", peerAttr(conn.RemoteAddr()), hashAttr(req.hash), "err", err)
+			metrics.malformed.inc("")
+			missing = append(missing, missingDatum{req.hash, errBadDatum})
+			continue
+		}
+		results[string(req.hash)] = mess
+		emitProgress(progressReceive, req.hash, int64(len(mess.Body)-32), "")
+		metrics.bytesDownloaded.add("", uint64(len(mess.Body)-32))
+		datums.put(peerNameOf(conn.RemoteAddr()), req.hash, mess.Body[32:])
+		cw.onReply()
+		if !req.retransmitted { //règle de Karn
+			est.sample(clock.Now().Sub(req.sentAt))
+		}
+	}
+	return results, missing
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+//===================================================================================================
+//                                DIFF DE DEUX ARBRES
+//===================================================================================================
+
+// datumSource renvoie la valeur (octet de type compris) du noeud de hash donné,
+// qu'elle vienne d'un arbre local ou d'un pair
+type datumSource func(hash []byte) ([]byte, error)
+
+func localSource(root *MerkleNode) datumSource {
+	index := make(map[string]*MerkleNode)
+	IndexTree(root, index)
+	return func(hash []byte) ([]byte, error) {
+		n, ok := index[string(hash)]
+		if !ok {
+			return nil, errNoDatum
+		}
+		return n.Value, nil
+	}
+}
+
+func remoteSource(conn Transport, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) datumSource {
+	return func(hash []byte) ([]byte, error) {
+		response, err := getDatum(conn, hash, privK, bobK)
+		if err != nil {
+			return nil, err
+		}
+		return response.Body[32:], nil
+	}
+}
+
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified"
+)
+
+type treeChange struct {
+	Path string
+	Kind string
+	Hash []byte //hash du nouveau noeud (nil si supprimé)
+}
+
+type treeDiff struct {
+	Changes []treeChange
+	Order   map[string][]string //ordre des entrées des répertoires du nouvel arbre parcourus pendant le diff
+}
+
+// diffTrees parcourt en parallèle l'ancien arbre (oldSrc, oldRoot) et le nouveau (newSrc, newRoot).
+// Les sous-arbres de même hash ne sont pas parcourus, donc pas récupérés.
+func diffTrees(oldSrc datumSource, oldRoot []byte, newSrc datumSource, newRoot []byte) (treeDiff, error) {
+	d := treeDiff{make([]treeChange, 0), make(map[string][]string)}
+	err := diffNodes(oldSrc, oldRoot, newSrc, newRoot, ".", &d)
+	return d, err
+}
+
+func diffNodes(oldSrc datumSource, oldHash []byte, newSrc datumSource, newHash []byte, path string, d *treeDiff) error {
+	if bytes.Equal(oldHash, newHash) {
+		return nil
+	}
+	oldValue, err := oldSrc(oldHash)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	newValue, err := newSrc(newHash)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if oldValue[0] != directoryType || newValue[0] != directoryType {
+		d.Changes = append(d.Changes, treeChange{path, changeModified, newHash})
+		return nil
+	}
+
+	oldEntries, err := parseDirectory(oldValue)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	newEntries, err := parseDirectory(newValue)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	oldByName := make(map[string][]byte, len(oldEntries))
+	for _, e := range oldEntries {
+		oldByName[e.Name] = e.Hash
+	}
+	//Les noms du nouvel arbre peuvent venir d'un pair : les entrées dangereuses sont ignorées
+	newEntries, rejected := filterEntries(newEntries)
+	for _, r := range rejected {
+		slog.Warn("Rejected entry", "path", path, "reason", r)
+	}
+	newByName := make(map[string]bool, len(newEntries))
+	for _, e := range newEntries {
+		newByName[e.Name] = true
+		d.Order[path] = append(d.Order[path], e.Name)
+	}
+
+	for _, e := range oldEntries {
+		if !newByName[e.Name] {
+			d.Changes = append(d.Changes, treeChange{joinTreePath(path, e.Name), changeRemoved, nil})
+		}
+	}
+	for _, e := range newEntries {
+		childPath := joinTreePath(path, e.Name)
+		oldChild, ok := oldByName[e.Name]
+		if !ok {
+			d.Changes = append(d.Changes, treeChange{childPath, changeAdded, e.Hash})
+			continue
+		}
+		err = diffNodes(oldSrc, oldChild, newSrc, e.Hash, childPath, d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localTree construit l'arbre d'un dossier téléchargé, dans l'ordre de son manifeste s'il existe
+func localTree(dir string) (*MerkleNode, map[string][]string, error) {
+	var order map[string][]string
+	entries, err := readManifest(dir)
+	if err == nil {
+		order = manifestOrder(entries)
+	}
+	tree, err := BuildMerkleTree(dir, order)
+	return tree, order, err
+}
+
+// updateDirectory met à jour le dossier déjà téléchargé dirPath pour qu'il corresponde à remoteRoot,
+// en ne récupérant que ce qui a changé. Les entrées modifiées sont d'abord toutes téléchargées dans
+// <dirPath>.staging, puis renommées à leur place : en cas d'échec, dirPath n'est pas modifié.
+// Si keepRemoved est vrai, les entrées qui ont disparu chez le pair sont conservées.
+func updateDirectory(ctx context.Context, conn Transport, remoteRoot []byte, dirPath string, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, keepRemoved bool) ([]treeChange, error) {
+	err := os.MkdirAll(dirPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	local, order, err := localTree(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	d, err := diffTrees(localSource(local), local.Hash, remoteSource(conn, privK, bobK), remoteRoot)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.Changes) == 0 {
+		return d.Changes, nil
+	}
+
+	//Téléchargement de tout ce qui a changé dans le dossier temporaire
+	staging := dirPath + ".staging"
+	err = os.RemoveAll(staging)
+	if err != nil {
+		return nil, err
+	}
+	applied := false
+	defer func() {
+		if applied || !*keepPartFiles { //avec -keep-part on garde ce qui a été reçu pour l'examiner
+			os.RemoveAll(staging)
+		}
+	}()
+	for _, c := range d.Changes {
+		if c.Kind == changeRemoved {
+			continue
+		}
+		if ctx.Err() != nil { //arrêt demandé : dirPath reste tel quel
+			return nil, context.Cause(ctx)
+		}
+		response, err := getDatum(conn, c.Hash, privK, bobK)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", c.Path, err)
+		}
+		target := stagingPath(staging, c.Path)
+		err = os.MkdirAll(treeParent(target), 0755)
+		if err != nil {
+			return nil, err
+		}
+		dl := newDownload(staging)
+		collectDirectory(ctx, response, conn, c.Path[strings.LastIndex(c.Path, "/")+1:], target, privK, bobK, dl)
+		if len(dl.failed) > 0 {
+			return nil, fmt.Errorf("%d file(s) of %v could not be downloaded", len(dl.failed), c.Path)
+		}
+	}
+
+	//Application des changements
+	applied = true
+	for _, c := range d.Changes {
+		if c.Kind == changeRemoved && keepRemoved {
+			continue
+		}
+		target := stagingPath(dirPath, c.Path)
+		err = os.RemoveAll(target)
+		if err != nil {
+			return nil, err
+		}
+		if c.Kind == changeRemoved {
+			continue
+		}
+		err = os.Rename(stagingPath(staging, c.Path), target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//Nouveau manifeste : ordre de l'ancien, remplacé par celui des répertoires qui ont changé
+	if order == nil {
+		order = make(map[string][]string)
+	}
+	for dir, names := range d.Order {
+		order[dir] = names
+	}
+	local, err = BuildMerkleTree(dirPath, order)
+	if err != nil {
+		return nil, err
+	}
+	err = writeManifest(dirPath, treeManifest(local))
+	if err != nil {
+		return nil, err
+	}
+	if !keepRemoved && !bytes.Equal(local.Hash, remoteRoot) {
+		return d.Changes, fmt.Errorf("%v does not match remote root after update", dirPath)
+	}
+	return d.Changes, nil
+}
+
+// stagingPath donne le chemin sur disque de l'entrée path (relative) sous base
+func stagingPath(base string, path string) string {
+	if path == "." {
+		return base
+	}
+	return base + "/" + path
+}
+
+// diffMain implémente la commande "diff <old-dir> <new-dir>" entre deux dossiers locaux
+func diffMain(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: diff <old-dir> <new-dir>\n")
+		return 2
+	}
+	oldTree, _, err := localTree(strings.TrimRight(args[0], "/"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	newTree, _, err := localTree(strings.TrimRight(args[1], "/"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	d, err := diffTrees(localSource(oldTree), oldTree.Hash, localSource(newTree), newTree.Hash)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	for _, c := range d.Changes {
+		fmt.Printf("%v %v\n", c.Kind, c.Path)
+	}
+	if len(d.Changes) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// countingSource compte les valeurs demandées à src
+func countingSource(src datumSource, n *int) datumSource {
+	return func(hash []byte) ([]byte, error) {
+		*n++
+		return src(hash)
+	}
+}
+
+func buildTestTree(t *testing.T, dir string) *MerkleNode {
+	t.Helper()
+	tree, err := BuildMerkleTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestDiffTrees(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTree(t, dir, 3)
+	oldTree := buildTestTree(t, dir) //les valeurs restent en mémoire
+	os.WriteFile(filepath.Join(dir, "docs/deep/nested"), []byte("changed"), 0644)
+	os.Remove(filepath.Join(dir, "small.txt"))
+	os.WriteFile(filepath.Join(dir, "images/new.txt"), []byte("new"), 0644)
+	newTree := buildTestTree(t, dir)
+
+	oldReads, newReads := 0, 0
+	d, err := diffTrees(countingSource(localSource(oldTree), &oldReads), oldTree.Hash, countingSource(localSource(newTree), &newReads), newTree.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{small.txt removed} {docs/deep/nested modified} {images/new.txt added}]"
+	got := make([]string, 0, len(d.Changes))
+	for _, c := range d.Changes {
+		got = append(got, fmt.Sprintf("{%v %v}", c.Path, c.Kind))
+	}
+	if "["+strings.Join(got, " ")+"]" != want {
+		t.Fatalf("changes %v, want %v", got, want)
+	}
+	//racine, docs, docs/deep, nested et images : big.bin, exact.bin et images/thumbs ont le même hash
+	if oldReads != 5 || newReads != 5 {
+		t.Fatalf("%d old and %d new values read, want 5 each", oldReads, newReads)
+	}
+	if fmt.Sprint(d.Order["images"]) != "[new.txt photo.raw thumbs]" {
+		t.Fatalf("order of images %v", d.Order["images"])
+	}
+
+	same, err := diffTrees(countingSource(localSource(oldTree), &oldReads), oldTree.Hash, localSource(oldTree), oldTree.Hash)
+	if err != nil || len(same.Changes) != 0 || oldReads != 5 {
+		t.Fatalf("identical trees: %v %v, %d values read", same.Changes, err, oldReads-5)
+	}
+}
+
+// nodeAt renvoie le noeud de chemin path (relatif) sous tree
+func nodeAt(t *testing.T, tree *MerkleNode, path string) *MerkleNode {
+	t.Helper()
+	n := tree
+	for _, name := range strings.Split(path, "/") {
+		i := slices.IndexFunc(n.Children, func(c *MerkleNode) bool { return c.Name == name })
+		if i < 0 {
+			t.Fatalf("%v not in the tree", path)
+		}
+		n = n.Children[i]
+	}
+	return n
+}
+
+// simSwitch est un pair simulé dont on peut changer l'arbre pendant le test, et qui note les hash demandés
+type simSwitch struct {
+	peer      *simPeer
+	requested map[string]bool
+}
+
+func (s *simSwitch) handle(from *net.UDPAddr, packet []byte, send func(*net.UDPAddr, []byte)) {
+	if len(packet) >= 7+32 && packet[4] == 3 {
+		s.requested[string(packet[7:7+32])] = true
+	}
+	s.peer.handle(from, packet, send)
+}
+
+// swap remplace l'arbre du pair par celui de dir et oublie les hash déjà demandés
+func (s *simSwitch) swap(t *testing.T, dir string) *MerkleNode {
+	tree := buildTestTree(t, dir)
+	s.peer = newSimPeer(tree)
+	s.requested = make(map[string]bool)
+	return tree
+}
+
+func TestUpdateDirectory(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 4)
+	sn := newSimNet(4)
+	sw := &simSwitch{}
+	sw.swap(t, src)
+	peerAddr := sn.Node("192.0.2.10", nil).Listen(8443, sw.handle)
+	defer useSimNet(sn, sn.Node("198.51.100.7", nil))()
+	conn := connectPeer("sim", [][]byte{[]byte(peerAddr.String())}, nil, nil, make([]byte, 64), emptyRootHash())
+	if conn == nil {
+		t.Fatalf("could not connect (%v)", sn)
+	}
+	defer conn.Close()
+
+	out := filepath.Join(t.TempDir(), "out")
+	if _, err := updateDirectory(context.Background(), conn, sw.peer.root, out, nil, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buildTestTree(t, out).Hash, sw.peer.root) {
+		t.Fatalf("first update does not match the peer")
+	}
+
+	//seul ce qui a changé est redemandé
+	os.WriteFile(filepath.Join(src, "docs/readme"), []byte("changed"), 0644)
+	sw.swap(t, src)
+	changes, err := updateDirectory(context.Background(), conn, sw.peer.root, out, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Path != "docs/readme" {
+		t.Fatalf("changes %v", changes)
+	}
+	if len(sw.requested) != 3 { //racine et docs pour le diff, puis readme
+		t.Fatalf("%d datums requested for one changed file, want 3", len(sw.requested))
+	}
+	if _, err := os.Stat(out + ".staging"); !os.IsNotExist(err) {
+		t.Fatalf("staging directory left behind: %v", err)
+	}
+
+	//un téléchargement qui échoue ne modifie rien : tout passe d'abord par le dossier temporaire
+	before := buildTestTree(t, out).Hash
+	os.WriteFile(filepath.Join(src, "small.txt"), []byte("changed too"), 0644)
+	os.WriteFile(filepath.Join(src, "images/thumbs/a.png"), make([]byte, 3*chunkSize), 0644)
+	tree := sw.swap(t, src)
+	png := nodeAt(t, tree, "images/thumbs/a.png")
+	delete(sw.peer.values, string(png.Children[1].Hash)) //le pair a perdu un chunk de a.png
+	*maxAttempts = 2
+	if _, err := updateDirectory(context.Background(), conn, sw.peer.root, out, nil, nil, false); err == nil {
+		t.Fatalf("update succeeded without a chunk of a.png")
+	}
+	if !bytes.Equal(buildTestTree(t, out).Hash, before) {
+		t.Fatalf("failed update modified the directory")
+	}
+	if _, err := os.Stat(out + ".staging"); !os.IsNotExist(err) {
+		t.Fatalf("staging directory left behind after a failure: %v", err)
+	}
+}
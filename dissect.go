@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+//===================================================================================================
+//                                DECODAGE LISIBLE DES DATAGRAMMES
+//===================================================================================================
+
+// Dissect décrit un datagramme champ par champ (type, Id, longueur, contenu selon le type, signature) ;
+// dissectLine en donne un résumé d'une ligne pour les journaux et les captures. La commande decode les
+// applique à des datagrammes en hexadécimal, à une capture (-capture) ou aux lignes d'un journal.
+
+var messageTypeNames = map[byte]string{
+	0:   "Hello",
+	1:   "PublicKey",
+	2:   "Root",
+	3:   "GetDatum",
+	128: "HelloReply",
+	129: "PublicKeyReply",
+	130: "RootReply",
+	131: "Datum",
+	132: "NoDatum",
+	133: "NatTraversalRequest",
+	134: "NatTraversal",
+	254: "Error",
+}
+
+func messageTypeName(typ byte) string {
+	if name, ok := messageTypeNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", typ)
+}
+
+var datumTypeNames = map[byte]string{chunkType: "chunk", bigFileType: "BigFile", directoryType: "directory"}
+
+// Dissect décrit data sur plusieurs lignes ; la signature est vérifiée si pubK est donnée
+func Dissect(data []byte, pubK *ecdsa.PublicKey) string {
+	var b strings.Builder
+	if len(data) < 7 {
+		fmt.Fprintf(&b, "truncated datagram (%d bytes): %x\n", len(data), data)
+		return b.String()
+	}
+	length := int(binary.BigEndian.Uint16(data[5:7]))
+	fmt.Fprintf(&b, "%v (type %d)\n", messageTypeName(data[4]), data[4])
+	fmt.Fprintf(&b, "  %v\n", field("id", "%x", data[:4]))
+	fmt.Fprintf(&b, "  %v\n", field("length", "%d", length))
+	if len(data) < 7+length {
+		fmt.Fprintf(&b, "  %v\n", field("truncated", "%d bytes of body received", len(data)-7))
+		return b.String()
+	}
+	for _, f := range bodyFields(data[4], data[7:7+length]) {
+		fmt.Fprintf(&b, "  %v\n", f)
+	}
+	fmt.Fprintf(&b, "  %v\n", field("signature", "%v", signatureStatus(data, length, pubK)))
+	return b.String()
+}
+
+// dissectLine résume data sur une ligne : type, Id et les champs principaux
+func dissectLine(data []byte) string {
+	if len(data) < 7 {
+		return fmt.Sprintf("truncated datagram (%d bytes)", len(data))
+	}
+	length := int(binary.BigEndian.Uint16(data[5:7]))
+	line := fmt.Sprintf("%v id %x len %d", messageTypeName(data[4]), data[:4], length)
+	if len(data) < 7+length {
+		return line + fmt.Sprintf(" (truncated, %d bytes of body)", len(data)-7)
+	}
+	body := data[7 : 7+length]
+	switch data[4] {
+	case 0, 128:
+		if len(body) >= 4 {
+			line += fmt.Sprintf(" name %q", body[4:])
+		}
+	case 2, 130, 3, 132:
+		if len(body) >= 32 {
+			line += fmt.Sprintf(" %x", body[:32])
+		}
+	case 131:
+		if len(body) > 32 {
+			line += fmt.Sprintf(" %x %v %d bytes", body[:32], datumTypeName(body[32]), len(body)-33)
+		}
+	case 133, 134:
+		if addr, err := parseNATAddress(body); err == nil {
+			line += fmt.Sprintf(" %v", addr)
+		}
+	case 254:
+		line += fmt.Sprintf(" %q", body)
+	}
+	if len(data) == 7+length+64 {
+		line += " signed"
+	}
+	return line
+}
+
+func datumTypeName(typ byte) string {
+	if name, ok := datumTypeNames[typ]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", typ)
+}
+
+// bodyFields décrit le corps d'un message de type typ, une ligne par champ
+func bodyFields(typ byte, body []byte) []string {
+	fields := make([]string, 0)
+	switch typ {
+	case 0, 128: //Hello, HelloReply
+		if len(body) < 4 {
+			return append(fields, field("bad body", "%d bytes, extensions need 4", len(body)))
+		}
+		fields = append(fields, field("extensions", "%08x", binary.BigEndian.Uint32(body[:4])))
+		fields = append(fields, field("name", "%q", body[4:]))
+	case 1, 129: //PublicKey, PublicKeyReply
+		if len(body) == 0 || bytes.Equal(body, make([]byte, 64)) {
+			return append(fields, field("key", "none (peer does not sign)"))
+		}
+		if len(body) != 64 {
+			return append(fields, field("bad key", "%d bytes, want 64", len(body)))
+		}
+		fields = append(fields, field("key X", "%x", body[:32]))
+		fields = append(fields, field("key Y", "%x", body[32:]))
+		if _, err := parsePublicKey(body); err != nil {
+			fields = append(fields, field("bad key", "%v", err))
+		}
+	case 2, 130, 3: //Root et RootReply (racine de l'émetteur), GetDatum
+		if len(body) != 32 {
+			return append(fields, field("bad hash", "%d bytes: %x", len(body), body))
+		}
+		fields = append(fields, field("hash", "%x", body))
+		if typ != 3 && bytes.Equal(body, emptyRootHash()) {
+			fields = append(fields, field("", "(empty tree)"))
+		}
+	case 132: //NoDatum
+		fields = append(fields, field("hash", "%x", body))
+	case 131: //Datum
+		return datumFields(body)
+	case 133, 134: //traversée de NAT
+		addr, err := parseNATAddress(body)
+		if err != nil {
+			return append(fields, field("bad address", "%v", err))
+		}
+		fields = append(fields, field("address", "%v", addr))
+	case 254: //Error
+		fields = append(fields, field("error", "%q", body))
+	default:
+		fields = append(fields, field("body", "%x", body))
+	}
+	return fields
+}
+
+// field aligne les valeurs des champs décrits par Dissect
+func field(label string, format string, args ...interface{}) string {
+	if label != "" {
+		label += ":"
+	}
+	return fmt.Sprintf("%-11s ", label) + fmt.Sprintf(format, args...)
+}
+
+// datumFields décrit un Datum : hash, type du noeud et ses fils ou son contenu
+func datumFields(body []byte) []string {
+	if len(body) < 33 {
+		return []string{field("bad datum", "%d bytes", len(body))}
+	}
+	hash, value := body[:32], body[32:]
+	fields := []string{field("hash", "%x", hash)}
+	if sum := sha256.Sum256(value); !bytes.Equal(sum[:], hash) {
+		fields = append(fields, field("", "does not match the value (sha256 %x)", sum))
+	}
+	fields = append(fields, field("node", "%v", datumTypeName(value[0])))
+	if err := checkDatum(value); err != nil {
+		fields = append(fields, field("malformed", "%v", err))
+	}
+	switch value[0] {
+	case chunkType:
+		fields = append(fields, field("data", "%d bytes %v", len(value)-1, preview(value[1:])))
+	case bigFileType:
+		for i, h := range childHashes(value) {
+			fields = append(fields, field(fmt.Sprintf("child %d", i), "%x", h))
+		}
+	case directoryType:
+		entries, err := parseDirectory(value)
+		if err != nil {
+			break
+		}
+		for _, e := range entries {
+			fields = append(fields, field("entry", "%-34q %x", e.Name, e.Hash))
+		}
+	}
+	return fields
+}
+
+// preview montre le début d'un chunk, en texte s'il est lisible
+func preview(data []byte) string {
+	const max = 32
+	short := data
+	if len(short) > max {
+		short = short[:max]
+	}
+	if utf8.Valid(short) && bytes.IndexFunc(short, func(r rune) bool { return r < 0x20 && r != '\n' && r != '\t' }) < 0 {
+		return fmt.Sprintf("%q", short)
+	}
+	return hex.EncodeToString(short)
+}
+
+// signatureStatus dit si data est signé et, avec pubK, si la signature est valide
+func signatureStatus(data []byte, length int, pubK *ecdsa.PublicKey) string {
+	extra := len(data) - 7 - length
+	switch {
+	case extra == 0:
+		return "none"
+	case extra != 64:
+		return fmt.Sprintf("%d trailing bytes, not a signature", extra)
+	case pubK == nil:
+		return "present, not checked (no key)"
+	}
+	if _, err := parseMessage(data, pubK); err != nil {
+		return "INVALID"
+	}
+	return "valid"
+}
+
+//===================================================================================================
+// commande decode
+
+// decodeMain décode des datagrammes donnés en hexadécimal, ou tous ceux d'une capture ; sans argument, chaque
+// ligne de l'entrée standard est décodée si elle contient un datagramme en hexadécimal (un journal par exemple)
+func decodeMain(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	keyHex := fs.String("key", "", "public key (X || Y in hex) used to check signatures")
+	captureIn := fs.String("capture", "", "decode every datagram of a capture file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var pubK *ecdsa.PublicKey
+	if *keyHex != "" {
+		raw, err := hex.DecodeString(*keyHex)
+		if err == nil {
+			pubK, err = parsePublicKey(raw)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bad key: %v\n", err)
+			return 2
+		}
+	}
+
+	switch {
+	case *captureIn != "":
+		packets, err := readCapture(*captureIn)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 2
+		}
+		for _, p := range packets {
+			fmt.Printf("%v %v %v\n", p.Time.Format("15:04:05.000000"), p.Dir, p.Peer)
+			fmt.Print(Dissect(p.Data, pubK))
+		}
+	case fs.NArg() > 0:
+		for _, arg := range fs.Args() {
+			data, err := hex.DecodeString(cleanHex(arg))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%q: %v\n", arg, err)
+				return 2
+			}
+			fmt.Print(Dissect(data, pubK))
+		}
+	default:
+		decodeLines(os.Stdin, os.Stdout, pubK)
+	}
+	return 0
+}
+
+// cleanHex retire les séparateurs courants (espaces, ':', '0x') d'un datagramme copié depuis un outil
+func cleanHex(s string) string {
+	s = strings.NewReplacer(" ", "", ":", "", "\t", "", "0x", "").Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// hexRun repère dans une ligne de journal une suite hexadécimale assez longue pour être un datagramme
+var hexRun = regexp.MustCompile(`[0-9a-fA-F]{14,}`)
+
+// decodeLines recopie r dans w et fait suivre chaque ligne contenant un datagramme en hexadécimal de sa description
+func decodeLines(r io.Reader, w io.Writer, pubK *ecdsa.PublicKey) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fmt.Fprintln(w, line)
+		for _, run := range hexRun.FindAllString(line, -1) {
+			data, err := hex.DecodeString(run)
+			if err != nil || len(data) < 7+int(binary.BigEndian.Uint16(data[5:7])) {
+				continue
+			}
+			for _, l := range strings.Split(strings.TrimRight(Dissect(data, pubK), "\n"), "\n") {
+				fmt.Fprintf(w, "    | %v\n", l)
+			}
+		}
+	}
+}
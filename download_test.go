@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestTree crée dans dir une arborescence avec des fichiers d'un chunk, d'un BigFile à deux niveaux
+// et des sous-dossiers, au contenu tiré de seed
+func writeTestTree(t *testing.T, dir string, seed int64) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+	files := map[string]int{
+		"small.txt":           100,
+		"exact.bin":           chunkSize,
+		"big.bin":             33*chunkSize + 17,
+		"docs/readme":         2500,
+		"docs/deep/nested":    5,
+		"docs/deep/empty":     0,
+		"images/photo.raw":    40 * chunkSize,
+		"images/thumbs/a.png": 700,
+	}
+	for name, size := range files {
+		data := make([]byte, size)
+		rng.Read(data)
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// simDownload télécharge tout l'arbre de peer à travers sn et renvoie le hash racine du dossier obtenu
+func simDownload(t *testing.T, sn *simNet, client *simNode, peerAddr string, out string) []byte {
+	t.Helper()
+	conn := connectPeer("sim", [][]byte{[]byte(peerAddr)}, nil, nil, make([]byte, 64), emptyRootHash())
+	if conn == nil {
+		t.Fatalf("could not connect to %v (%v)", peerAddr, sn)
+	}
+	defer conn.Close()
+	root, err := rootRequest(conn, emptyRootHash(), nil, nil)
+	if err != nil {
+		t.Fatalf("root: %v (%v)", err, sn)
+	}
+
+	sn.mu.Lock()
+	sn.Loss, sn.Dup, sn.Reorder, sn.Jitter = 0.3, 0.05, 0.1, 15*time.Millisecond
+	sn.mu.Unlock()
+
+	response, err := getDatum(conn, root, nil, nil)
+	if err != nil {
+		t.Fatalf("root datum: %v (%v)", err, sn)
+	}
+	dl := newDownload(out)
+	collectDirectory(context.Background(), response, conn, "root", out, nil, nil, dl)
+	if len(dl.failed) > 0 || len(dl.rejected) > 0 {
+		t.Fatalf("failed %v, rejected %v (%v)", dl.failed, dl.rejected, sn)
+	}
+	tree, err := BuildMerkleTree(out, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree.Hash
+}
+
+func quietLog(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestDownloadTreeUnderLoss(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 1)
+	tree, err := BuildMerkleTree(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() (string, []byte) {
+		sn := newSimNet(42)
+		peer := newSimPeer(tree)
+		peerAddr := sn.Node("192.0.2.10", nil).Listen(8443, peer.handle)
+		client := sn.Node("198.51.100.7", nil)
+		defer useSimNet(sn, client)()
+		*maxAttempts = 30 //à 30% de pertes dans chaque sens, un aller-retour sur deux échoue
+
+		got := simDownload(t, sn, client, peerAddr.String(), filepath.Join(t.TempDir(), "root"))
+		if !bytes.Equal(got, tree.Hash) {
+			t.Fatalf("downloaded tree %x, want %x", got, tree.Hash)
+		}
+		if sn.Dropped == 0 || sn.Duplicated == 0 {
+			t.Fatalf("the network did not lose or duplicate anything: %v", sn)
+		}
+		return sn.String(), got
+	}
+
+	first, _ := run()
+	second, _ := run()
+	if first != second { //même graine : même suite de paquets, même durée virtuelle
+		t.Fatalf("simulation is not reproducible:\n%v\n%v", first, second)
+	}
+	t.Log(first)
+}
+
+func TestNATTraversal(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 2)
+	tree, err := BuildMerkleTree(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		filtering string
+		direct    bool //un Hello direct passe
+		traversal bool //un Hello après la demande au serveur passe
+	}{
+		{natEndpointIndependent, true, true},
+		{natAddressDependent, false, true},
+		{natPortDependent, false, false},
+	} {
+		t.Run(tc.filtering, func(t *testing.T) {
+			sn := newSimNet(7)
+			serverAddr := sn.Node("203.0.113.1", nil).Listen(8443, simServer)
+			nat := newSimNAT("192.0.2.99", natEndpointIndependent, tc.filtering)
+			peerNode := sn.Node("10.0.0.2", nat)
+			peer := newSimPeer(tree)
+			peer.greet = true
+			peer.server = serverAddr
+			inside := peerNode.Listen(9000, peer.handle)
+			public := nat.outbound(inside, serverAddr) //le pair s'est enregistré auprès du serveur
+			client := sn.Node("198.51.100.7", nil)
+			defer useSimNet(sn, client)()
+			*maxAttempts = 3
+
+			direct := connectPeer("sim", [][]byte{[]byte(public.String())}, nil, nil, make([]byte, 64), emptyRootHash())
+			if (direct != nil) != tc.direct {
+				t.Fatalf("direct Hello: got %v, want %v (%v)", direct != nil, tc.direct, sn)
+			}
+
+			connJCH, _ := client.Dial(serverAddr.String())
+			conn := NATTravMessage([][]byte{[]byte(public.String())}, connJCH, nil, nil)
+			if (conn != nil) != tc.traversal {
+				t.Fatalf("traversal: got %v, want %v (%v)", conn != nil, tc.traversal, sn)
+			}
+			if conn == nil {
+				return
+			}
+			root, err := getDatum(conn, tree.Hash, nil, nil)
+			if err != nil || !bytes.Equal(root.Body[32:], tree.Value) {
+				t.Fatalf("GetDatum through the NAT: %v", err)
+			}
+		})
+	}
+}
+
+// cancelAfter annule un contexte à la n-ième lecture sur le Transport qu'il enveloppe
+type cancelAfter struct {
+	Transport
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfter) Read(b []byte) (int, error) {
+	if c.n--; c.n == 0 {
+		c.cancel()
+	}
+	return c.Transport.Read(b)
+}
+
+func TestDownloadCancelled(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 5)
+	tree, err := BuildMerkleTree(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := newSimNet(45)
+	peer := newSimPeer(tree)
+	peerAddr := sn.Node("192.0.2.10", nil).Listen(8443, peer.handle)
+	client := sn.Node("198.51.100.7", nil)
+	defer useSimNet(sn, client)()
+
+	conn := connectPeer("sim", [][]byte{[]byte(peerAddr.String())}, nil, nil, make([]byte, 64), emptyRootHash())
+	if conn == nil {
+		t.Fatalf("could not connect to %v", peerAddr)
+	}
+	defer conn.Close()
+	response, err := getDatum(conn, tree.Hash, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := filepath.Join(t.TempDir(), "root")
+	dl := newDownload(out)
+	collectDirectory(ctx, response, &cancelAfter{conn, 60, cancel}, "root", out, nil, nil, dl)
+	if len(dl.failed) == 0 {
+		t.Fatalf("download not interrupted")
+	}
+
+	//ce qui a été écrit avant l'annulation est complet, le reste est absent
+	written := 0
+	err = filepath.Walk(out, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(out, p)
+		want, err := os.ReadFile(filepath.Join(src, rel))
+		if err != nil {
+			return err
+		}
+		got, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%v: partial file left after cancellation", rel)
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written == 0 {
+		t.Fatalf("nothing written before the cancellation")
+	}
+	t.Logf("%d files written, %d interrupted", written, len(dl.failed))
+}
+
+func TestDownloadSocketError(t *testing.T) {
+	quietLog(t)
+	conn := newSinkConn("192.0.2.10:8443") //chaque lecture échoue sans être un timeout
+	hashes := [][]byte{make([]byte, 32), bytes.Repeat([]byte{1}, 32)}
+	results, missing := fetchDatumsPartial(context.Background(), conn, hashes, nil, nil)
+	if len(results) != 0 || len(missing) != len(hashes) {
+		t.Fatalf("%d results and %d missing, want all %d missing", len(results), len(missing), len(hashes))
+	}
+	if conn.sent != len(hashes) {
+		t.Fatalf("%d datagrams sent for %d hashes: retransmitted on a broken socket", conn.sent, len(hashes))
+	}
+}
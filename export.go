@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//===================================================================================================
+//                                EXPORT DE PLUSIEURS DOSSIERS
+//===================================================================================================
+
+// Le protocole ne donne qu'une racine par pair : les dossiers exportés (docs/, images/, ...) sont donc
+// les entrées d'un répertoire synthétique dont le hash est celui que l'on annonce dans RootReply.
+// Chaque export garde son propre sous-arbre : en ajouter, en retirer ou en reconstruire un ne recalcule
+// que ce sous-arbre et le répertoire de tête.
+
+type exportSpec struct {
+	Name    string
+	Dir     string
+	Include []string //motifs (path.Match) des fichiers à exporter, tous si vide
+	Exclude []string //motifs des fichiers et dossiers à ne pas exporter
+}
+
+type exportList []exportSpec
+
+func (l *exportList) String() string {
+	names := make([]string, 0, len(*l))
+	for _, e := range *l {
+		names = append(names, e.Name+"="+e.Dir)
+	}
+	return strings.Join(names, " ")
+}
+
+func (l *exportList) Set(value string) error {
+	spec, err := parseExportSpec(strings.Split(value, ";"))
+	if err != nil {
+		return err
+	}
+	*l = append(*l, spec)
+	return nil
+}
+
+var exportFlags exportList
+var exportsFile = flag.String("exports-file", "", "file listing exported directories, reloaded on SIGHUP")
+
+func init() {
+	flag.Var(&exportFlags, "export", "export a directory: name=dir[;include=glob,glob][;exclude=glob,glob] (repeatable)")
+}
+
+func (s exportSpec) equal(o exportSpec) bool {
+	return s.Name == o.Name && s.Dir == o.Dir && slices.Equal(s.Include, o.Include) && slices.Equal(s.Exclude, o.Exclude)
+}
+
+// parseExportSpec lit "name=dir" suivi d'options "include=..." et "exclude=..."
+func parseExportSpec(fields []string) (exportSpec, error) {
+	var spec exportSpec
+	if len(fields) == 0 || !strings.Contains(fields[0], "=") {
+		return spec, fmt.Errorf("export must be name=dir")
+	}
+	nameDir := strings.SplitN(fields[0], "=", 2)
+	spec.Name, spec.Dir = strings.TrimSpace(nameDir[0]), strings.TrimSpace(nameDir[1])
+	if err := checkEntryName(spec.Name); err != nil {
+		return spec, fmt.Errorf("export name %q: %v", spec.Name, err)
+	}
+	for _, f := range fields[1:] {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) != 2 {
+			return spec, fmt.Errorf("bad export option %q", f)
+		}
+		globs := strings.Split(kv[1], ",")
+		for _, g := range globs {
+			if _, err := path.Match(g, ""); err != nil {
+				return spec, fmt.Errorf("bad pattern %q", g)
+			}
+		}
+		switch kv[0] {
+		case "include":
+			spec.Include = append(spec.Include, globs...)
+		case "exclude":
+			spec.Exclude = append(spec.Exclude, globs...)
+		default:
+			return spec, fmt.Errorf("unknown export option %q", kv[0])
+		}
+	}
+	return spec, nil
+}
+
+// readExportsFile lit un export par ligne : "name=dir include=glob,glob exclude=glob", # pour les commentaires
+func readExportsFile(file string) ([]exportSpec, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	specs := make([]exportSpec, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		spec, err := parseExportSpec(strings.Fields(line))
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, scanner.Err()
+}
+
+// matchAny indique si le chemin relatif p ou son nom correspond à l'un des motifs
+func matchAny(globs []string, p string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, p); ok {
+			return true
+		}
+		if ok, _ := path.Match(g, path.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (spec exportSpec) keep(p string, isDir bool) bool {
+	if matchAny(spec.Exclude, p) {
+		return false
+	}
+	if isDir || len(spec.Include) == 0 {
+		return true
+	}
+	return matchAny(spec.Include, p)
+}
+
+type exportedTree struct {
+	spec  exportSpec
+	tree  *MerkleNode
+	index map[string]*MerkleNode
+}
+
+type exporter struct {
+	mu    sync.Mutex
+	trees map[string]*exportedTree //clé : nom de l'export
+	root  *MerkleNode              //répertoire de tête
+}
+
+// exports est ce que l'on publie, nil si on n'exporte rien
+var exports *exporter
+
+func newExporter() *exporter {
+	return &exporter{trees: make(map[string]*exportedTree)}
+}
+
+// AddExport (re)construit le sous-arbre d'un export et met à jour la racine
+func (ex *exporter) AddExport(spec exportSpec) error {
+	tree, err := BuildFilteredTree(spec.Dir, spec.Name, spec.keep)
+	if err != nil {
+		return err
+	}
+	index := make(map[string]*MerkleNode)
+	IndexTree(tree, index)
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	old := ex.trees[spec.Name]
+	ex.trees[spec.Name] = &exportedTree{spec, tree, index}
+	err = ex.rebuildRoot()
+	if err != nil { //trop d'exports : on revient à l'état précédent
+		if old != nil {
+			ex.trees[spec.Name] = old
+		} else {
+			delete(ex.trees, spec.Name)
+		}
+	}
+	return err
+}
+
+func (ex *exporter) RemoveExport(name string) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if _, ok := ex.trees[name]; !ok {
+		return fmt.Errorf("no export named %v", name)
+	}
+	delete(ex.trees, name)
+	return ex.rebuildRoot()
+}
+
+// rebuildRoot recalcule le répertoire de tête à partir des sous-arbres, ex.mu doit être pris
+func (ex *exporter) rebuildRoot() error {
+	names := make([]string, 0, len(ex.trees))
+	for name := range ex.trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	children := make([]*MerkleNode, 0, len(names))
+	for _, name := range names {
+		children = append(children, ex.trees[name].tree)
+	}
+	root, err := BuildDirectoryNode("", ".", children)
+	if err != nil {
+		return err
+	}
+	ex.root = root
+	return nil
+}
+
+// Sync applique une nouvelle liste d'exports : ajoute les nouveaux, retire ceux qui ont disparu,
+// reconstruit ceux dont la définition a changé, et ne touche pas aux autres
+func (ex *exporter) Sync(specs []exportSpec) {
+	wanted := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		wanted[spec.Name] = true
+		ex.mu.Lock()
+		current, ok := ex.trees[spec.Name]
+		ex.mu.Unlock()
+		if ok && current.spec.equal(spec) {
+			continue
+		}
+		if err := ex.AddExport(spec); err != nil {
+			slog.Error("Export failed", "export", spec.Name, "dir", spec.Dir, "err", err)
+		} else {
+			slog.Info("Exporting", "export", spec.Name, "dir", spec.Dir)
+		}
+	}
+	ex.mu.Lock()
+	names := make([]string, 0)
+	for name := range ex.trees {
+		if !wanted[name] {
+			names = append(names, name)
+		}
+	}
+	ex.mu.Unlock()
+	for _, name := range names {
+		ex.RemoveExport(name)
+		slog.Info("Export removed", "export", name)
+	}
+}
+
+// RootHash est le hash annoncé dans RootReply
+func (ex *exporter) RootHash() []byte {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	return ex.root.Hash
+}
+
+// get renvoie la valeur du noeud hash s'il fait partie de ce que l'on exporte
+func (ex *exporter) get(hash []byte) ([]byte, bool) {
+	if ex == nil {
+		return nil, false
+	}
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	if ex.root != nil && string(ex.root.Hash) == string(hash) {
+		return ex.root.Value, true
+	}
+	for _, t := range ex.trees {
+		if n, ok := t.index[string(hash)]; ok {
+			return n.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ourRoot est le hash racine que l'on annonce : celui des exports, ou la racine vide
+func ourRoot() []byte {
+	if exports == nil {
+		return emptyRootHash()
+	}
+	return exports.RootHash()
+}
+
+// initExports construit les exports donnés sur la ligne de commande et, avec -exports-file,
+// relit ce fichier à chaque SIGHUP ; privK signe les annonces de la racine et les RootReply
+func initExports(privK *ecdsa.PrivateKey) {
+	announce.Lock()
+	announce.privK = privK
+	announce.Unlock()
+	if len(exportFlags) == 0 && *exportsFile == "" {
+		return
+	}
+	exports = newExporter()
+	exports.rebuildRoot()
+	trackSessions()
+	load := func() {
+		before := exports.RootHash()
+		specs := append(make([]exportSpec, 0), exportFlags...)
+		if *exportsFile != "" {
+			fromFile, err := readExportsFile(*exportsFile)
+			if err != nil {
+				slog.Error("Exports file", "file", *exportsFile, "err", err)
+				return
+			}
+			specs = append(specs, fromFile...)
+		}
+		exports.Sync(specs)
+		if root := exports.RootHash(); !bytes.Equal(root, before) {
+			slog.Info("Root changed", hashAttr(root))
+			announceRoot(root)
+		}
+	}
+	load()
+
+	if *exportsFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				load()
+			}
+		}()
+	}
+}
+
+//===================================================================================================
+// annonce de la racine
+
+// Quand les exports changent, notre racine change : on envoie un Root portant la nouvelle racine sur chaque
+// session ouverte (le serveur et les pairs), comme à l'enregistrement. serveRequest absorbe les RootReply à
+// ces annonces, et répond aux Root reçus avec la racine du moment.
+
+var announce = struct {
+	sync.Mutex
+	privK    *ecdsa.PrivateKey
+	sessions map[*trackedTransport]bool
+	pending  map[string]bool //Id des Root envoyés par announceRoot, en attente de leur RootReply
+}{sessions: make(map[*trackedTransport]bool), pending: make(map[string]bool)}
+
+// maxPendingAnnounces borne les Id de Root sans réponse que l'on garde
+const maxPendingAnnounces = 1024
+
+// trackedTransport est une session ouverte par dialTransport, retirée des annonces à sa fermeture
+type trackedTransport struct {
+	Transport
+}
+
+func (t *trackedTransport) Close() error {
+	announce.Lock()
+	delete(announce.sessions, t)
+	announce.Unlock()
+	return t.Transport.Close()
+}
+
+// trackSessions garde la liste des sessions ouvertes par dialTransport, à qui annoncer la racine
+func trackSessions() {
+	dial := dialTransport
+	dialTransport = func(addr string) (Transport, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		t := &trackedTransport{conn}
+		announce.Lock()
+		announce.sessions[t] = true
+		announce.Unlock()
+		return t, nil
+	}
+}
+
+// announceRoot envoie un Root portant root sur chaque session ouverte
+func announceRoot(root []byte) {
+	announce.Lock()
+	defer announce.Unlock()
+	if len(announce.pending) > maxPendingAnnounces {
+		announce.pending = make(map[string]bool)
+	}
+	for t := range announce.sessions {
+		mess := NewMessage(newID(), []byte{2}, root, announce.privK)
+		announce.pending[string(mess.Id)] = true
+		slog.Debug("Announcing root", peerAttr(t.RemoteAddr()), idAttr(mess.Id), hashAttr(root))
+		MessageSender(t, mess)
+	}
+}
+
+// announceReplied dit si id est celui d'une annonce de la racine, et l'oublie
+func announceReplied(id []byte) bool {
+	announce.Lock()
+	defer announce.Unlock()
+	if !announce.pending[string(id)] {
+		return false
+	}
+	delete(announce.pending, string(id))
+	return true
+}
+
+// rootReply est la réponse à un Root reçu : notre racine, avec l'Id du Root
+func rootReply(id []byte) Message {
+	announce.Lock()
+	privK := announce.privK
+	announce.Unlock()
+	return NewMessage(append([]byte(nil), id...), []byte{130}, ourRoot(), privK)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAnnounceRoot(t *testing.T) {
+	quietLog(t)
+	useLimits(t, 0, 0, 0, 0, 0)
+	savedDial := dialTransport
+	defer func() { dialTransport = savedDial }()
+	dialTransport = func(addr string) (Transport, error) { return newSinkConn(addr), nil }
+	trackSessions()
+	open, _ := dialTransport("192.0.2.1:1")
+	closed, _ := dialTransport("192.0.2.2:1")
+	closed.Close()
+
+	//la nouvelle racine est annoncée aux sessions ouvertes seulement
+	root := useTestExport(t)
+	announceRoot(root)
+	conn, gone := open.(*trackedTransport).Transport.(*sinkConn), closed.(*trackedTransport).Transport.(*sinkConn)
+	if conn.sent != 1 || gone.sent != 0 {
+		t.Fatalf("%d and %d announces sent, want 1 to the open session only", conn.sent, gone.sent)
+	}
+	mess := BytesToMessage(conn.last, nil)
+	if mess.Type[0] != 2 || !bytes.Equal(mess.Body, root) {
+		t.Fatalf("announce is %v, want a Root with %x", mess, root)
+	}
+	open.Close()
+
+	//le RootReply à l'annonce est absorbé une fois
+	reply := MessageToBytes(NewMessage(mess.Id, []byte{130}, emptyRootHash(), nil))
+	if !serveRequest(conn, reply) {
+		t.Fatalf("RootReply to the announce not absorbed")
+	}
+	if serveRequest(conn, reply) {
+		t.Fatalf("RootReply absorbed twice")
+	}
+
+	//un Root reçu a pour réponse notre racine
+	request := NewMessage(newID(), []byte{2}, emptyRootHash(), nil)
+	if !serveRequest(conn, MessageToBytes(request)) || conn.sent != 2 {
+		t.Fatalf("Root not answered")
+	}
+	if mess := BytesToMessage(conn.last, nil); mess.Type[0] != 130 || !bytes.Equal(mess.Id, request.Id) || !bytes.Equal(mess.Body, root) {
+		t.Fatalf("reply to Root is %v, want a RootReply with %x", mess, root)
+	}
+
+	//sauf pendant la poignée de main, où c'est la réponse attendue à notre PublicKeyReply
+	conn.replies = [][]byte{MessageToBytes(request)}
+	if mess := MessageListener(conn, NewMessage(newID(), []byte{129}, make([]byte, 64), nil), false, nil); mess.Type[0] != 2 {
+		t.Fatalf("Root of the handshake not returned: %v", mess)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// Tout ce qui est décodé ici vient du réseau. Les cibles vérifient qu'aucune entrée ne fait paniquer le
+// décodage, et que ce qui est accepté se réencode à l'identique. Le corpus de départ (testdata/fuzz, local-*) est
+// construit localement, ce ne sont pas des captures : un message de chaque type échangé avec jch.irif.fr, et les
+// Datum reconstruits à partir de l'arbre téléchargé dans downlaod_from_jch.irif.fr.
+// Lancer une cible : go test -run '^$' -fuzz FuzzBytesToMessage
+
+func FuzzBytesToMessage(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{1, 2, 3, 4, 0, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		quietLog(t)
+		Dissect(packet, nil) //le décodage lisible ne doit pas paniquer non plus
+		dissectLine(packet)
+		mess, err := parseMessage(packet, nil)
+		if err != nil {
+			if m := BytesToMessage(packet, nil); m.Type[0] != 254 {
+				t.Fatalf("malformed packet decoded as type %d", m.Type[0])
+			}
+			return
+		}
+		length := int(binary.BigEndian.Uint16(packet[5:7]))
+		if len(mess.Body) != length {
+			t.Fatalf("body of %d bytes, length field says %d", len(mess.Body), length)
+		}
+		if got := MessageToBytes(mess); !bytes.Equal(got, packet[:7+length]) {
+			t.Fatalf("re-encoded as %x, want %x", got, packet[:7+length])
+		}
+		for i := range packet { //le message ne doit pas partager la mémoire du datagramme, qui sera réutilisé
+			packet[i] ^= 0xff
+		}
+		if got := MessageToBytes(mess); bytes.Equal(got, packet[:7+length]) {
+			t.Fatalf("message aliases the packet")
+		}
+	})
+}
+
+var fuzzKey *ecdsa.PrivateKey
+
+func FuzzSignedMessage(f *testing.F) {
+	if fuzzKey == nil {
+		var err error
+		fuzzKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			f.Fatal(err)
+		}
+	}
+	f.Add([]byte{1, 2, 3, 4, 0, 0, 4, 0, 0, 0, 0}, uint16(0))
+	f.Fuzz(func(t *testing.T, packet []byte, flip uint16) {
+		//un datagramme quelconque n'a pas de signature valide
+		if _, err := parseMessage(packet, &fuzzKey.PublicKey); err == nil {
+			t.Fatalf("unsigned packet %x accepted", packet)
+		}
+		if len(packet) < 7 || len(packet)-7 > 0xffff {
+			return
+		}
+		//un message signé par NewMessage est accepté, et ne l'est plus dès qu'un octet change
+		mess := NewMessage(append([]byte(nil), packet[:4]...), []byte{packet[4]}, packet[7:], fuzzKey)
+		signed := MessageToBytes(mess)
+		got, err := parseMessage(signed, &fuzzKey.PublicKey)
+		if err != nil {
+			t.Fatalf("signed message rejected: %v", err)
+		}
+		if !bytes.Equal(MessageToBytes(got), signed) {
+			t.Fatalf("signed message re-encoded differently")
+		}
+		signed[int(flip)%len(signed)] ^= 1
+		if _, err := parseMessage(signed, &fuzzKey.PublicKey); err == nil {
+			t.Fatalf("message with byte %d flipped accepted", int(flip)%len(signed))
+		}
+	})
+}
+
+func FuzzDatum(f *testing.F) {
+	f.Add([]byte{chunkType})
+	f.Add(append([]byte{bigFileType}, make([]byte, 2*32)...))
+	f.Fuzz(func(t *testing.T, value []byte) {
+		children := childHashes(value)
+		for _, h := range children {
+			if len(h) != 32 {
+				t.Fatalf("child hash of %d bytes", len(h))
+			}
+		}
+		if err := checkDatum(value); err != nil {
+			return
+		}
+		switch value[0] {
+		case chunkType:
+			if len(children) != 0 {
+				t.Fatalf("chunk with %d children", len(children))
+			}
+		case bigFileType:
+			if len(children) < 2 || len(children) > bigFileArity || 1+32*len(children) != len(value) {
+				t.Fatalf("BigFile of %d bytes accepted with %d children", len(value), len(children))
+			}
+		case directoryType:
+			if len(children) > maxDirEntries {
+				t.Fatalf("directory accepted with %d entries", len(children))
+			}
+		}
+	})
+}
+
+// FuzzDatumReply passe une réponse à un GetDatum dans les vérifications de getDatum, puis dans ce que
+// browsePeer fait d'un Datum accepté
+func FuzzDatumReply(f *testing.F) {
+	empty := sha256.Sum256(nil)
+	f.Add(MessageToBytes(NewMessage([]byte{1, 2, 3, 4}, []byte{131}, empty[:], nil))) //32 octets : le hash de la valeur vide, sans valeur
+	f.Add(MessageToBytes(NewMessage([]byte{1, 2, 3, 4}, []byte{131}, []byte{directoryType}, nil)))
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		mess, err := parseMessage(packet, nil)
+		if err != nil {
+			return
+		}
+		hash := mess.Body[:min(32, len(mess.Body))] //le hash que l'on aurait demandé
+		if checkDatumReply(mess, hash) != nil {
+			return
+		}
+		if len(mess.Body) < 33 || !checkHash(mess) {
+			t.Fatalf("reply of %d bytes accepted", len(mess.Body))
+		}
+		if mess.Body[32] == directoryType {
+			entries, err := parseDirectory(mess.Body[32:])
+			if err != nil {
+				t.Fatalf("accepted directory does not parse: %v", err)
+			}
+			filterEntries(entries)
+		}
+	})
+}
+
+func FuzzDirectoryEntries(f *testing.F) {
+	f.Add([]byte{directoryType})
+	f.Fuzz(func(t *testing.T, value []byte) {
+		entries, err := parseDirectory(value)
+		if err != nil {
+			return
+		}
+		//réencodage : le nom complété par des 0 suivi du hash redonne exactement l'entrée reçue
+		encoded := []byte{directoryType}
+		for _, e := range entries {
+			name, err := padName(e.Name)
+			if err != nil {
+				t.Fatalf("entry name %q: %v", e.Name, err)
+			}
+			encoded = append(append(encoded, name...), e.Hash...)
+		}
+		if !bytes.Equal(encoded, value) {
+			t.Fatalf("directory re-encoded as %x, want %x", encoded, value)
+		}
+		ok, rejected := filterEntries(entries)
+		if len(ok)+len(rejected) != len(entries) {
+			t.Fatalf("%d entries kept and %d rejected out of %d", len(ok), len(rejected), len(entries))
+		}
+		seen := make(map[string]bool)
+		for _, e := range ok {
+			if err := checkEntryName(e.Name); err != nil || seen[e.Name] {
+				t.Fatalf("unsafe entry %q kept", e.Name)
+			}
+			seen[e.Name] = true
+		}
+	})
+}
+
+func FuzzNATAddress(f *testing.F) {
+	f.Add([]byte{192, 0, 2, 1, 0x20, 0xfb})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		if addr, err := parseNATAddress(body); err == nil {
+			checkNATRoundTrip(t, addr)
+		}
+		//body lu comme la liste d'adresses renvoyée par le serveur REST
+		for _, line := range ParseREST(body) {
+			host, _, err := net.SplitHostPort(string(line))
+			if err != nil || net.ParseIP(host) == nil {
+				continue //pas de résolution de noms pendant le fuzzing
+			}
+			enc, err := natTraversalBody(string(line))
+			if err != nil {
+				continue
+			}
+			addr, err := parseNATAddress(enc)
+			if err != nil {
+				t.Fatalf("%q encoded as %x, which does not decode: %v", line, enc, err)
+			}
+			checkNATRoundTrip(t, addr)
+		}
+	})
+}
+
+// checkNATRoundTrip vérifie que addr se code puis se décode sans changer
+func checkNATRoundTrip(t *testing.T, addr *net.UDPAddr) {
+	t.Helper()
+	enc, err := natTraversalBody(addr.String())
+	if err != nil {
+		t.Fatalf("%v: %v", addr, err)
+	}
+	back, err := parseNATAddress(enc)
+	if err != nil {
+		t.Fatalf("%v encoded as %x: %v", addr, enc, err)
+	}
+	if !back.IP.Equal(addr.IP) || back.Port != addr.Port {
+		t.Fatalf("%v came back as %v", addr, back)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===================================================================================================
+//                                PASSERELLE HTTP
+//===================================================================================================
+
+// Passerelle HTTP locale pour parcourir les arbres des pairs avec un navigateur :
+//   /peers                  liste des pairs
+//   /peers/<pair>/chemin/   contenu d'un répertoire
+//   /peers/<pair>/chemin    téléchargement d'un fichier (Range accepté, ETag = hash de Merkle)
+//   /dav/<pair>/chemin      les mêmes arbres en WebDAV, en lecture seule (voir webdav.go)
+
+var httpAddr = flag.String("http", "", "address of the HTTP gateway, e.g. :8080 (listens on localhost only unless a host is given)")
+var httpCache = flag.Int("http-cache", 16<<20, "size in bytes of the gateway's in-memory datum cache")
+
+// peerSession est une session UDP avec un pair, partagée entre les requêtes HTTP
+type peerSession struct {
+	mu    sync.Mutex //une seule requête à la fois lit sur conn
+	name  string
+	conn  Transport
+	ready chan struct{} //fermé quand la connexion au pair a abouti (conn) ou échoué (err)
+	err   error
+}
+
+type gateway struct {
+	ctx      context.Context //annulé à l'arrêt : les téléchargements en cours s'interrompent
+	client   http.Client
+	privK    *ecdsa.PrivateKey
+	bobK     *ecdsa.PublicKey
+	pubK     []byte
+	mu       sync.Mutex
+	sessions map[string]*peerSession
+	cache    *datumCache
+}
+
+func newGateway(ctx context.Context, client http.Client, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, pubK []byte) *gateway {
+	return &gateway{ctx: ctx, client: client, privK: privK, bobK: bobK, pubK: pubK, sessions: make(map[string]*peerSession), cache: newDatumCache(*httpCache)}
+}
+
+// gatewayListenAddr limite l'écoute à localhost si aucune adresse n'est précisée
+func gatewayListenAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "127.0.0.1" + addr
+	}
+	return addr
+}
+
+// startGateway lance la passerelle si -http est donné, jusqu'à l'annulation de ctx
+func startGateway(ctx context.Context, client http.Client, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, pubK []byte) {
+	if *httpAddr == "" {
+		return
+	}
+	addr := gatewayListenAddr(*httpAddr)
+	g := newGateway(ctx, client, privK, bobK, pubK)
+	srv := &http.Server{Addr: addr, Handler: g}
+	go func() {
+		slog.Info("HTTP gateway", "url", "http://"+addr+"/peers")
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			slog.Error("HTTP gateway", "err", err)
+		}
+	}()
+	context.AfterFunc(ctx, func() {
+		srv.Close() //les requêtes en cours échouent avec leur session, fermée juste après
+		g.closeSessions()
+	})
+}
+
+// session renvoie la session avec le pair name, en l'ouvrant si besoin. La connexion au pair peut prendre
+// plusieurs RTO : elle se fait hors de g.mu, et les requêtes pour le même pair attendent qu'elle aboutisse.
+func (g *gateway) session(name string) (*peerSession, error) {
+	g.mu.Lock()
+	s, ok := g.sessions[name]
+	if !ok {
+		s = &peerSession{name: name, ready: make(chan struct{})}
+		g.sessions[name] = s
+	}
+	g.mu.Unlock()
+	if ok {
+		select {
+		case <-s.ready:
+		case <-g.ctx.Done():
+			return nil, context.Cause(g.ctx)
+		}
+		if s.err != nil {
+			return nil, s.err
+		}
+		return s, nil
+	}
+
+	conn, err := g.dial(name)
+	g.mu.Lock()
+	if err == nil && g.sessions[name] != s { //fermée par closeSessions pendant la connexion
+		conn.Close()
+		err = fmt.Errorf("session with %v closed", name)
+	}
+	if err != nil {
+		if g.sessions[name] == s {
+			delete(g.sessions, name) //la prochaine requête réessaiera
+		}
+	} else {
+		s.conn = conn
+	}
+	s.err = err
+	close(s.ready)
+	g.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// dial ouvre une session avec le pair name
+func (g *gateway) dial(name string) (Transport, error) {
+	addrs, err := HttpRequest("GET", jchPeersAddr+url.PathEscape(name)+"/addresses", g.client) //name vient de l'URL demandée
+	if err != nil {
+		return nil, err
+	}
+	conn := connectPeer(name, ParseREST(addrs), g.privK, g.bobK, g.pubK, ourRoot())
+	if conn == nil {
+		return nil, fmt.Errorf("cannot open session with %v", name)
+	}
+	return conn, nil
+}
+
+// drop ferme une session qui ne répond plus, la prochaine requête en ouvrira une nouvelle
+func (g *gateway) drop(s *peerSession) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sessions[s.name] == s {
+		delete(g.sessions, s.name)
+		s.conn.Close()
+	}
+}
+
+// closeSessions ferme toutes les sessions, à l'arrêt ; celles en cours d'ouverture seront fermées par session
+func (g *gateway) closeSessions() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name, s := range g.sessions {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		delete(g.sessions, name)
+	}
+}
+
+// fetch renvoie la valeur de chaque noeud de hashes, en ne demandant au pair que ceux qui ne sont
+// pas dans le cache, s doit être verrouillée
+func (g *gateway) fetch(s *peerSession, hashes [][]byte) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(hashes))
+	missing := make([][]byte, 0)
+	for _, h := range hashes {
+		if v, ok := g.cache.get(h); ok {
+			values[string(h)] = v
+		} else {
+			missing = append(missing, h)
+		}
+	}
+	if len(missing) == 0 {
+		return values, nil
+	}
+	fetched, err := fetchDatums(g.ctx, s.conn, missing, g.privK, g.bobK)
+	if err != nil {
+		return nil, err
+	}
+	for h, m := range fetched {
+		values[h] = m.Body[32:]
+		g.cache.put([]byte(h), m.Body[32:])
+	}
+	return values, nil
+}
+
+// datum récupère un noeud du pair, s doit être verrouillée
+func (g *gateway) datum(s *peerSession, hash []byte) ([]byte, error) {
+	values, err := g.fetch(s, [][]byte{hash})
+	if err != nil {
+		return nil, err
+	}
+	return values[string(hash)], nil
+}
+
+// reader lit les fichiers du pair de s à travers le cache, s doit être verrouillée
+func (g *gateway) reader(s *peerSession) *FileReader {
+	return NewFileReader(func(hashes [][]byte) (map[string][]byte, error) {
+		return g.fetch(s, hashes)
+	})
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "dav" {
+		g.serveDAV(w, r, parts[1:])
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if parts[0] != "peers" {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		g.listPeers(w)
+		return
+	}
+	g.servePeerPath(w, r, parts[1], parts[2:])
+}
+
+// peerList renvoie les noms des pairs connus du serveur
+func (g *gateway) peerList() ([]string, error) {
+	body, err := HttpRequest("GET", jchPeersAddr, g.client)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, p := range ParseREST(body) {
+		names = append(names, string(p))
+	}
+	return names, nil
+}
+
+func (g *gateway) listPeers(w http.ResponseWriter) {
+	names, err := g.peerList()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body><h1>Peers</h1><ul>\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "<li><a href=\"/peers/%v/\">%v</a></li>\n", url.PathEscape(name), html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</ul></body></html>\n")
+}
+
+// resolve descend depuis la racine du pair en suivant les noms de path et renvoie le hash et la valeur
+// du noeud atteint, s doit être verrouillée
+func (g *gateway) resolve(s *peerSession, path []string) ([]byte, []byte, error) {
+	hash, err := rootRequest(s.conn, ourRoot(), g.privK, g.bobK)
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := g.datum(s, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range path {
+		if name == "" {
+			continue
+		}
+		entries, err := parseDirectory(value)
+		if err != nil {
+			return nil, nil, errNoDatum
+		}
+		var next []byte
+		for _, e := range entries {
+			if e.Name == name {
+				next = e.Hash
+			}
+		}
+		if next == nil {
+			return nil, nil, errNoDatum
+		}
+		hash = next
+		value, err = g.datum(s, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return hash, value, nil
+}
+
+// lookup ouvre la session avec peer, la verrouille et résout path ; en cas d'erreur la réponse HTTP
+// est déjà écrite et la session n'est pas verrouillée
+func (g *gateway) lookup(w http.ResponseWriter, r *http.Request, peer string, path []string) (*peerSession, []byte, []byte, bool) {
+	s, err := g.session(peer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, nil, nil, false
+	}
+	s.mu.Lock()
+	hash, value, err := g.resolve(s, path)
+	if errors.Is(err, errNoDatum) {
+		s.mu.Unlock()
+		http.NotFound(w, r)
+		return nil, nil, nil, false
+	}
+	if err != nil {
+		s.mu.Unlock()
+		g.drop(s)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, nil, nil, false
+	}
+	return s, hash, value, true
+}
+
+func (g *gateway) servePeerPath(w http.ResponseWriter, r *http.Request, peer string, path []string) {
+	s, hash, value, ok := g.lookup(w, r, peer, path)
+	if !ok {
+		return
+	}
+	defer s.mu.Unlock()
+
+	w.Header().Set("ETag", etag(hash))
+	if value[0] == directoryType {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		g.listDirectory(w, r, s, value)
+		return
+	}
+	g.serveFile(w, r, s, path, hash)
+}
+
+// serveFile envoie le contenu d'un File ou BigFile, s doit être verrouillée ; seuls les chunks
+// de la plage demandée (Range) sont récupérés
+func (g *gateway) serveFile(w http.ResponseWriter, r *http.Request, s *peerSession, path []string, hash []byte) {
+	fr := g.reader(s)
+	size, err := fr.Size(hash)
+	if err != nil {
+		g.drop(s)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	name := ""
+	if len(path) > 0 {
+		name = path[len(path)-1]
+	}
+	//ServeContent gère Content-Length, Range et If-None-Match à partir de l'ETag
+	http.ServeContent(w, r, name, time.Time{}, &fileSeeker{fr: fr, root: hash, size: size})
+}
+
+func etag(hash []byte) string {
+	return "\"" + hex.EncodeToString(hash) + "\""
+}
+
+// children renvoie les entrées valides d'un répertoire et la valeur de chacune, s doit être verrouillée
+func (g *gateway) children(s *peerSession, value []byte) ([]dirEntry, map[string][]byte, error) {
+	entries, err := parseDirectory(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, _ = filterEntries(entries)
+	hashes := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		hashes = append(hashes, e.Hash)
+	}
+	values, err := g.fetch(s, hashes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, values, nil
+}
+
+// listDirectory affiche les entrées d'un répertoire avec leur type, s doit être verrouillée
+func (g *gateway) listDirectory(w http.ResponseWriter, r *http.Request, s *peerSession, value []byte) {
+	if r.Header.Get("If-None-Match") == w.Header().Get("ETag") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	entries, values, err := g.children(s, value)
+	if err != nil {
+		g.drop(s)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><body><h1>%v</h1><ul>\n", html.EscapeString(r.URL.Path))
+	fmt.Fprintf(w, "<li><a href=\"../\">..</a></li>\n")
+	for _, e := range entries {
+		kind, suffix := "file", ""
+		switch values[string(e.Hash)][0] {
+		case directoryType:
+			kind, suffix = "dir", "/"
+		case bigFileType:
+			kind = "bigfile"
+		}
+		fmt.Fprintf(w, "<li><a href=\"%v%v\">%v%v</a> (%v)</li>\n", url.PathEscape(e.Name), suffix, html.EscapeString(e.Name), suffix, kind)
+	}
+	fmt.Fprintf(w, "</ul></body></html>\n")
+}
+
+// datumCache garde en mémoire les noeuds déjà récupérés par la passerelle, indexés par hash :
+// un hash désigne toujours le même contenu, quel que soit le pair, il n'y a donc rien à invalider
+type datumCache struct {
+	mu    sync.Mutex
+	limit int
+	size  int
+	order *list.List               //les plus récemment utilisés en tête
+	byKey map[string]*list.Element //clé : string(hash)
+}
+
+type cachedDatum struct {
+	key   string
+	value []byte
+}
+
+func newDatumCache(limit int) *datumCache {
+	return &datumCache{limit: limit, order: list.New(), byKey: make(map[string]*list.Element)}
+}
+
+func (c *datumCache) get(hash []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byKey[string(hash)]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*cachedDatum).value, true
+	}
+	if value, _, ok := datums.get(hash); ok { //déjà dans le stockage sur disque
+		return value, true
+	}
+	return nil, false
+}
+
+func (c *datumCache) put(hash []byte, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byKey[string(hash)]; ok || len(value) > c.limit {
+		return
+	}
+	c.byKey[string(hash)] = c.order.PushFront(&cachedDatum{string(hash), value})
+	c.size += len(value)
+	for c.size > c.limit {
+		last := c.order.Back()
+		d := c.order.Remove(last).(*cachedDatum)
+		delete(c.byKey, d.key)
+		c.size -= len(d.value)
+	}
+}
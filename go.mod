@@ -1,6 +1,6 @@
 module client.go
 
-go 1.17
+go 1.21
 
 require github.com/paberthet/tp_chroboczek/projetcrypto v1.2.3
 
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Arbres de référence : chaque dossier de testdata/golden est exporté et téléchargé, et les deux côtés doivent
+// produire exactement les Datum enregistrés dans <dossier>.golden (hash racine puis un Datum par ligne).
+// go test -run Golden -update régénère les dossiers et les fichiers .golden après un changement volontaire
+// de l'encodage.
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden fixture trees and their expected datums")
+
+// goldenFixtures donne pour chaque arbre ses fichiers et leur taille
+var goldenFixtures = map[string]map[string]int{
+	"empty-file":  {"empty": 0},
+	"exact-chunk": {"exact.bin": chunkSize},
+	"33-chunks":   {"big.bin": 33 * chunkSize}, //un BigFile de 32 chunks et un chunk remonté à côté
+	"nested": {
+		"readme.txt":      300,
+		"a/top.txt":       chunkSize + 1,
+		"a/b/side.txt":    10,
+		"a/b/c/leaf.txt":  2 * chunkSize,
+		"a/b/c/d/deepest": 1,
+	},
+	"max-entries": maxEntriesFixture(),
+}
+
+func maxEntriesFixture() map[string]int {
+	files := make(map[string]int, maxDirEntries)
+	for i := 0; i < maxDirEntries; i++ {
+		files[fmt.Sprintf("f%02d", i)] = 50 * i
+	}
+	return files
+}
+
+// goldenContent est le contenu du fichier name : des lignes numérotées, pour que chaque chunk soit différent
+func goldenContent(name string, size int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "%s %06d\n", name, i)
+	}
+	return b.Bytes()[:size]
+}
+
+type goldenTree struct {
+	root   []byte
+	values map[string][]byte //hash -> valeur
+	order  [][]byte          //hash dans l'ordre du fichier
+}
+
+// writeGolden enregistre tree : la racine puis chaque noeud en profondeur d'abord
+func writeGolden(file string, tree *MerkleNode) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "root %x\n", tree.Hash)
+	var walk func(n *MerkleNode)
+	walk = func(n *MerkleNode) {
+		fmt.Fprintf(&b, "datum %x %x\n", n.Hash, n.Value)
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(tree)
+	return os.WriteFile(file, b.Bytes(), 0644)
+}
+
+func readGolden(t *testing.T, file string) goldenTree {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g := goldenTree{values: make(map[string][]byte)}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 4*chunkSize)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		switch {
+		case len(fields) == 2 && fields[0] == "root":
+			g.root, err = hex.DecodeString(fields[1])
+		case len(fields) == 3 && fields[0] == "datum":
+			var hash, value []byte
+			hash, err = hex.DecodeString(fields[1])
+			if err == nil {
+				value, err = hex.DecodeString(fields[2])
+			}
+			if _, seen := g.values[string(hash)]; !seen {
+				g.order = append(g.order, hash)
+			}
+			g.values[string(hash)] = value
+		default:
+			t.Fatalf("%v: bad line %q", file, sc.Text())
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", file, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if g.root == nil || g.values[string(g.root)] == nil {
+		t.Fatalf("%v: no root datum", file)
+	}
+	return g
+}
+
+// goldenDir renvoie le dossier de l'arbre name, réécrit d'abord avec -update
+func goldenDir(t *testing.T, name string) string {
+	t.Helper()
+	dir := filepath.Join("testdata", "golden", name)
+	if !*updateGolden {
+		return dir
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	for file, size := range goldenFixtures[name] {
+		p := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, goldenContent(file, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree, err := BuildMerkleTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeGolden(dir+".golden", tree); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func goldenNames() []string {
+	names := make([]string, 0, len(goldenFixtures))
+	for name := range goldenFixtures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestGoldenExporter(t *testing.T) {
+	for _, name := range goldenNames() {
+		t.Run(name, func(t *testing.T) {
+			dir := goldenDir(t, name)
+			want := readGolden(t, dir+".golden")
+
+			ex := newExporter()
+			if err := ex.AddExport(exportSpec{Name: name, Dir: dir}); err != nil {
+				t.Fatal(err)
+			}
+			exported := ex.trees[name]
+			if !bytes.Equal(exported.tree.Hash, want.root) {
+				t.Fatalf("root %x, want %x", exported.tree.Hash, want.root)
+			}
+			if len(exported.index) != len(want.values) {
+				t.Fatalf("%d datums exported, want %d", len(exported.index), len(want.values))
+			}
+			for _, hash := range want.order {
+				value, ok := ex.get(hash)
+				if !ok {
+					t.Fatalf("datum %x is not exported", hash)
+				}
+				if !bytes.Equal(value, want.values[string(hash)]) {
+					t.Fatalf("datum %x is\n%x\nwant\n%x", hash, value, want.values[string(hash)])
+				}
+			}
+			//l'export est la seule entrée du répertoire annoncé dans RootReply
+			entries, err := parseDirectory(ex.root.Value)
+			if err != nil || len(entries) != 1 || entries[0].Name != name || !bytes.Equal(entries[0].Hash, want.root) {
+				t.Fatalf("exported root directory %x (%v)", ex.root.Value, err)
+			}
+		})
+	}
+}
+
+func TestGoldenDownload(t *testing.T) {
+	quietLog(t)
+	for _, name := range goldenNames() {
+		t.Run(name, func(t *testing.T) {
+			dir := goldenDir(t, name)
+			want := readGolden(t, dir+".golden")
+
+			//le pair ne sert que les Datum enregistrés, pas ceux recalculés à partir des fichiers
+			sn := newSimNet(43)
+			peer := &simPeer{root: want.root, values: want.values}
+			peerAddr := sn.Node("192.0.2.10", nil).Listen(8443, peer.handle)
+			client := sn.Node("198.51.100.7", nil)
+			defer useSimNet(sn, client)()
+			*maxAttempts = 30
+
+			out := filepath.Join(t.TempDir(), "root")
+			if got := simDownload(t, sn, client, peerAddr.String(), out); !bytes.Equal(got, want.root) {
+				t.Fatalf("downloaded tree %x, want %x", got, want.root)
+			}
+			for file := range goldenFixtures[name] {
+				got, err := os.ReadFile(filepath.Join(out, filepath.FromSlash(file)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				expected, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, expected) {
+					t.Fatalf("%v differs from the fixture (%d bytes, want %d)", file, len(got), len(expected))
+				}
+			}
+			if peer.Requests < len(want.values) {
+				t.Fatalf("%d GetDatum for %d datums", peer.Requests, len(want.values))
+			}
+		})
+	}
+}
+
+// goldenAnchors sont des hash calculés hors du dépôt (python hashlib : sha256(0x00 || chunk) pour un chunk,
+// sha256(0x01 || hash1 || hash2) pour le BigFile), pour que -update ne puisse pas valider un encodage faux
+var goldenAnchors = []struct {
+	fixture, file string
+	hash          string
+}{
+	{"exact-chunk", "exact.bin", "d295e85e869684a81c41d3f01e7057d7479f4c31fe336f757719f52a69542320"},
+	{"nested", "a/b/c/leaf.txt", "194d178e297d4b54d81303ee09f1fa9575ac0c52471e1dfe907c1663367809e6"},
+}
+
+func TestGoldenAnchors(t *testing.T) {
+	for _, a := range goldenAnchors {
+		want, _ := hex.DecodeString(a.hash)
+		n := BuildFileTree("", a.file, goldenContent(a.file, goldenFixtures[a.fixture][a.file]))
+		if !bytes.Equal(n.Hash, want) {
+			t.Fatalf("%v: hash %x, want %x", a.file, n.Hash, want)
+		}
+		//le fichier .golden doit contenir le même noeud
+		g := readGolden(t, goldenDir(t, a.fixture)+".golden")
+		if !bytes.Equal(g.values[string(want)], n.Value) {
+			t.Fatalf("%v: %v.golden does not contain the anchored datum", a.file, a.fixture)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//===================================================================================================
+//                                LIMITES DES REQUETES RECUES
+//===================================================================================================
+
+// Un pair ne doit pas pouvoir nous saturer. Chaque datagramme reçu passe par admitDatagram avant d'être traité ;
+// pour chaque adresse source (l'IP, quel que soit le port) :
+//   - un seau à jetons limite le nombre de messages acceptés par seconde (-limit-messages, -limit-messages-burst) ;
+//     les réponses (type >= 128) des pairs que l'on a contactés n'y sont pas comptées : leur débit est celui de
+//     nos propres requêtes ;
+//   - un autre limite les octets de Datum qu'on lui sert par seconde (-limit-datum-bytes) ;
+//   - les datagrammes mal formés et les signatures invalides sont comptés : au-delà de -ban-threshold sur
+//     -ban-window, l'adresse est ignorée pendant -ban-duration.
+// Les octets servis à l'ensemble des pairs sont limités par -limit-bandwidth. Un datagramme refusé est ignoré
+// sans réponse ; 0 désactive une limite.
+//
+// Il n'y a pas de plafond de sessions : toutes nos sockets sont connectées (dialTransport), le noyau jette donc
+// les datagrammes des adresses que l'on n'a pas contactées, et chaque session est un pair que l'on a choisi de
+// contacter. Plafonner ces sessions ne ferait qu'interrompre la passerelle ou la découverte du swarm.
+//
+// Anti-amplification : un GetDatum de 39 octets peut appeler un Datum de plus de 1 Kio, et l'adresse source d'un
+// datagramme UDP se falsifie. Comme QUIC pour un chemin non validé, tant qu'une adresse n'a pas répondu par un
+// HelloReply à l'un de nos Hello (ce qui prouve qu'elle reçoit ce qu'on lui envoie), on ne lui répond pas plus de
+// -amplification-factor fois les octets reçus d'elle (sans compter la signature du HelloReply à un Hello, qui reprend
+// le corps reçu, voir answerHello).
+
+var limitMessages = flag.Float64("limit-messages", 50, "requests accepted per second from one address (0: no limit)")
+var limitMessagesBurst = flag.Int("limit-messages-burst", 100, "requests accepted at once from one address before -limit-messages applies")
+var limitDatumBytes = flag.Int("limit-datum-bytes", 256<<10, "datum bytes served per second to one address (0: no limit)")
+var limitBandwidth = flag.Int("limit-bandwidth", 4<<20, "datum bytes served per second to all peers together (0: no limit)")
+var banThreshold = flag.Int("ban-threshold", 10, "malformed packets or bad signatures from one address before it is banned (0: never ban)")
+var banWindow = flag.Duration("ban-window", time.Minute, "period over which -ban-threshold is counted")
+var banDuration = flag.Duration("ban-duration", 10*time.Minute, "how long a banned address is ignored")
+var amplificationFactor = flag.Int("amplification-factor", 3, "bytes sent to an address not yet validated by a HelloReply, per byte received from it (0: no limit)")
+
+// maxServedValue est la plus grande valeur de Datum (directory de 16 entrées) : un seau d'octets en contient au moins une
+const maxServedValue = 1 + 16*64
+
+// tokenBucket se remplit de rate jetons par seconde, jusqu'à burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take retire n jetons s'il y en a assez
+func (b *tokenBucket) take(now time.Time, rate, burst, n float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = min(burst, b.tokens+elapsed*rate)
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// sourceState est ce que l'on sait d'une adresse source
+type sourceState struct {
+	messages    tokenBucket
+	bytes       tokenBucket
+	strikes     int       //datagrammes mal formés ou mal signés depuis strikesFrom
+	strikesFrom time.Time //début de la période de -ban-window
+	bannedUntil time.Time
+	lastSeen    time.Time
+	validated   bool //l'adresse a répondu par un HelloReply à l'un de nos Hello
+	received    int  //octets reçus de l'adresse avant sa validation
+	sent        int  //octets de réponse envoyés à l'adresse avant sa validation
+}
+
+var inbound = struct {
+	sync.Mutex
+	sources   map[string]*sourceState
+	bandwidth tokenBucket
+	dialed    map[string]int //adresses des sessions ouvertes par dialTransport, avec leur nombre
+}{sources: make(map[string]*sourceState), dialed: make(map[string]int)}
+
+// maxSources est le nombre d'adresses suivies au-delà duquel on oublie celles qui se sont tues
+const maxSources = 4096
+
+// sourceKey renvoie l'IP de addr : changer de port ne contourne pas les limites
+func sourceKey(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return u.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// source renvoie l'état de l'adresse de addr, inbound doit être verrouillé
+func source(addr net.Addr, now time.Time) *sourceState {
+	key := sourceKey(addr)
+	s, ok := inbound.sources[key]
+	if !ok {
+		if len(inbound.sources) >= maxSources {
+			forgetIdleSources(now)
+		}
+		s = &sourceState{}
+		inbound.sources[key] = s
+	}
+	s.lastSeen = now
+	return s
+}
+
+// forgetIdleSources oublie les adresses silencieuses depuis -ban-window et qui ne sont pas bannies
+func forgetIdleSources(now time.Time) {
+	for key, s := range inbound.sources {
+		if now.Sub(s.lastSeen) > *banWindow && now.After(s.bannedUntil) {
+			delete(inbound.sources, key)
+		}
+	}
+}
+
+// admitDatagram dit si l'on traite packet, reçu de addr : l'adresse n'est pas bannie et n'a pas dépassé
+// -limit-messages. Les octets acceptés comptent pour l'anti-amplification.
+func admitDatagram(addr net.Addr, packet []byte) bool {
+	if addr == nil {
+		return true
+	}
+	inbound.Lock()
+	defer inbound.Unlock()
+	now := clock.Now()
+	dialed := inbound.dialed[sourceKey(addr)] > 0
+	s := source(addr, now)
+	if now.Before(s.bannedUntil) {
+		metrics.limited.inc("banned")
+		return false
+	}
+	reply := len(packet) >= 5 && packet[4] >= 128
+	if *limitMessages > 0 && !(dialed && reply) && !s.messages.take(now, *limitMessages, float64(max(*limitMessagesBurst, 1)), 1) {
+		metrics.limited.inc("messages")
+		slog.Debug("Datagram dropped, too many messages", peerAttr(addr))
+		return false
+	}
+	if !s.validated {
+		s.received += len(packet)
+	}
+	return true
+}
+
+// admitDatum dit si l'on peut envoyer n octets de Datum à addr, selon -limit-datum-bytes et -limit-bandwidth
+func admitDatum(addr net.Addr, n int) bool {
+	inbound.Lock()
+	defer inbound.Unlock()
+	now := clock.Now()
+	s := source(addr, now)
+	if *limitDatumBytes > 0 {
+		rate := float64(*limitDatumBytes)
+		if !s.bytes.take(now, rate, max(rate, maxServedValue), float64(n)) {
+			metrics.limited.inc("datum_bytes")
+			slog.Debug("Datum dropped, byte budget of the address exceeded", peerAttr(addr), "bytes", n)
+			return false
+		}
+	}
+	if *limitBandwidth > 0 {
+		rate := float64(*limitBandwidth)
+		if !inbound.bandwidth.take(now, rate, max(rate, maxServedValue), float64(n)) {
+			metrics.limited.inc("bandwidth")
+			slog.Debug("Datum dropped, bandwidth cap reached", peerAttr(addr), "bytes", n)
+			return false
+		}
+	}
+	return true
+}
+
+// strike compte un datagramme mal formé ou mal signé venu de addr, et bannit l'adresse au-delà de -ban-threshold
+func strike(addr net.Addr, reason error) {
+	if addr == nil || *banThreshold <= 0 {
+		return
+	}
+	inbound.Lock()
+	defer inbound.Unlock()
+	now := clock.Now()
+	s := source(addr, now)
+	if now.Sub(s.strikesFrom) > *banWindow {
+		s.strikes, s.strikesFrom = 0, now
+	}
+	s.strikes++
+	if s.strikes >= *banThreshold && !now.Before(s.bannedUntil) {
+		s.bannedUntil = now.Add(*banDuration)
+		s.strikes = 0
+		metrics.bans.inc("")
+		slog.Warn("Address banned", peerAttr(addr), "for", *banDuration, "last", reason)
+	}
+}
+
+//===================================================================================================
+// anti-amplification
+
+// validateSource note que addr a répondu à l'un de nos Hello : elle n'est plus soumise à -amplification-factor
+func validateSource(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	inbound.Lock()
+	defer inbound.Unlock()
+	s := source(addr, clock.Now())
+	if !s.validated {
+		slog.Debug("Address validated", peerAttr(addr))
+	}
+	s.validated = true
+}
+
+// admitReply dit si l'on peut envoyer une réponse de n octets à addr sans dépasser -amplification-factor
+// fois ce qu'elle nous a envoyé, tant qu'elle n'est pas validée
+func admitReply(addr net.Addr, n int) bool {
+	if *amplificationFactor <= 0 {
+		return true
+	}
+	inbound.Lock()
+	defer inbound.Unlock()
+	s := source(addr, clock.Now())
+	if s.validated {
+		return true
+	}
+	if s.sent+n > *amplificationFactor*s.received {
+		metrics.limited.inc("amplification")
+		slog.Debug("Reply dropped, address not validated", peerAttr(addr), "bytes", n, "received", s.received, "sent", s.sent)
+		return false
+	}
+	s.sent += n
+	return true
+}
+
+//===================================================================================================
+// pairs contactés
+
+// dialedTransport est une session ouverte par dialTransport : les réponses de son adresse ne prennent pas de
+// jeton, jusqu'à la fermeture
+type dialedTransport struct {
+	Transport
+	key    string
+	closed int32
+}
+
+func (d *dialedTransport) Close() error {
+	if atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		inbound.Lock()
+		if inbound.dialed[d.key]--; inbound.dialed[d.key] <= 0 {
+			delete(inbound.dialed, d.key)
+		}
+		inbound.Unlock()
+	}
+	return d.Transport.Close()
+}
+
+// initLimits note les adresses des sessions que l'on ouvre avec dialTransport
+func initLimits() {
+	dial := dialTransport
+	dialTransport = func(addr string) (Transport, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		key := sourceKey(conn.RemoteAddr())
+		inbound.Lock()
+		inbound.dialed[key]++
+		inbound.Unlock()
+		return &dialedTransport{Transport: conn, key: key}, nil
+	}
+}
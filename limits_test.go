@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// stepClock est une horloge que le test avance à la main
+type stepClock struct {
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time        { return c.now }
+func (c *stepClock) Sleep(d time.Duration) { c.now = c.now.Add(d) }
+
+// sinkConn compte les datagrammes envoyés à un pair, garde le dernier, et lui fait recevoir ceux de replies
+type sinkConn struct {
+	addr    net.Addr
+	sent    int
+	last    []byte
+	replies [][]byte
+}
+
+func (c *sinkConn) Write(b []byte) (int, error) {
+	c.sent++
+	c.last = append([]byte(nil), b...)
+	return len(b), nil
+}
+func (c *sinkConn) Read(b []byte) (int, error) {
+	if len(c.replies) == 0 {
+		return 0, errors.New("sinkConn: nothing to read")
+	}
+	n := copy(b, c.replies[0])
+	c.replies = c.replies[1:]
+	return n, nil
+}
+func (c *sinkConn) SetReadDeadline(t time.Time) error { return nil }
+func (c *sinkConn) RemoteAddr() net.Addr              { return c.addr }
+func (c *sinkConn) Close() error                      { return nil }
+
+func newSinkConn(addr string) *sinkConn {
+	return &sinkConn{addr: net.UDPAddrFromAddrPort(netip.MustParseAddrPort(addr))}
+}
+
+// useLimits fixe les limites et l'horloge jusqu'à la fin du test ; 0 désactive une limite
+func useLimits(t *testing.T, messages float64, burst, datumBytes, bandwidth, ban int) *stepClock {
+	saved := []interface{}{*limitMessages, *limitMessagesBurst, *limitDatumBytes, *limitBandwidth, *banThreshold, clock, *amplificationFactor}
+	*limitMessages, *limitMessagesBurst, *limitDatumBytes, *limitBandwidth, *banThreshold = messages, burst, datumBytes, bandwidth, ban
+	*amplificationFactor = 0
+	clk := &stepClock{time.Unix(1700000000, 0)}
+	clock = clk
+	inbound.Lock()
+	inbound.sources = make(map[string]*sourceState)
+	inbound.bandwidth = tokenBucket{}
+	inbound.Unlock()
+	t.Cleanup(func() {
+		*limitMessages, *limitMessagesBurst, *limitDatumBytes = saved[0].(float64), saved[1].(int), saved[2].(int)
+		*limitBandwidth, *banThreshold, clock = saved[3].(int), saved[4].(int), saved[5].(Clock)
+		*amplificationFactor = saved[6].(int)
+	})
+	return clk
+}
+
+// deliver traite packet comme s'il venait d'être lu sur conn
+func deliver(conn *sinkConn, packet []byte) {
+	if admitDatagram(conn.addr, packet) {
+		serveRequest(conn, packet)
+	}
+}
+
+func getDatumPacket(hash []byte) []byte {
+	return MessageToBytes(NewMessage(newID(), []byte{3}, hash, nil))
+}
+
+// useTestExport exporte un petit arbre jusqu'à la fin du test et renvoie son hash racine
+func useTestExport(t *testing.T) []byte {
+	src := t.TempDir()
+	writeTestTree(t, src, 7)
+	saved := exports
+	exports = newExporter()
+	t.Cleanup(func() { exports = saved })
+	if err := exports.AddExport(exportSpec{Name: "t", Dir: src}); err != nil {
+		t.Fatal(err)
+	}
+	return exports.RootHash()
+}
+
+func TestRequestLimits(t *testing.T) {
+	quietLog(t)
+	root := useTestExport(t)
+	value, _ := exports.get(root)
+	flood := func(conn *sinkConn, n int) int {
+		before := conn.sent
+		for i := 0; i < n; i++ {
+			deliver(conn, getDatumPacket(root))
+		}
+		return conn.sent - before
+	}
+
+	//requêtes par adresse : le port ne compte pas
+	clk := useLimits(t, 10, 5, 0, 0, 0)
+	a, samePeer, other := newSinkConn("192.0.2.1:1000"), newSinkConn("192.0.2.1:2000"), newSinkConn("192.0.2.2:1000")
+	if n := flood(a, 20); n != 5 {
+		t.Fatalf("%d replies to a burst of 20, want 5", n)
+	}
+	if n := flood(samePeer, 1); n != 0 {
+		t.Fatalf("another port of the same address was answered")
+	}
+	if n := flood(other, 1); n != 1 {
+		t.Fatalf("another address was not answered")
+	}
+	clk.Sleep(200 * time.Millisecond)
+	if n := flood(a, 20); n != 2 {
+		t.Fatalf("%d replies after 200ms at 10/s, want 2", n)
+	}
+
+	//octets servis à une adresse, puis à toutes
+	useLimits(t, 0, 0, 2000, 0, 0)
+	if n := flood(newSinkConn("192.0.2.1:1000"), 100); n != 2000/len(value) {
+		t.Fatalf("%d datums of %d bytes served with a budget of 2000 bytes", n, len(value))
+	}
+	useLimits(t, 0, 0, 0, 3000, 0)
+	total := 0
+	for _, addr := range []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.3:1", "192.0.2.4:1"} {
+		total += flood(newSinkConn(addr), 100)
+	}
+	if total != 3000/len(value) {
+		t.Fatalf("%d datums of %d bytes served with a bandwidth of 3000 bytes", total, len(value))
+	}
+
+	//bannissement après des datagrammes mal formés ou mal signés
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk = useLimits(t, 0, 0, 0, 0, 3)
+	bans := metrics.bans.get("")
+	bad := newSinkConn("192.0.2.9:1000")
+	deliver(bad, MessageToBytes(NewMessage(newID(), []byte{3}, []byte("short"), nil)))
+	messageFrom(bad.addr, []byte{1, 2, 3}, nil)
+	if n := flood(bad, 1); n != 1 {
+		t.Fatalf("address banned too early")
+	}
+	messageFrom(bad.addr, append(getDatumPacket(root), make([]byte, 64)...), &key.PublicKey)
+	if n := flood(bad, 1); n != 0 || metrics.bans.get("") != bans+1 {
+		t.Fatalf("address not banned after 3 bad packets")
+	}
+	clk.Sleep(*banDuration)
+	if n := flood(bad, 1); n != 1 {
+		t.Fatalf("address still banned after -ban-duration")
+	}
+}
+
+func TestDialedPeers(t *testing.T) {
+	quietLog(t)
+	useLimits(t, 1, 1, 0, 0, 0)
+	savedDial := dialTransport
+	defer func() { dialTransport = savedDial }()
+	dialTransport = func(addr string) (Transport, error) { return newSinkConn(addr), nil }
+	initLimits()
+	hello := MessageToBytes(NewMessage(newID(), []byte{0}, []byte("\x00\x00\x00\x00test"), nil))
+	admitted := func(addr string, packet []byte) bool {
+		return admitDatagram(newSinkConn(addr).addr, packet)
+	}
+
+	//les réponses d'un pair que l'on a contacté ne prennent pas de jeton
+	conn, err := dialTransport("192.0.2.4:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	datum := MessageToBytes(NewMessage(newID(), []byte{131}, make([]byte, 33), nil))
+	for i := 0; i < 5; i++ {
+		if !admitted("192.0.2.4:2", datum) {
+			t.Fatalf("reply %d of a contacted peer dropped", i)
+		}
+	}
+	if !admitted("192.0.2.4:2", hello) || admitted("192.0.2.4:2", hello) {
+		t.Fatalf("requests of a contacted peer not limited by -limit-messages")
+	}
+	conn.Close()
+	conn.Close() //une seule fermeture comptée
+	if admitted("192.0.2.4:2", datum) {
+		t.Fatalf("closed session still exempt")
+	}
+}
+
+func TestAmplification(t *testing.T) {
+	quietLog(t)
+	root := useTestExport(t)
+	value, _ := exports.get(root)
+	tree := value[1+32 : 1+64] //le dossier exporté, plus gros que la racine
+	if value, _ := exports.get(tree); 7+32+len(value) <= 3*(7+32) {
+		t.Fatalf("datum of %d bytes too small for the test", len(value))
+	}
+	useLimits(t, 0, 0, 0, 0, 0)
+	*amplificationFactor = 3
+	request := func(conn *sinkConn, hash []byte) bool {
+		packet := getDatumPacket(hash)
+		before := conn.sent
+		deliver(conn, packet)
+		return conn.sent > before
+	}
+
+	//une adresse non validée reçoit des NoDatum (39 octets pour 39 reçus), pas de Datum plus gros que 3 fois la requête
+	spoofed := newSinkConn("192.0.2.1:1000")
+	if request(spoofed, tree) {
+		t.Fatalf("datum sent to an address not validated")
+	}
+	if !request(spoofed, make([]byte, 32)) {
+		t.Fatalf("NoDatum not sent to an address not validated")
+	}
+	limited := metrics.limited.get("amplification")
+	for i := 0; i < 10; i++ {
+		if !request(spoofed, tree) {
+			break
+		}
+	}
+	if metrics.limited.get("amplification") == limited {
+		t.Fatalf("amplification limit never reached")
+	}
+
+	//un HelloReply à notre Hello valide l'adresse
+	peer := newSinkConn("192.0.2.2:1000")
+	hello := NewMessage(newID(), []byte{0}, []byte("\x00\x00\x00\x00test"), nil)
+	reply := NewMessage(hello.Id, []byte{128}, hello.Body, nil)
+	peer.replies = [][]byte{MessageToBytes(reply)}
+	if mess := MessageListener(peer, hello, true, nil); mess.Type[0] != 128 {
+		t.Fatalf("HelloReply not received: %v", mess)
+	}
+	for i := 0; i < 10; i++ {
+		if !request(peer, tree) {
+			t.Fatalf("datum %d not sent to a validated address", i)
+		}
+	}
+
+	//un Hello non signé avec un nom court reçoit quand même un HelloReply signé, 64 octets plus long
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short := newSinkConn("192.0.2.4:1000")
+	packet := MessageToBytes(NewMessage(newID(), []byte{0}, []byte("\x00\x00\x00\x00ab"), nil))
+	if !admitDatagram(short.addr, packet) {
+		t.Fatalf("Hello dropped")
+	}
+	answerHello(short, BytesToMessage(packet, nil), key)
+	if short.sent != 1 || len(short.last) != len(packet)+64 || short.last[4] != 128 {
+		t.Fatalf("no signed HelloReply to a short Hello: %d sent, last %x", short.sent, short.last)
+	}
+	if _, err := parseMessage(short.last, &key.PublicKey); err != nil {
+		t.Fatalf("HelloReply: %v", err)
+	}
+
+	//un HelloReply avec un autre Id ne valide rien
+	other := newSinkConn("192.0.2.3:1000")
+	other.replies = [][]byte{MessageToBytes(NewMessage(newID(), []byte{128}, hello.Body, nil))}
+	MessageListener(other, hello, false, nil)
+	if request(other, tree) {
+		t.Fatalf("datum sent after a HelloReply with the wrong Id")
+	}
+}
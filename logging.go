@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+)
+
+//===================================================================================================
+//                                JOURNAL
+//===================================================================================================
+
+// Le journal passe par log/slog : chaque ligne a un niveau et des champs (peer, msg_id, type, hash...) qu'on
+// peut filtrer. -log-level choisit le niveau minimal, -log-format json donne une ligne JSON par événement.
+// Les sorties destinées à l'utilisateur (menus, résultats des commandes) restent sur la sortie standard.
+
+var logLevel = flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error")
+var logFormat = flag.String("log-format", "text", "format of log messages: text or json")
+
+// logOutput reçoit le journal : la sortie d'erreur, ou la dernière ligne de l'écran avec -tui. Après
+// slog.SetDefault, log.Writer() renvoie vers slog : le handler ne peut donc pas écrire sur la sortie de log.
+var logOutput = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stderr}
+
+type logSink struct{}
+
+func (logSink) Write(p []byte) (int, error) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	return logOutput.w.Write(p)
+}
+
+func setLogOutput(w io.Writer) {
+	logOutput.Lock()
+	logOutput.w = w
+	logOutput.Unlock()
+}
+
+// initLogging installe le journal choisi par -log-level et -log-format
+func initLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("bad -log-level %q: want debug, info, warn or error", *logLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch *logFormat {
+	case "text":
+		h = slog.NewTextHandler(logSink{}, opts)
+	case "json":
+		h = slog.NewJSONHandler(logSink{}, opts)
+	default:
+		return fmt.Errorf("bad -log-format %q: want text or json", *logFormat)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+//===================================================================================================
+// champs communs
+
+func peerAttr(addr net.Addr) slog.Attr {
+	if addr == nil {
+		return slog.String("peer", "")
+	}
+	return slog.String("peer", addr.String())
+}
+
+func hashAttr(hash []byte) slog.Attr {
+	return slog.String("hash", hex.EncodeToString(hash))
+}
+
+func idAttr(id []byte) slog.Attr {
+	return slog.String("msg_id", hex.EncodeToString(id))
+}
+
+func typeAttr(typ byte) slog.Attr {
+	return slog.String("type", messageTypeName(typ))
+}
+
+// datagramAttrs donne l'Id et le type d'un datagramme, s'il est assez long pour les contenir
+func datagramAttrs(data []byte) []any {
+	if len(data) < 5 {
+		return []any{slog.Int("len", len(data))}
+	}
+	return []any{idAttr(data[:4]), typeAttr(data[4]), slog.Int("len", len(data))}
+}
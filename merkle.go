@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+)
+
+//===================================================================================================
+//									Merkle s tree (encodage réseau)
+//===================================================================================================
+
+// Même arbre que merkle_test/merkle.go, mais avec exactement l'encodage des Datum échangés sur le réseau :
+// la valeur d'un noeud commence par un octet de type, le hash d'un noeud est le sha256 de sa valeur,
+// les noms des entrées de répertoire sont complétés par des 0 jusqu'à 32 octets.
+
+const (
+	chunkType     = byte(0)
+	bigFileType   = byte(1)
+	directoryType = byte(2)
+
+	chunkSize     = 1024 //taille max des données d'un chunk (en octets)
+	bigFileArity  = 32   //nombre max de fils d'un BigFile
+	maxDirEntries = 16   //nombre max d'entrées dans un directory
+	nameSize      = 32   //taille d'un nom dans un directory
+)
+
+type MerkleNode struct {
+	Name     string
+	Path     string //chemin relatif à la racine de l'arbre ("." pour la racine)
+	Hash     []byte
+	Value    []byte //octet de type + contenu, tel que transmis dans un Datum après le hash
+	Children []*MerkleNode
+}
+
+func (n *MerkleNode) Type() byte {
+	return n.Value[0]
+}
+
+func newMerkleNode(name string, path string, value []byte, children []*MerkleNode) *MerkleNode {
+	hash := sha256.Sum256(value)
+	return &MerkleNode{name, path, hash[:], value, children}
+}
+
+// padName complète un nom par des 0 pour qu'il fasse nameSize octets
+func padName(name string) ([]byte, error) {
+	if len(name) > nameSize {
+		return nil, fmt.Errorf("name %q is longer than %d bytes", name, nameSize)
+	}
+	padded := make([]byte, nameSize)
+	copy(padded, name)
+	return padded, nil
+}
+
+// unpadName retire les 0 de fin d'un nom reçu dans un directory
+func unpadName(name []byte) string {
+	return string(bytes.TrimRight(name, "\x00"))
+}
+
+// BuildFileTree découpe data en chunks et les regroupe par bigFileArity jusqu'à n'avoir plus qu'un noeud.
+// Un fichier d'au plus chunkSize octets est un simple chunk.
+// Un noeud resté seul à un niveau est remonté tel quel au niveau supérieur (un BigFile a au moins 2 fils).
+func BuildFileTree(name string, path string, data []byte) *MerkleNode {
+	level := make([]*MerkleNode, 0, len(data)/chunkSize+1)
+	for len(data) > chunkSize {
+		level = append(level, newMerkleNode("", path, append([]byte{chunkType}, data[:chunkSize]...), nil))
+		data = data[chunkSize:]
+	}
+	level = append(level, newMerkleNode("", path, append([]byte{chunkType}, data...), nil))
+
+	for len(level) > 1 {
+		next := make([]*MerkleNode, 0, len(level)/bigFileArity+1)
+		for len(level) > 0 {
+			n := bigFileArity
+			if n > len(level) {
+				n = len(level)
+			}
+			if n == 1 {
+				next = append(next, level[0])
+			} else {
+				value := []byte{bigFileType}
+				for _, child := range level[:n] {
+					value = append(value, child.Hash...)
+				}
+				next = append(next, newMerkleNode("", path, value, level[:n]))
+			}
+			level = level[n:]
+		}
+		level = next
+	}
+	root := level[0]
+	root.Name = name
+	return root
+}
+
+// BuildDirectoryNode construit le noeud directory à partir de ses fils, dans l'ordre donné
+func BuildDirectoryNode(name string, path string, children []*MerkleNode) (*MerkleNode, error) {
+	if len(children) > maxDirEntries {
+		return nil, fmt.Errorf("too many entries in directory %v (%d > %d)", path, len(children), maxDirEntries)
+	}
+	value := []byte{directoryType}
+	for _, child := range children {
+		padded, err := padName(child.Name)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, padded...)
+		value = append(value, child.Hash...)
+	}
+	return newMerkleNode(name, path, value, children), nil
+}
+
+// BuildMerkleTree construit l'arbre du dossier dirPath.
+// order permet d'imposer l'ordre des entrées d'un répertoire (clé : chemin relatif du répertoire),
+// les entrées absentes de order sont ajoutées ensuite par ordre alphabétique. order peut être nil.
+func BuildMerkleTree(dirPath string, order map[string][]string) (*MerkleNode, error) {
+	return buildMerkleDir(dirPath, "", ".", order, nil)
+}
+
+// BuildFilteredTree construit l'arbre du dossier dirPath en ne gardant que les entrées pour lesquelles
+// keep(chemin relatif, est un dossier) est vrai
+func BuildFilteredTree(dirPath string, name string, keep func(path string, isDir bool) bool) (*MerkleNode, error) {
+	return buildMerkleDir(dirPath, name, ".", nil, keep)
+}
+
+func buildMerkleDir(dirPath string, name string, path string, order map[string][]string, keep func(string, bool) bool) (*MerkleNode, error) {
+	files, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	names := orderEntries(files, order[path])
+
+	children := make([]*MerkleNode, 0, len(names))
+	for _, file := range names {
+		childPath := joinTreePath(path, file.Name())
+		if keep != nil && !keep(childPath, file.IsDir()) {
+			continue
+		}
+		var child *MerkleNode
+		if file.IsDir() {
+			child, err = buildMerkleDir(dirPath+"/"+file.Name(), file.Name(), childPath, order, keep)
+		} else {
+			var data []byte
+			data, err = os.ReadFile(dirPath + "/" + file.Name())
+			if err == nil {
+				child = BuildFileTree(file.Name(), childPath, data)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	return BuildDirectoryNode(name, path, children)
+}
+
+// orderEntries trie les entrées selon wanted, puis le reste par nom
+func orderEntries(files []os.DirEntry, wanted []string) []os.DirEntry {
+	rank := make(map[string]int, len(wanted))
+	for i, name := range wanted {
+		rank[name] = i
+	}
+	ordered := make([]os.DirEntry, len(files))
+	copy(ordered, files)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, oki := rank[ordered[i].Name()]
+		rj, okj := rank[ordered[j].Name()]
+		if oki && okj {
+			return ri < rj
+		}
+		if oki != okj {
+			return oki
+		}
+		return ordered[i].Name() < ordered[j].Name()
+	})
+	return ordered
+}
+
+func joinTreePath(parent string, name string) string {
+	if parent == "." || parent == "" {
+		return name
+	}
+	return parent + "/" + name
+}
+
+type dirEntry struct {
+	Name string
+	Hash []byte
+}
+
+// parseDirectory décode la valeur d'un noeud directory (octet de type compris)
+func parseDirectory(value []byte) ([]dirEntry, error) {
+	if len(value) == 0 || value[0] != directoryType {
+		return nil, fmt.Errorf("datum is not a directory")
+	}
+	if (len(value)-1)%(nameSize+32) != 0 {
+		return nil, fmt.Errorf("bad directory length %d", len(value))
+	}
+	entries := make([]dirEntry, 0, (len(value)-1)/(nameSize+32))
+	for i := 1; i < len(value); i += nameSize + 32 {
+		entries = append(entries, dirEntry{unpadName(value[i : i+nameSize]), value[i+nameSize : i+nameSize+32]})
+	}
+	return entries, nil
+}
+
+// IndexTree remplit index avec hash -> noeud pour tous les noeuds de l'arbre
+func IndexTree(n *MerkleNode, index map[string]*MerkleNode) {
+	index[string(n.Hash)] = n
+	for _, child := range n.Children {
+		IndexTree(child, index)
+	}
+}
+
+// checkDatum vérifie qu'une valeur reçue est un noeud bien formé : chunk d'au plus chunkSize octets,
+// BigFile de 2 à bigFileArity hash, ou directory d'au plus maxDirEntries entrées
+func checkDatum(value []byte) error {
+	if len(value) == 0 {
+		return fmt.Errorf("empty datum")
+	}
+	switch value[0] {
+	case chunkType:
+		if len(value)-1 > chunkSize {
+			return fmt.Errorf("chunk of %d bytes", len(value)-1)
+		}
+	case bigFileType:
+		if (len(value)-1)%32 != 0 {
+			return fmt.Errorf("bad BigFile length %d", len(value))
+		}
+		if n := (len(value) - 1) / 32; n < 2 || n > bigFileArity {
+			return fmt.Errorf("BigFile with %d children", n)
+		}
+	case directoryType:
+		entries, err := parseDirectory(value)
+		if err != nil {
+			return err
+		}
+		if len(entries) > maxDirEntries {
+			return fmt.Errorf("directory with %d entries", len(entries))
+		}
+	default:
+		return fmt.Errorf("unknown datum type %d", value[0])
+	}
+	return nil
+}
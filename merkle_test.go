@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// walkTree vérifie chaque noeud sous n (hash = sha256 de la valeur, valeur acceptée par checkDatum)
+// et renvoie les octets des chunks dans l'ordre
+func walkTree(t *testing.T, n *MerkleNode) []byte {
+	t.Helper()
+	if sum := sha256.Sum256(n.Value); !bytes.Equal(sum[:], n.Hash) {
+		t.Fatalf("%v: hash %x is not the sha256 of the value", n.Path, n.Hash)
+	}
+	if err := checkDatum(n.Value); err != nil {
+		t.Fatalf("%v: built node rejected: %v", n.Path, err)
+	}
+	children := childHashes(n.Value)
+	if len(children) != len(n.Children) {
+		t.Fatalf("%v: %d hashes in the value for %d children", n.Path, len(children), len(n.Children))
+	}
+	if n.Type() == chunkType {
+		return n.Value[1:]
+	}
+	data := make([]byte, 0)
+	for i, child := range n.Children {
+		if !bytes.Equal(children[i], child.Hash) {
+			t.Fatalf("%v: child %d hash differs from the value", n.Path, i)
+		}
+		data = append(data, walkTree(t, child)...)
+	}
+	return data
+}
+
+func TestFileTree(t *testing.T) {
+	for _, c := range []struct {
+		size     int
+		rootType byte
+		children int
+	}{
+		{0, chunkType, 0},
+		{chunkSize, chunkType, 0},
+		{chunkSize + 1, bigFileType, 2},
+		{bigFileArity*chunkSize + 1, bigFileType, 2}, //un BigFile plein de 32 chunks et le dernier chunk
+	} {
+		data := make([]byte, c.size)
+		rand.New(rand.NewSource(int64(c.size))).Read(data)
+		root := BuildFileTree("f", "f", data)
+		if root.Type() != c.rootType || len(root.Children) != c.children {
+			t.Fatalf("%d bytes: root of type %d with %d children, want type %d with %d", c.size, root.Type(), len(root.Children), c.rootType, c.children)
+		}
+		if got := walkTree(t, root); !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: chunks give back %d bytes", c.size, len(got))
+		}
+	}
+}
+
+func TestDirectoryNode(t *testing.T) {
+	children := make([]*MerkleNode, 0, maxDirEntries+1)
+	for i := 0; i <= maxDirEntries; i++ {
+		children = append(children, BuildFileTree(fmt.Sprintf("entry-%02d", i), "", []byte{byte(i)}))
+	}
+	dir, err := BuildDirectoryNode("d", "d", children[:maxDirEntries])
+	if err != nil {
+		t.Fatal(err)
+	}
+	walkTree(t, dir)
+	entries, err := parseDirectory(dir.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != maxDirEntries {
+		t.Fatalf("%d entries parsed, want %d", len(entries), maxDirEntries)
+	}
+	for i, e := range entries {
+		if e.Name != children[i].Name || !bytes.Equal(e.Hash, children[i].Hash) {
+			t.Fatalf("entry %d parsed as %q %x", i, e.Name, e.Hash)
+		}
+	}
+	if _, err := BuildDirectoryNode("d", "d", children); err == nil {
+		t.Fatalf("directory of %d entries built", len(children))
+	}
+	long := BuildFileTree(strings.Repeat("x", nameSize+1), "", nil)
+	if _, err := BuildDirectoryNode("d", "d", []*MerkleNode{long}); err == nil {
+		t.Fatalf("entry name of %d bytes accepted", nameSize+1)
+	}
+}
+
+func TestCheckDatum(t *testing.T) {
+	hashes := func(n int) []byte { return make([]byte, 32*n) }
+	entries := func(n int) []byte { return make([]byte, n*(nameSize+32)) }
+	for _, c := range []struct {
+		name  string
+		value []byte
+		ok    bool
+	}{
+		{"empty", nil, false},
+		{"empty chunk", []byte{chunkType}, true},
+		{"full chunk", append([]byte{chunkType}, make([]byte, chunkSize)...), true},
+		{"oversized chunk", append([]byte{chunkType}, make([]byte, chunkSize+1)...), false},
+		{"BigFile of 1", append([]byte{bigFileType}, hashes(1)...), false},
+		{"BigFile of 2", append([]byte{bigFileType}, hashes(2)...), true},
+		{"BigFile of 32", append([]byte{bigFileType}, hashes(bigFileArity)...), true},
+		{"BigFile of 33", append([]byte{bigFileType}, hashes(bigFileArity+1)...), false},
+		{"truncated BigFile", append([]byte{bigFileType}, hashes(2)[1:]...), false},
+		{"empty directory", []byte{directoryType}, true},
+		{"directory of 16", append([]byte{directoryType}, entries(maxDirEntries)...), true},
+		{"directory of 17", append([]byte{directoryType}, entries(maxDirEntries+1)...), false},
+		{"truncated directory", append([]byte{directoryType}, entries(1)[1:]...), false},
+		{"unknown type", []byte{3}, false},
+	} {
+		if err := checkDatum(c.value); (err == nil) != c.ok {
+			t.Errorf("%v: checkDatum = %v", c.name, err)
+		}
+	}
+}
+
+func TestCompareWithManifest(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a/x", "x")
+	write("a/y", "y")
+	write("b", "b")
+	write("same/z", "z")
+	remote, err := BuildMerkleTree(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeManifest(dir, treeManifest(remote)); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string][]byte)
+	for _, e := range entries {
+		expected[e.Path] = e.Hash
+	}
+	if len(expected) != 7 || !bytes.Equal(expected["."], remote.Hash) {
+		t.Fatalf("manifest read back as %d entries with root %x", len(expected), expected["."])
+	}
+	if m := compareWithManifest(remote, expected); len(m) != 0 {
+		t.Fatalf("identical tree reported %v", m)
+	}
+
+	write("a/x", "changed")
+	os.Remove(filepath.Join(dir, "b"))
+	write("c", "new")
+	local, err := BuildMerkleTree(dir, manifestOrder(entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []treeMismatch{
+		{".", "subtree differs"},
+		{"a", "subtree differs"},
+		{"a/x", "content differs"},
+		{"c", "not in remote tree"},
+		{"b", "missing locally"},
+	}
+	got := compareWithManifest(local, expected)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("mismatches %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//===================================================================================================
+//                                METRIQUES
+//===================================================================================================
+
+// Compteurs et histogrammes du protocole, exposés au format texte de Prometheus sur /metrics avec
+// -metrics :9100. Ils sont tenus même sans -metrics : un incrément ne coûte qu'un verrou.
+
+var metricsAddr = flag.String("metrics", "", "serve Prometheus metrics on this address (\":port\" listens on localhost only)")
+
+// counterVec est un compteur par valeur d'une étiquette (ou sans étiquette si label est vide)
+type counterVec struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]uint64
+}
+
+func newCounter(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+}
+
+func (c *counterVec) add(value string, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[value] += n
+}
+
+func (c *counterVec) inc(value string) {
+	c.add(value, 1)
+}
+
+func (c *counterVec) get(value string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[value]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%v %d\n", c.name, c.values[""])
+		return
+	}
+	for _, v := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%v{%v} %d\n", c.name, labelPair(c.label, v), c.values[v])
+	}
+}
+
+// gauge est une valeur qui monte et descend
+type gauge struct {
+	name, help string
+	value      int64
+}
+
+func (g *gauge) add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n%v %d\n", g.name, g.help, g.name, g.name, atomic.LoadInt64(&g.value))
+}
+
+// histogramVec compte les observations par seuil cumulatif, pour chaque valeur d'une étiquette
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+	mu                sync.Mutex
+	series            map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 //une case par seuil, non cumulées
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(value string, x float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[value]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = s
+	}
+	for i, le := range h.buckets {
+		if x <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += x
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		s := h.series[v]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%v_bucket{%v,le=\"%g\"} %d\n", h.name, labelPair(h.label, v), le, cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket{%v,le=\"+Inf\"} %d\n", h.name, labelPair(h.label, v), s.count)
+		fmt.Fprintf(w, "%v_sum{%v} %g\n", h.name, labelPair(h.label, v), s.sum)
+		fmt.Fprintf(w, "%v_count{%v} %d\n", h.name, labelPair(h.label, v), s.count)
+	}
+}
+
+func labelPair(label, value string) string {
+	return fmt.Sprintf("%v=\"%v\"", label, strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value))
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var metrics = struct {
+	sent, received, retransmits, timeouts      *counterVec
+	badSignatures, badHashes, malformed        *counterVec
+	limited, bans                              *counterVec
+	bytesServed, bytesDownloaded, datumsServed *counterVec
+	sessions                                   *gauge
+	rtt                                        *histogramVec
+}{
+	sent:            newCounter("tp_messages_sent_total", "Datagrams sent, by message type.", "type"),
+	received:        newCounter("tp_messages_received_total", "Datagrams received, by message type.", "type"),
+	retransmits:     newCounter("tp_retransmissions_total", "Requests sent again after a timeout or a bad reply, by message type.", "type"),
+	timeouts:        newCounter("tp_timeouts_total", "Requests abandoned without a reply after every attempt, by message type.", "type"),
+	badSignatures:   newCounter("tp_signature_failures_total", "Messages dropped because their signature did not verify.", ""),
+	badHashes:       newCounter("tp_hash_mismatches_total", "Datum replies whose value did not match the requested hash.", ""),
+	malformed:       newCounter("tp_malformed_messages_total", "Datagrams or datums that could not be decoded.", ""),
+	limited:         newCounter("tp_requests_limited_total", "Requests or sessions refused by the limits, by reason (banned, messages, datum_bytes, bandwidth, amplification).", "reason"),
+	bans:            newCounter("tp_bans_total", "Addresses banned for sending malformed packets or bad signatures.", ""),
+	bytesServed:     newCounter("tp_datum_bytes_served_total", "Bytes of datum values sent in reply to GetDatum.", ""),
+	datumsServed:    newCounter("tp_datums_served_total", "GetDatum requests answered, by result (datum or nodatum).", "result"),
+	bytesDownloaded: newCounter("tp_datum_bytes_downloaded_total", "Bytes of verified datum values received.", ""),
+	sessions:        &gauge{name: "tp_active_sessions", help: "UDP sessions with peers currently open."},
+	rtt: newHistogram("tp_rtt_seconds", "Round-trip time of requests answered on the first attempt, by peer address.", "peer",
+		[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}),
+}
+
+// writeMetrics écrit toutes les métriques au format texte de Prometheus
+func writeMetrics(w io.Writer) {
+	for _, c := range []*counterVec{metrics.sent, metrics.received, metrics.retransmits, metrics.timeouts,
+		metrics.badSignatures, metrics.badHashes, metrics.malformed, metrics.limited, metrics.bans,
+		metrics.bytesServed, metrics.datumsServed, metrics.bytesDownloaded} {
+		c.write(w)
+	}
+	metrics.sessions.write(w)
+	metrics.rtt.write(w)
+}
+
+// countDatagram compte un datagramme envoyé (sent) ou reçu selon son type
+func countDatagram(c *counterVec, data []byte) {
+	if len(data) < 5 {
+		c.inc("truncated")
+		return
+	}
+	c.inc(messageTypeName(data[4]))
+}
+
+// meteredTransport tient à jour le nombre de sessions ouvertes
+type meteredTransport struct {
+	Transport
+	closed int32
+}
+
+func (m *meteredTransport) Close() error {
+	if atomic.CompareAndSwapInt32(&m.closed, 0, 1) {
+		metrics.sessions.add(-1)
+	}
+	return m.Transport.Close()
+}
+
+// initMetrics compte les sessions ouvertes par dialTransport et, avec -metrics, lance le serveur HTTP
+func initMetrics() {
+	dial := dialTransport
+	dialTransport = func(addr string) (Transport, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		metrics.sessions.add(1)
+		return &meteredTransport{Transport: conn}, nil
+	}
+	if *metricsAddr == "" {
+		return
+	}
+	addr := gatewayListenAddr(*metricsAddr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	go func() {
+		slog.Info("Metrics", "url", "http://"+addr+"/metrics")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("Metrics", "err", err)
+		}
+	}()
+}
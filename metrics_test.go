@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 5)
+	tree, err := BuildMerkleTree(src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sn := newSimNet(46)
+	peer := newSimPeer(tree)
+	peerAddr := sn.Node("192.0.2.10", nil).Listen(8443, peer.handle)
+	client := sn.Node("198.51.100.7", nil)
+	defer useSimNet(sn, client)()
+	*maxAttempts = 30
+
+	getDatums := metrics.sent.get("GetDatum")
+	datums := metrics.received.get("Datum")
+	retransmits := metrics.retransmits.get("GetDatum")
+	downloaded := metrics.bytesDownloaded.get("")
+	simDownload(t, sn, client, peerAddr.String(), filepath.Join(t.TempDir(), "root"))
+
+	if n := metrics.sent.get("GetDatum") - getDatums; n < uint64(peer.Requests)/2 {
+		t.Fatalf("%d GetDatum counted as sent, the peer received %d", n, peer.Requests)
+	}
+	if metrics.received.get("Datum") == datums {
+		t.Fatalf("no Datum counted as received")
+	}
+	if metrics.retransmits.get("GetDatum") == retransmits {
+		t.Fatalf("no retransmission counted with %d packets lost", sn.Dropped)
+	}
+	if metrics.bytesDownloaded.get("")-downloaded < 40*chunkSize {
+		t.Fatalf("only %d bytes counted as downloaded", metrics.bytesDownloaded.get("")-downloaded)
+	}
+
+	//chaque ligne est un commentaire ou « nom{étiquettes} valeur »
+	var b bytes.Buffer
+	writeMetrics(&b)
+	sample := regexp.MustCompile(`^[a-z_]+(\{[a-z]+="[^"]*"(,le="[^"]+")?\})? [0-9.e+-]+$`)
+	rtt := false
+	scanner := bufio.NewScanner(&b)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line[0] == '#' {
+			continue
+		}
+		if !sample.MatchString(line) {
+			t.Fatalf("bad exposition line %q", line)
+		}
+		rtt = rtt || strings.HasPrefix(line, `tp_rtt_seconds_count{peer="`+peerAddr.String()+`"}`)
+	}
+	if !rtt {
+		t.Fatalf("no RTT histogram for %v:\n%v", peerAddr, b.String())
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//===================================================================================================
+//                                MIRROR
+//===================================================================================================
+
+// mirrorMain implémente "mirror [-interval d] [-keep] <peer> <dir>" : garde dir à jour avec l'arbre du pair
+func mirrorMain(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	interval := flags.Duration("interval", time.Minute, "delay between two polls of the peer's root")
+	keep := flags.Bool("keep", false, "keep local files that disappeared upstream")
+	if flags.Parse(args) != nil || flags.NArg() != 2 {
+		fmt.Fprintf(os.Stderr, "usage: mirror [-interval d] [-keep] <peer> <dir>\n")
+		return 2
+	}
+	peerName := flags.Arg(0)
+	dir := strings.TrimRight(flags.Arg(1), "/")
+
+	privK, pubK := newKeys()
+	initDatumStore()
+	initExports(privK)
+	var bobK *ecdsa.PublicKey
+	client := restClient()
+
+	conn := registerToServer(privK, pubK, bobK, ourRoot())
+	if conn == nil {
+		slog.Error("Cannot register with the server")
+		return 1
+	}
+	defer conn.Close()
+	closeOnCancel(ctx, conn)
+	go HelloRepeater(ctx, conn, privK, bobK)
+
+	m := mirror{peerName, dir, *keep, humanOutput(), *client, privK, bobK, pubK, nil, nil}
+	defer func() {
+		if m.conn != nil {
+			m.conn.Close()
+		}
+	}()
+	for {
+		err := m.sync(ctx)
+		if ctx.Err() != nil { //arrêt demandé : une synchronisation interrompue ne modifie pas dir
+			return 0
+		}
+		if err != nil {
+			slog.Warn("Mirror failed", "peer", peerName, "err", err)
+		}
+		if !sleepContext(ctx, *interval) {
+			return 0
+		}
+	}
+}
+
+type mirror struct {
+	peerName string
+	dir      string
+	keep     bool
+	out      io.Writer //changements et statistiques de chaque synchronisation
+	client   http.Client
+	privK    *ecdsa.PrivateKey
+	bobK     *ecdsa.PublicKey
+	pubK     []byte
+	conn     Transport //session UDP avec le pair, rouverte si elle ne répond plus
+	lastRoot []byte    //racine du pair lors de la dernière synchronisation réussie
+}
+
+// remoteRoot demande la racine du pair par REST et par Root/RootReply sur la session UDP.
+// En cas de désaccord on garde celle de la session, plus récente que celle connue du serveur.
+func (m *mirror) remoteRoot() ([]byte, error) {
+	restRoot, errREST := HttpRequest("GET", jchPeersAddr+m.peerName+"/root", m.client)
+	if errREST == nil && len(restRoot) != 32 {
+		errREST = fmt.Errorf("bad root length %d", len(restRoot))
+	}
+
+	if m.conn == nil {
+		addrs, err := HttpRequest("GET", jchPeersAddr+m.peerName+"/addresses", m.client)
+		if err == nil {
+			m.conn = connectPeer(m.peerName, ParseREST(addrs), m.privK, m.bobK, m.pubK, ourRoot())
+		}
+		if m.conn == nil {
+			return nil, fmt.Errorf("cannot open session with %v", m.peerName)
+		}
+	}
+	udpRoot, err := rootRequest(m.conn, ourRoot(), m.privK, m.bobK)
+	if err != nil {
+		m.conn.Close()
+		m.conn = nil
+		if errREST != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("session with %v lost", m.peerName)
+	}
+	if errREST == nil && !bytes.Equal(restRoot, udpRoot) {
+		slog.Warn("Root differs between REST and UDP", "peer", m.peerName, "rest", hex.EncodeToString(restRoot), "udp", hex.EncodeToString(udpRoot))
+	}
+	return udpRoot, nil
+}
+
+// sync récupère ce qui a changé depuis la dernière synchronisation
+func (m *mirror) sync(ctx context.Context) error {
+	root, err := m.remoteRoot()
+	if err != nil {
+		return err
+	}
+	stop := closeOnCancel(ctx, m.conn)
+	defer stop()
+	if bytes.Equal(root, m.lastRoot) {
+		return nil
+	}
+	slog.Info("Syncing", "peer", m.peerName, hashAttr(root), "dir", m.dir)
+	resetProgress()
+	changes, err := updateDirectory(ctx, m.conn, root, m.dir, m.privK, m.bobK, m.keep)
+	doneProgress()
+	for _, c := range changes {
+		fmt.Fprintf(m.out, "%v %v\n", c.Kind, c.Path)
+	}
+	fmt.Fprintf(m.out, "%v\n", sessionStats(m.conn.RemoteAddr()))
+	if err != nil {
+		return err
+	}
+	m.lastRoot = root
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 5)
+	sn := newSimNet(5)
+	sw := &simSwitch{}
+	sw.swap(t, src)
+	peerAddr := sn.Node("192.0.2.10", nil).Listen(8443, sw.handle)
+	defer useSimNet(sn, sn.Node("198.51.100.7", nil))()
+
+	directory, client := useSimDirectory(t)
+	directory.add("sim", peerAddr, func() []byte { return sw.peer.root })
+
+	out := filepath.Join(t.TempDir(), "out")
+	m := mirror{peerName: "sim", dir: out, keep: true, out: io.Discard, client: client, pubK: make([]byte, 64)}
+	defer func() {
+		if m.conn != nil {
+			m.conn.Close()
+		}
+	}()
+	sync := func() {
+		t.Helper()
+		if err := m.sync(context.Background()); err != nil {
+			t.Fatalf("sync: %v (%v)", err, sn)
+		}
+	}
+	sync()
+	if !bytes.Equal(buildTestTree(t, out).Hash, sw.peer.root) {
+		t.Fatalf("first sync does not match the peer")
+	}
+
+	//racine inchangée : aucun GetDatum
+	sw.requested = make(map[string]bool)
+	sync()
+	if len(sw.requested) != 0 {
+		t.Fatalf("%d datums requested with an unchanged root", len(sw.requested))
+	}
+
+	//-keep : un fichier supprimé chez le pair reste, un fichier modifié est mis à jour
+	os.Remove(filepath.Join(src, "small.txt"))
+	os.WriteFile(filepath.Join(src, "docs/readme"), []byte("changed"), 0644)
+	sw.swap(t, src)
+	sync()
+	if _, err := os.Stat(filepath.Join(out, "small.txt")); err != nil {
+		t.Fatalf("removed file not kept with -keep: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "docs/readme")); string(data) != "changed" {
+		t.Fatalf("modified file not updated: %q", data)
+	}
+
+	//sans -keep le miroir devient identique au pair
+	m.keep = false
+	os.WriteFile(filepath.Join(src, "docs/readme"), []byte("changed again"), 0644)
+	sw.swap(t, src)
+	sync()
+	if _, err := os.Stat(filepath.Join(out, "small.txt")); !os.IsNotExist(err) {
+		t.Fatalf("removed file still there without -keep: %v", err)
+	}
+	if !bytes.Equal(buildTestTree(t, out).Hash, sw.peer.root) {
+		t.Fatalf("mirror does not match the peer")
+	}
+}
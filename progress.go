@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===================================================================================================
+//                                PROGRESSION DES TELECHARGEMENTS
+//===================================================================================================
+
+// Les téléchargements émettent des événements (hash mis en file, demandés, reçus, retransmis, fichiers
+// commencés et écrits). Ils sont résumés dans une barre de progression sur stderr (-progress bar) ou
+// écrits un par ligne en JSON (-progress json) pour les scripts, dans -progress-file ou sur stdout : les commandes
+// écrivent alors le reste (menus, changements, statistiques) sur humanOutput(), stderr, pour que le flux reste lisible.
+
+var progressMode = flag.String("progress", "", "report download progress: \"bar\" on stderr or \"json\" lines on stdout")
+var progressOutput = flag.String("progress-file", "", "with -progress json, write the events to this file instead of stdout")
+
+const (
+	progressQueued     = "queued"     //Bytes = nombre de hash que l'on va demander
+	progressRequest    = "request"    //premier envoi d'un GetDatum
+	progressRetransmit = "retransmit" //GetDatum renvoyé faute de réponse
+	progressReceive    = "receive"    //Datum valide reçu, Bytes = taille de la valeur
+	progressFile       = "file"       //début d'un fichier
+	progressWrite      = "write"      //fichier écrit et vérifié, Bytes = sa taille
+	progressDone       = "done"       //fin du téléchargement
+)
+
+type progressEvent struct {
+	Time  float64 `json:"t"` //secondes depuis le début
+	Event string  `json:"event"`
+	Hash  string  `json:"hash,omitempty"`
+	Bytes int64   `json:"bytes,omitempty"`
+	File  string  `json:"file,omitempty"`
+}
+
+// progressStats est le cumul des événements depuis resetProgress
+type progressStats struct {
+	Start         time.Time
+	Queued        int64
+	Requested     int
+	Received      int
+	Retransmits   int
+	BytesReceived int64
+	BytesWritten  int64
+	File          string
+}
+
+type progressSink func(e progressEvent, st progressStats)
+
+var progress = struct {
+	sync.Mutex
+	stats progressStats
+	sinks []progressSink
+}{stats: progressStats{Start: time.Now()}}
+
+// emitProgress compte l'événement et le transmet aux abonnés
+func emitProgress(event string, hash []byte, bytes int64, file string) {
+	progress.Lock()
+	defer progress.Unlock()
+	if len(progress.sinks) == 0 {
+		return
+	}
+	st := &progress.stats
+	switch event {
+	case progressQueued:
+		st.Queued += bytes
+	case progressRequest:
+		st.Requested++
+	case progressRetransmit:
+		st.Retransmits++
+	case progressReceive:
+		st.Received++
+		st.BytesReceived += bytes
+	case progressFile:
+		st.File = file
+	case progressWrite:
+		st.BytesWritten += bytes
+	}
+	e := progressEvent{Time: time.Since(st.Start).Seconds(), Event: event, Bytes: bytes, File: file}
+	if hash != nil {
+		e.Hash = hex.EncodeToString(hash)
+	}
+	for _, sink := range progress.sinks {
+		sink(e, *st)
+	}
+}
+
+// addProgressSink abonne sink aux événements
+func addProgressSink(sink progressSink) {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.sinks = append(progress.sinks, sink)
+}
+
+// resetProgress remet les compteurs à zéro au début d'un téléchargement
+func resetProgress() {
+	progress.Lock()
+	defer progress.Unlock()
+	progress.stats = progressStats{Start: time.Now()}
+}
+
+// doneProgress signale la fin d'un téléchargement
+func doneProgress() {
+	emitProgress(progressDone, nil, 0, "")
+}
+
+// rate est le débit moyen de réception en octets/s
+func (st progressStats) rate() float64 {
+	elapsed := time.Since(st.Start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(st.BytesReceived) / elapsed
+}
+
+// eta estime le temps restant pour les hash déjà connus, avec la taille moyenne des Datum reçus ;
+// on ne connaît pas la taille de l'arbre à l'avance, c'est donc une borne basse
+func (st progressStats) eta() (time.Duration, bool) {
+	remaining := st.Queued - int64(st.Received)
+	if st.Received == 0 || remaining <= 0 || st.rate() == 0 {
+		return 0, false
+	}
+	bytesLeft := float64(remaining) * float64(st.BytesReceived) / float64(st.Received)
+	return time.Duration(bytesLeft / st.rate() * float64(time.Second)).Round(time.Second), true
+}
+
+// line résume la progression sur une ligne
+func (st progressStats) line() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d/%d datums  %v  %v/s", st.Received, st.Queued, humanSize(st.BytesReceived), humanSize(int64(st.rate())))
+	if st.Retransmits > 0 {
+		fmt.Fprintf(&b, "  %d retransmits", st.Retransmits)
+	}
+	if eta, ok := st.eta(); ok {
+		fmt.Fprintf(&b, "  ETA >%v", eta)
+	}
+	if st.File != "" {
+		fmt.Fprintf(&b, "  %v", st.File)
+	}
+	return b.String()
+}
+
+// progressBar redessine une ligne sur w (stderr) au plus tous les 200ms
+func progressBar(w io.Writer) progressSink {
+	var last time.Time
+	return func(e progressEvent, st progressStats) {
+		if time.Since(last) < 200*time.Millisecond && e.Event != progressWrite && e.Event != progressDone {
+			return
+		}
+		last = time.Now()
+		bar := "[" + strings.Repeat(" ", 20) + "]"
+		if st.Queued > 0 {
+			done := int(20 * int64(st.Received) / st.Queued)
+			if done > 20 {
+				done = 20
+			}
+			bar = "[" + strings.Repeat("#", done) + strings.Repeat(" ", 20-done) + "]"
+		}
+		line := bar + " " + st.line()
+		if len(line) > 120 {
+			line = line[:117] + "..."
+		}
+		fmt.Fprintf(w, "\r\x1b[K%v", line)
+		if e.Event == progressDone {
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
+
+// progressJSON écrit chaque événement sur une ligne de w
+func progressJSON(w io.Writer) progressSink {
+	enc := json.NewEncoder(w)
+	return func(e progressEvent, st progressStats) {
+		enc.Encode(e)
+	}
+}
+
+// humanOutput est la sortie des menus, changements et statistiques : stdout, sauf si les événements JSON y
+// sont écrits
+func humanOutput() io.Writer {
+	if *progressMode == "json" && *progressOutput == "" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// initProgress branche la sortie choisie avec -progress ; la barre n'est pas utilisée avec -tui,
+// qui affiche la progression dans sa ligne d'état
+func initProgress() {
+	switch *progressMode {
+	case "bar":
+		if !*tuiMode {
+			addProgressSink(progressBar(os.Stderr))
+		}
+	case "json":
+		if *progressOutput != "" {
+			f, err := os.Create(*progressOutput)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Cannot create progress file: %v\n", err)
+				return
+			}
+			addProgressSink(progressJSON(f))
+			return
+		}
+		addProgressSink(progressJSON(os.Stdout))
+	case "":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown -progress mode %q\n", *progressMode)
+	}
+}
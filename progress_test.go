@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useProgressSinks retire les abonnés aux événements jusqu'à la fin du test
+func useProgressSinks(t *testing.T) {
+	progress.Lock()
+	saved := progress.sinks
+	progress.sinks = nil
+	progress.Unlock()
+	t.Cleanup(func() {
+		progress.Lock()
+		progress.sinks = saved
+		progress.Unlock()
+	})
+}
+
+// emitTestDownload émet les événements d'un téléchargement de deux Datum et d'un fichier
+func emitTestDownload() {
+	resetProgress()
+	emitProgress(progressQueued, nil, 2, "")
+	emitProgress(progressRequest, []byte{0xab, 0xcd}, 0, "")
+	emitProgress(progressRetransmit, []byte{0xab, 0xcd}, 0, "")
+	emitProgress(progressReceive, []byte{0xab, 0xcd}, 1000, "")
+	emitProgress(progressFile, nil, 0, "dir/f")
+	emitProgress(progressReceive, []byte{0x01}, 24, "")
+	emitProgress(progressWrite, nil, 1024, "dir/f")
+	doneProgress()
+}
+
+func TestProgressJSON(t *testing.T) {
+	useProgressSinks(t)
+	var buf bytes.Buffer
+	addProgressSink(progressJSON(&buf))
+	emitTestDownload()
+
+	events := make([]progressEvent, 0)
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var e progressEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	names := make([]string, 0, len(events))
+	for _, e := range events {
+		names = append(names, e.Event)
+	}
+	if strings.Join(names, " ") != "queued request retransmit receive file receive write done" {
+		t.Fatalf("events %v", names)
+	}
+	if e := events[3]; e.Hash != "abcd" || e.Bytes != 1000 {
+		t.Fatalf("receive event %+v", e)
+	}
+	if e := events[6]; e.File != "dir/f" || e.Bytes != 1024 {
+		t.Fatalf("write event %+v", e)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	useProgressSinks(t)
+	var buf bytes.Buffer
+	addProgressSink(progressBar(&buf))
+	emitTestDownload()
+
+	//une ligne au premier événement, puis à l'écriture du fichier et à la fin, les autres sont trop rapprochés
+	draws := strings.Split(buf.String(), "\r\x1b[K")[1:]
+	if len(draws) != 3 {
+		t.Fatalf("%d redraws: %q", len(draws), buf.String())
+	}
+	last := draws[2]
+	if !strings.HasPrefix(last, "["+strings.Repeat("#", 20)+"] 2/2 datums  1.0 KiB") || !strings.Contains(last, "1 retransmits") ||
+		!strings.HasSuffix(last, "dir/f\n") {
+		t.Fatalf("last line %q", last)
+	}
+}
+
+func TestProgressOutput(t *testing.T) {
+	useProgressSinks(t)
+	savedMode, savedFile, savedStdout := *progressMode, *progressOutput, os.Stdout
+	defer func() { *progressMode, *progressOutput = savedMode, savedFile }()
+
+	*progressMode, *progressOutput = "json", ""
+	initProgress()
+	if os.Stdout != savedStdout || humanOutput() != os.Stderr {
+		t.Fatalf("with JSON events on stdout, human output goes to %v and stdout is %v", humanOutput(), os.Stdout)
+	}
+
+	progress.Lock()
+	progress.sinks = nil //rien sur le vrai stdout
+	progress.Unlock()
+	*progressOutput = filepath.Join(t.TempDir(), "events")
+	initProgress()
+	if humanOutput() != os.Stdout {
+		t.Fatalf("with -progress-file, human output goes to %v", humanOutput())
+	}
+	emitProgress(progressDone, nil, 0, "")
+	if data, err := os.ReadFile(*progressOutput); err != nil || !strings.Contains(string(data), `"event":"done"`) {
+		t.Fatalf("progress file contains %q (%v)", data, err)
+	}
+}
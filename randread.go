@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+//===================================================================================================
+//                                ACCES DIRECT DANS UN BIGFILE
+//===================================================================================================
+
+// Un BigFile construit par groupes de 32 a une forme connue : tous les fils d'un noeud sauf le dernier
+// sont des sous-arbres pleins, qui couvrent chunkSize*32^(h-1) octets pour un noeud de hauteur h.
+// On peut donc aller directement aux chunks qui couvrent une plage d'octets, sans lire ce qui précède.
+// Si le pair a découpé son fichier autrement, on s'en aperçoit en descendant et on relit tout le fichier.
+
+// batchSource renvoie la valeur de chaque noeud de hashes, indexée par string(hash)
+type batchSource func(hashes [][]byte) (map[string][]byte, error)
+
+var errIrregularFile = errors.New("file does not follow the 32-ary layout")
+
+// maxFileHeight borne la hauteur d'un BigFile pour que les tailles tiennent dans un int64
+const maxFileHeight = 10
+
+type FileReader struct {
+	fetch batchSource
+}
+
+func NewFileReader(fetch batchSource) *FileReader {
+	return &FileReader{fetch}
+}
+
+func (fr *FileReader) node(hash []byte) ([]byte, error) {
+	values, err := fr.fetch([][]byte{hash})
+	if err != nil {
+		return nil, err
+	}
+	value := values[string(hash)]
+	if len(value) == 0 {
+		return nil, errNoDatum
+	}
+	return value, nil
+}
+
+// height compte les niveaux de BigFile sous value en suivant le premier fils
+func (fr *FileReader) height(value []byte) (int, error) {
+	h := 0
+	for value[0] == bigFileType {
+		children := childHashes(value)
+		if len(children) == 0 || h == maxFileHeight {
+			return 0, errIrregularFile
+		}
+		v, err := fr.node(children[0])
+		if err != nil {
+			return 0, err
+		}
+		value = v
+		h++
+	}
+	if value[0] != chunkType {
+		return 0, errIrregularFile
+	}
+	return h, nil
+}
+
+// childSpan est le nombre d'octets couverts par chaque fils plein d'un noeud de hauteur h
+func childSpan(h int) int64 {
+	span := int64(chunkSize)
+	for i := 1; i < h; i++ {
+		span *= bigFileArity
+	}
+	return span
+}
+
+// Size renvoie la taille du fichier de racine root en descendant le long du dernier fils (ses frères ne sont
+// lus que pour vérifier qu'ils sont pleins), ou en lisant tout le fichier s'il n'a pas la forme de BuildFileTree
+func (fr *FileReader) Size(root []byte) (int64, error) {
+	size, err := fr.SizeFromShape(root)
+	if err == errIrregularFile {
+		return fr.sizeByReading(root)
+	}
+	return size, err
+}
+
+// SizeFromShape est Size sans lecture de tout le fichier : errIrregularFile si sa forme ne donne pas sa taille
+func (fr *FileReader) SizeFromShape(root []byte) (int64, error) {
+	value, err := fr.node(root)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for value[0] == bigFileType {
+		h, err := fr.height(value)
+		if err != nil {
+			return 0, err
+		}
+		children := childHashes(value)
+		if err := fr.checkFull(children[:len(children)-1], h-1); err != nil {
+			return 0, err
+		}
+		size += int64(len(children)-1) * childSpan(h)
+		value, err = fr.node(children[len(children)-1])
+		if err != nil {
+			return 0, err
+		}
+	}
+	if value[0] != chunkType {
+		return 0, fmt.Errorf("%x is a directory", root)
+	}
+	return size + int64(len(value)-1), nil
+}
+
+// checkFull vérifie que les fils hashes, tous sauf le dernier d'un noeud de hauteur h+1, sont pleins : des chunks
+// de chunkSize octets si h == 0, des BigFile de 32 fils sinon. Les chunks plus bas ne sont vérifiés qu'en les
+// lisant (voir readRange), ce qui suffit pour les fichiers découpés par un autre programme que BuildFileTree.
+func (fr *FileReader) checkFull(hashes [][]byte, h int) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	values, err := fr.fetch(hashes)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		v := values[string(hash)]
+		if len(v) == 0 {
+			return errNoDatum
+		}
+		chunk := h == 0 && v[0] == chunkType && len(v)-1 == chunkSize
+		bigFile := h > 0 && v[0] == bigFileType && len(childHashes(v)) == bigFileArity
+		if !chunk && !bigFile {
+			return errIrregularFile
+		}
+	}
+	return nil
+}
+
+func (fr *FileReader) sizeByReading(root []byte) (int64, error) {
+	data, err := fr.ReadAll(root)
+	return int64(len(data)), err
+}
+
+// filePart est un noeud à lire et l'octet du fichier où il commence
+type filePart struct {
+	value  []byte
+	start  int64
+	height int
+	full   bool //pas le dernier fils de son père : il doit être plein
+}
+
+// ReadAt renvoie les n octets du fichier de racine root à partir de off, en ne récupérant que les noeuds
+// qui couvrent cette plage ; comme io.ReaderAt, il renvoie io.EOF avec moins de n octets en fin de fichier
+func (fr *FileReader) ReadAt(root []byte, off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", off, n)
+	}
+	size, err := fr.Size(root)
+	if err != nil {
+		return nil, err
+	}
+	return fr.readAt(root, size, off, n)
+}
+
+// readAt est ReadAt quand la taille du fichier est déjà connue
+func (fr *FileReader) readAt(root []byte, size, off, n int64) ([]byte, error) {
+	var eof error
+	if off >= size {
+		return []byte{}, io.EOF
+	}
+	if off+n > size {
+		n = size - off
+		eof = io.EOF
+	}
+	out := make([]byte, n)
+	err := fr.readRange(root, off, out)
+	if err == errIrregularFile {
+		data, err := fr.ReadAll(root)
+		if err != nil {
+			return nil, err
+		}
+		if off >= int64(len(data)) { //la taille annoncée par Size était fausse
+			return []byte{}, io.EOF
+		}
+		m := copy(out, data[off:])
+		return out[:m], eof
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, eof
+}
+
+// readRange remplit out avec les octets à partir de off, niveau par niveau
+func (fr *FileReader) readRange(root []byte, off int64, out []byte) error {
+	end := off + int64(len(out))
+	value, err := fr.node(root)
+	if err != nil {
+		return err
+	}
+	h, err := fr.height(value)
+	if err != nil {
+		return err
+	}
+	level := []filePart{{value: value, height: h}}
+	for len(level) > 0 {
+		pending := make([]filePart, 0)
+		hashes := make([][]byte, 0)
+		for _, p := range level {
+			if p.value[0] == chunkType {
+				if p.height != 0 || (p.full && len(p.value)-1 != chunkSize) {
+					return errIrregularFile
+				}
+				copyOverlap(out, off, p.value[1:], p.start)
+				continue
+			}
+			children := childHashes(p.value)
+			if p.value[0] != bigFileType || p.height == 0 || (p.full && len(children) != bigFileArity) {
+				return errIrregularFile
+			}
+			span := childSpan(p.height)
+			for i, c := range children {
+				start := p.start + int64(i)*span
+				if start >= end {
+					break
+				}
+				last := i == len(children)-1
+				if !last && start+span <= off {
+					continue
+				}
+				pending = append(pending, filePart{value: c, start: start, height: p.height - 1, full: p.full || !last})
+				hashes = append(hashes, c)
+			}
+		}
+		if len(hashes) == 0 {
+			break
+		}
+		values, err := fr.fetch(hashes)
+		if err != nil {
+			return err
+		}
+		level = make([]filePart, 0, len(pending))
+		for _, p := range pending {
+			p.value = values[string(p.value)]
+			if len(p.value) == 0 {
+				return errNoDatum
+			}
+			if !p.full { //le dernier fils peut avoir été remonté d'un ou plusieurs niveaux
+				h, err := fr.height(p.value)
+				if err != nil {
+					return err
+				}
+				if h > p.height {
+					return errIrregularFile
+				}
+				p.height = h
+			}
+			level = append(level, p)
+		}
+	}
+	return nil
+}
+
+// copyOverlap copie dans out (qui commence à l'octet off du fichier) la partie de data
+// (qui commence à l'octet start) commune aux deux
+func copyOverlap(out []byte, off int64, data []byte, start int64) {
+	lo, hi := start, start+int64(len(data))
+	if lo < off {
+		lo = off
+	}
+	if end := off + int64(len(out)); hi > end {
+		hi = end
+	}
+	if lo < hi {
+		copy(out[lo-off:hi-off], data[lo-start:hi-start])
+	}
+}
+
+// ReadAll reconstitue tout le fichier niveau par niveau, quelle que soit sa forme
+func (fr *FileReader) ReadAll(root []byte) ([]byte, error) {
+	value, err := fr.node(root)
+	if err != nil {
+		return nil, err
+	}
+	level := [][]byte{value}
+	for {
+		hashes := make([][]byte, 0)
+		for _, v := range level {
+			switch v[0] {
+			case directoryType:
+				return nil, fmt.Errorf("directory inside a file")
+			case bigFileType:
+				hashes = append(hashes, childHashes(v)...)
+			}
+		}
+		if len(hashes) == 0 {
+			break
+		}
+		values, err := fr.fetch(hashes)
+		if err != nil {
+			return nil, err
+		}
+		next := make([][]byte, 0, len(hashes))
+		for _, v := range level {
+			if v[0] == chunkType { //un chunk peut se trouver plus haut que les autres
+				next = append(next, v)
+				continue
+			}
+			for _, h := range childHashes(v) {
+				if len(values[string(h)]) == 0 {
+					return nil, errNoDatum
+				}
+				next = append(next, values[string(h)])
+			}
+		}
+		level = next
+	}
+	out := make([]byte, 0)
+	for _, v := range level {
+		out = append(out, v[1:]...)
+	}
+	return out, nil
+}
+
+// fileSeeker présente un fichier distant comme un io.ReadSeeker, pour http.ServeContent :
+// chaque Read ne récupère que les chunks qu'il couvre
+type fileSeeker struct {
+	fr   *FileReader
+	root []byte
+	size int64
+	pos  int64
+}
+
+func (f *fileSeeker) Read(p []byte) (int, error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+	data, err := f.fr.readAt(f.root, f.size, f.pos, int64(len(p)))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	n := copy(p, data)
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *fileSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("bad whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
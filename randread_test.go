@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// mapSource sert les valeurs de values et compte les noeuds demandés
+func mapSource(values map[string][]byte, fetched *int) batchSource {
+	return func(hashes [][]byte) (map[string][]byte, error) {
+		*fetched += len(hashes)
+		out := make(map[string][]byte, len(hashes))
+		for _, h := range hashes {
+			if v, ok := values[string(h)]; ok {
+				out[string(h)] = v
+			}
+		}
+		return out, nil
+	}
+}
+
+// putNode ajoute à values un noeud de type typ dont le contenu est payload, et renvoie son hash
+func putNode(values map[string][]byte, typ byte, payload ...[]byte) []byte {
+	value := bytes.Join(append([][]byte{{typ}}, payload...), nil)
+	hash := sha256.Sum256(value)
+	values[string(hash[:])] = value
+	return hash[:]
+}
+
+func TestFileReaderRegular(t *testing.T) {
+	//un sous-arbre plein de 32*32 chunks, puis un dernier fils remonté : 3 niveaux de BigFile
+	data := make([]byte, bigFileArity*bigFileArity*chunkSize+5000)
+	rand.New(rand.NewSource(10)).Read(data)
+	tree := BuildFileTree("f", "f", data)
+	fetched := 0
+	fr := NewFileReader(mapSource(newSimPeer(tree).values, &fetched))
+
+	size, err := fr.SizeFromShape(tree.Hash)
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("size %d (%v), want %d", size, err, len(data))
+	}
+	for _, c := range []struct{ off, n int64 }{
+		{0, 10},
+		{chunkSize - 3, 6},              //à cheval sur deux chunks
+		{bigFileArity*chunkSize - 1, 2}, //sur deux sous-arbres de hauteur 1
+		{bigFileArity*bigFileArity*chunkSize - 100, 200}, //sur le sous-arbre plein et le dernier fils
+		{int64(len(data)) - 50, 50},
+	} {
+		fetched = 0
+		got, err := fr.ReadAt(tree.Hash, c.off, c.n)
+		if err != nil || !bytes.Equal(got, data[c.off:c.off+c.n]) {
+			t.Fatalf("ReadAt(%d, %d): %d bytes, %v", c.off, c.n, len(got), err)
+		}
+		if fetched > 3*bigFileArity+8 { //Size, puis deux branches au plus
+			t.Fatalf("ReadAt(%d, %d) fetched %d nodes", c.off, c.n, fetched)
+		}
+	}
+	got, err := fr.ReadAt(tree.Hash, int64(len(data))-10, 100)
+	if err != io.EOF || !bytes.Equal(got, data[len(data)-10:]) {
+		t.Fatalf("read past the end: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestFileReaderIrregular(t *testing.T) {
+	values := make(map[string][]byte)
+	a, b := bytes.Repeat([]byte{'a'}, 600), bytes.Repeat([]byte{'b'}, 600)
+	full := bytes.Repeat([]byte{'f'}, chunkSize)
+	chunkA, chunkB, chunkFull := putNode(values, chunkType, a), putNode(values, chunkType, b), putNode(values, chunkType, full)
+
+	for _, c := range []struct {
+		name string
+		root []byte
+		data []byte
+	}{
+		//deux chunks de 600 octets : la forme donnerait 1624
+		{"short chunks", putNode(values, bigFileType, chunkA, chunkB), append(append([]byte(nil), a...), b...)},
+		//un premier fils de hauteur 1 qui n'a que deux chunks : la forme donnerait 32*1024+600
+		{"short subtree", putNode(values, bigFileType, putNode(values, bigFileType, chunkFull, chunkFull), chunkA),
+			bytes.Join([][]byte{full, full, a}, nil)},
+	} {
+		fetched := 0
+		fr := NewFileReader(mapSource(values, &fetched))
+		if size, err := fr.SizeFromShape(c.root); err != errIrregularFile {
+			t.Fatalf("%v: SizeFromShape = %d, %v", c.name, size, err)
+		}
+		size, err := fr.Size(c.root)
+		if err != nil || size != int64(len(c.data)) {
+			t.Fatalf("%v: size %d (%v), want %d", c.name, size, err, len(c.data))
+		}
+		got, err := fr.ReadAt(c.root, 500, 200)
+		if err != nil || !bytes.Equal(got, c.data[500:700]) {
+			t.Fatalf("%v: ReadAt(500, 200) = %q, %v", c.name, got, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+//===================================================================================================
+//                                REJEU D'UNE CAPTURE
+//===================================================================================================
+
+// replay relit une capture (-capture) et repasse chaque datagramme dans les fonctions qui les traitent en
+// fonctionnement normal : décodage, vérification des signatures avec les clés échangées dans la capture,
+// association des réponses aux requêtes par Id, vérification des Datum, et réponse de getDatumReply aux
+// GetDatum reçus, comparée à celle qui avait été envoyée. Chaque problème est affiché ; le code de sortie
+// est 1 s'il y en a au moins un.
+
+type replayRequest struct {
+	time time.Time //date de la requête dans la capture
+	peer string
+	typ  byte
+	body []byte
+}
+
+type replayer struct {
+	keys     map[string]*ecdsa.PublicKey //clé publique de chaque adresse, apprise dans PublicKey ou PublicKeyReply
+	pending  map[string]replayRequest    //requêtes sans réponse, clé : adresse + Id
+	expected map[string][]byte           //réponses que serveRequest donne maintenant aux GetDatum reçus
+	problems int
+}
+
+func newReplayer() *replayer {
+	return &replayer{
+		keys:     make(map[string]*ecdsa.PublicKey),
+		pending:  make(map[string]replayRequest),
+		expected: make(map[string][]byte),
+	}
+}
+
+// replayReplies donne pour chaque requête le type de la réponse attendue
+var replayReplies = map[byte]byte{0: 128, 1: 129, 2: 130, 3: 131}
+
+// packet traite un datagramme de la capture et renvoie ce qu'on en conclut, avec problem vrai si c'est une erreur
+func (rp *replayer) packet(p capturedPacket) (verdict string, problem bool) {
+	var key *ecdsa.PublicKey
+	if p.Dir != captureSend {
+		key = rp.keys[p.Peer]
+	}
+	mess, err := parseMessage(p.Data, nil)
+	if err != nil {
+		return err.Error(), true
+	}
+	if key != nil && len(p.Data) > len(mess.Body)+7 { //signé : on vérifie avec la clé annoncée par le pair
+		if _, err := parseMessage(p.Data, key); err != nil {
+			return err.Error(), true
+		}
+	}
+	typ := mess.Type[0]
+	ref := p.Peer + "/" + string(mess.Id)
+	if _, ok := replayReplies[typ]; ok {
+		rp.pending[ref] = replayRequest{p.Time, p.Peer, typ, mess.Body}
+	}
+
+	switch typ {
+	case 0, 128: //Hello, HelloReply
+		if len(mess.Body) < 4 {
+			return "Hello without extensions", true
+		}
+		verdict = fmt.Sprintf("name %q", mess.Body[4:])
+	case 1, 129: //PublicKey, PublicKeyReply
+		if len(mess.Body) == 0 || bytes.Equal(mess.Body, make([]byte, 64)) {
+			verdict = "peer does not sign"
+			break
+		}
+		k, err := parsePublicKey(mess.Body)
+		if err != nil {
+			return err.Error(), true
+		}
+		if p.Dir != captureSend {
+			rp.keys[p.Peer] = k
+		}
+		verdict = "public key"
+	case 2: //Root
+		verdict = "root request"
+	case 130: //RootReply
+		if len(mess.Body) != 32 {
+			return fmt.Sprintf("root hash of %d bytes", len(mess.Body)), true
+		}
+		verdict = fmt.Sprintf("root %x", mess.Body)
+	case 3: //GetDatum
+		if len(mess.Body) != 32 {
+			return fmt.Sprintf("GetDatum for a hash of %d bytes", len(mess.Body)), true
+		}
+		verdict = fmt.Sprintf("GetDatum %x", mess.Body)
+		if p.Dir == captureRecv { //ce que nos fonctions répondent aujourd'hui à ce GetDatum, hors limites de débit
+			if reply, err := getDatumReply(p.Data); err == nil {
+				rp.expected[ref] = MessageToBytes(reply)
+			}
+		}
+	case 131, 132: //Datum, NoDatum
+		if len(mess.Body) < 32 {
+			return "reply without hash", true
+		}
+		if typ == 132 {
+			verdict = fmt.Sprintf("NoDatum %x", mess.Body[:32])
+		} else if !checkHash(mess) {
+			return fmt.Sprintf("Datum %x does not match its value", mess.Body[:32]), true
+		} else if err := checkDatum(mess.Body[32:]); err != nil {
+			return fmt.Sprintf("Datum %x: %v", mess.Body[:32], err), true
+		} else {
+			verdict = fmt.Sprintf("Datum %x, %d bytes", mess.Body[:32], len(mess.Body)-32)
+		}
+	case 133, 134: //demande de traversée de NAT, et sa transmission par le serveur
+		addr, err := parseNATAddress(mess.Body)
+		if err != nil {
+			return err.Error(), true
+		}
+		verdict = fmt.Sprintf("NAT traversal to %v", addr)
+	case 254: //Error
+		verdict = fmt.Sprintf("error %q", mess.Body)
+	default:
+		verdict = fmt.Sprintf("unknown type %d", typ)
+	}
+
+	if typ >= 128 && typ <= 132 { //réponses
+		req, ok := rp.pending[ref]
+		if !ok {
+			verdict += ", unsolicited"
+		} else {
+			if want := replayReplies[req.typ]; want != typ && !(req.typ == 3 && typ == 132) {
+				verdict += fmt.Sprintf(", but the request was of type %d", req.typ)
+				problem = true
+			} else if req.typ == 3 && !bytes.Equal(req.body, mess.Body[:32]) {
+				verdict += fmt.Sprintf(", but the request was for %x", req.body)
+				problem = true
+			}
+			delete(rp.pending, ref)
+		}
+	}
+	if want, ok := rp.expected[ref]; ok && p.Dir == captureSend && typ != 3 {
+		delete(rp.expected, ref)
+		if !bytes.Equal(want, p.Data) {
+			verdict += fmt.Sprintf(", but getDatumReply now answers %v", dissectLine(want))
+			problem = true
+		}
+	}
+	return verdict, problem
+}
+
+// unanswered renvoie les requêtes restées sans réponse, dans l'ordre de la capture
+func (rp *replayer) unanswered() []replayRequest {
+	reqs := make([]replayRequest, 0, len(rp.pending))
+	for _, req := range rp.pending {
+		reqs = append(reqs, req)
+	}
+	slices.SortStableFunc(reqs, func(a, b replayRequest) int { return a.time.Compare(b.time) })
+	return reqs
+}
+
+func replayMain(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: [-export ...] replay <capture.jsonl|capture.pcapng>\n")
+		return 2
+	}
+	packets, err := readCapture(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	initDatumStore()
+	initExports(nil)
+
+	rp := newReplayer()
+	for _, p := range packets {
+		verdict, problem := rp.packet(p)
+		mark := " "
+		if problem {
+			mark = "!"
+			rp.problems++
+		}
+		dir := p.Dir
+		if dir == "" {
+			dir = "?"
+		}
+		fmt.Printf("%v %v %v %-21v %v: %v\n", mark, p.Time.Format("15:04:05.000000"), dir, p.Peer, dissectLine(p.Data), verdict)
+	}
+	for _, req := range rp.unanswered() { //pertes ou fin de la capture : on le signale sans le compter
+		fmt.Printf("  %v request of type %d with %v got no reply\n", req.time.Format("15:04:05.000000"), req.typ, req.peer)
+	}
+	fmt.Printf("%d datagrams, %d problems\n", len(packets), rp.problems)
+	if rp.problems > 0 {
+		return 1
+	}
+	return 0
+}
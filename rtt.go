@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"sync"
+	"time"
+)
+
+//===================================================================================================
+//                                ESTIMATION DU RTT
+//===================================================================================================
+
+// Calcul du délai de retransmission comme TCP (RFC 6298) : on garde pour chaque pair une moyenne lissée
+// du RTT (srtt) et de sa variation (rttvar), et on attend srtt + 4*rttvar avant de retransmettre.
+// Règle de Karn : une réponse à une requête retransmise ne donne pas de mesure, on ne sait pas à quel envoi elle répond.
+
+var maxAttempts = flag.Int("max-attempts", 5, "number of times a request is sent before giving up")
+
+const (
+	initialRTO = 2000 * time.Millisecond //avant toute mesure, comme l'ancien délai fixe
+	minRTO     = 50 * time.Millisecond
+	maxRTO     = 10 * time.Second
+	rttAlpha   = 0.125
+	rttBeta    = 0.25
+)
+
+type rttEstimator struct {
+	peer    string //adresse du pair, étiquette de l'histogramme tp_rtt_seconds
+	mu      sync.Mutex
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	samples int
+}
+
+func newRTTEstimator() *rttEstimator {
+	return &rttEstimator{rto: initialRTO}
+}
+
+// sample prend en compte une nouvelle mesure de RTT
+func (e *rttEstimator) sample(rtt time.Duration) {
+	metrics.rtt.observe(e.peer, rtt.Seconds())
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = time.Duration((1-rttBeta)*float64(e.rttvar) + rttBeta*float64(diff))
+		e.srtt = time.Duration((1-rttAlpha)*float64(e.srtt) + rttAlpha*float64(rtt))
+	}
+	e.samples++
+	e.rto = clampRTO(e.srtt + 4*e.rttvar)
+}
+
+// backoff double le délai après un timeout, il reste doublé jusqu'à la prochaine mesure valide
+func (e *rttEstimator) backoff() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rto = clampRTO(2 * e.rto)
+}
+
+func (e *rttEstimator) timeout() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rto
+}
+
+func (e *rttEstimator) smoothed() (time.Duration, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt, e.rttvar
+}
+
+func clampRTO(rto time.Duration) time.Duration {
+	if rto < minRTO {
+		return minRTO
+	}
+	if rto > maxRTO {
+		return maxRTO
+	}
+	return rto
+}
+
+var rttTable = struct {
+	sync.Mutex
+	peers map[string]*rttEstimator
+}{peers: make(map[string]*rttEstimator)}
+
+// rttFor renvoie l'estimateur du pair à l'autre bout de conn
+func rttFor(addr net.Addr) *rttEstimator {
+	key := ""
+	if addr != nil {
+		key = addr.String()
+	}
+	rttTable.Lock()
+	defer rttTable.Unlock()
+	e, ok := rttTable.peers[key]
+	if !ok {
+		e = newRTTEstimator()
+		e.peer = key
+		rttTable.peers[key] = e
+	}
+	return e
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// scriptedConn répond à chaque lecture selon script : la réponse arrive après delay, ou la lecture expire si
+// reply est nil ; le temps passe sur clk
+type scriptedConn struct {
+	*sinkConn
+	clk      *stepClock
+	deadline time.Time
+	script   []scriptedRead
+}
+
+type scriptedRead struct {
+	delay time.Duration
+	reply []byte
+}
+
+func (c *scriptedConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	if len(c.script) == 0 || c.script[0].reply == nil {
+		if len(c.script) > 0 {
+			c.script = c.script[1:]
+		}
+		c.clk.now = c.deadline
+		return 0, simTimeout{}
+	}
+	r := c.script[0]
+	c.script = c.script[1:]
+	c.clk.Sleep(r.delay)
+	return copy(b, r.reply), nil
+}
+
+func TestRTTEstimator(t *testing.T) {
+	e := newRTTEstimator()
+	if e.timeout() != initialRTO {
+		t.Fatalf("rto %v before any sample, want %v", e.timeout(), initialRTO)
+	}
+	e.sample(100 * time.Millisecond)
+	if srtt, rttvar := e.smoothed(); srtt != 100*time.Millisecond || rttvar != 50*time.Millisecond || e.timeout() != 300*time.Millisecond {
+		t.Fatalf("first sample: srtt %v rttvar %v rto %v", srtt, rttvar, e.timeout())
+	}
+	e.sample(200 * time.Millisecond) //srtt 112.5ms, rttvar 62.5ms
+	if e.timeout() != 362500*time.Microsecond {
+		t.Fatalf("second sample: rto %v, want 362.5ms", e.timeout())
+	}
+
+	//bornes
+	for i := 0; i < 10; i++ {
+		e.backoff()
+	}
+	if e.timeout() != maxRTO {
+		t.Fatalf("rto %v after 10 backoffs, want %v", e.timeout(), maxRTO)
+	}
+	fast := newRTTEstimator()
+	fast.sample(time.Millisecond)
+	if fast.timeout() != minRTO {
+		t.Fatalf("rto %v for a 1ms RTT, want %v", fast.timeout(), minRTO)
+	}
+}
+
+func TestKarn(t *testing.T) {
+	quietLog(t)
+	clk := useLimits(t, 0, 0, 0, 0, 0)
+	rttTable.Lock()
+	rttTable.peers = make(map[string]*rttEstimator)
+	rttTable.Unlock()
+	savedAttempts := *maxAttempts
+	*maxAttempts = 3
+	defer func() { *maxAttempts = savedAttempts }()
+	listen := func(addr string, repeat bool, script ...scriptedRead) (*scriptedConn, *rttEstimator) {
+		conn := &scriptedConn{sinkConn: newSinkConn(addr), clk: clk}
+		request := NewMessage(newID(), []byte{2}, make([]byte, 32), nil)
+		for i := range script {
+			if script[i].reply != nil {
+				script[i].reply = MessageToBytes(NewMessage(request.Id, []byte{130}, make([]byte, 32), nil))
+			}
+		}
+		conn.script = script
+		MessageListener(conn, request, repeat, nil)
+		return conn, rttFor(conn.addr)
+	}
+	answer := func(d time.Duration) scriptedRead { return scriptedRead{d, []byte{}} }
+	timeout := scriptedRead{}
+
+	//réponse au premier envoi : une mesure
+	_, e := listen("192.0.2.1:1", true, answer(100*time.Millisecond))
+	if srtt, _ := e.smoothed(); srtt != 100*time.Millisecond {
+		t.Fatalf("srtt %v after an answer in 100ms", srtt)
+	}
+
+	//réponse après une retransmission : pas de mesure, le délai reste doublé
+	conn, e := listen("192.0.2.2:1", true, timeout, answer(100*time.Millisecond))
+	if conn.sent != 1 || e.samples != 0 || e.timeout() != 2*initialRTO {
+		t.Fatalf("%d retransmissions, %d samples, rto %v", conn.sent, e.samples, e.timeout())
+	}
+
+	//sans retransmission on attend plus longtemps sans doubler le délai du pair
+	start := clk.now
+	conn, e = listen("192.0.2.3:1", false, timeout, timeout, timeout)
+	if conn.sent != 0 || e.timeout() != initialRTO {
+		t.Fatalf("%d retransmissions, rto %v after waiting without repeating", conn.sent, e.timeout())
+	}
+	if waited := clk.now.Sub(start); waited != 7*initialRTO { //2s, 4s puis 8s
+		t.Fatalf("waited %v in total, want %v", waited, 7*initialRTO)
+	}
+
+	//le dernier timeout ne double pas le délai : rien n'est réémis
+	conn, e = listen("192.0.2.4:1", true, timeout, timeout, timeout)
+	if conn.sent != 2 || e.timeout() != 4*initialRTO {
+		t.Fatalf("%d retransmissions, rto %v after giving up", conn.sent, e.timeout())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+//===================================================================================================
+//                                NOMS ET CHEMINS SURS
+//===================================================================================================
+
+// Les noms des entrées de directory viennent du pair distant : on ne leur fait pas confiance,
+// un nom comme "../../.bashrc" ou "a/b" ne doit jamais sortir du dossier de téléchargement.
+
+// noms réservés par Windows, refusés pour que le dossier téléchargé reste utilisable partout
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkEntryName vérifie qu'un nom d'entrée reçu peut être utilisé tel quel comme nom de fichier
+func checkEntryName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if name == "." || name == ".." {
+		return fmt.Errorf("reserved name")
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("invalid UTF-8")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("control character in name")
+		}
+		if r == '/' || r == '\\' {
+			return fmt.Errorf("path separator in name")
+		}
+	}
+	if reservedNames[strings.ToUpper(strings.SplitN(name, ".", 2)[0])] {
+		return fmt.Errorf("reserved name")
+	}
+	return nil
+}
+
+// filterEntries garde les entrées dont le nom est sûr et qui n'apparaissent qu'une fois, majuscules et minuscules
+// confondues (sur un système de fichiers insensible à la casse "A" écraserait "a"), et renvoie la liste des
+// entrées refusées avec la raison
+func filterEntries(entries []dirEntry) ([]dirEntry, []string) {
+	ok := make([]dirEntry, 0, len(entries))
+	rejected := make([]string, 0)
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		if err := checkEntryName(e.Name); err != nil {
+			rejected = append(rejected, fmt.Sprintf("%q: %v", e.Name, err))
+			continue
+		}
+		folded := strings.ToLower(e.Name)
+		if seen[folded] {
+			rejected = append(rejected, fmt.Sprintf("%q: duplicate entry", e.Name))
+			continue
+		}
+		seen[folded] = true
+		ok = append(ok, e)
+	}
+	return ok, rejected
+}
+
+// insideDir vérifie que path reste dans root, y compris en suivant les liens symboliques déjà présents
+func insideDir(root string, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("%v is outside of %v", path, root)
+	}
+	if rel == "." { //root lui-même, même s'il existe déjà
+		return nil
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil //root n'existe pas encore, il ne contient donc pas de lien
+	}
+	//on remonte jusqu'au premier parent existant et on vérifie où il mène réellement
+	existing := filepath.Dir(filepath.Clean(path))
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			rel, err = filepath.Rel(realRoot, real)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("%v leads outside of %v", path, root)
+			}
+			return nil
+		}
+		if existing == filepath.Dir(existing) {
+			return nil
+		}
+		existing = filepath.Dir(existing)
+	}
+}
+
+// download regroupe l'état d'un téléchargement de dossier
+type download struct {
+	root     string   //dossier hors duquel on n'écrit jamais
+	manifest []string //lignes du manifeste (voir verify.go)
+	rejected []string //entrées refusées, avec leur chemin
+	failed   []string //fichiers dont le téléchargement a échoué
+}
+
+func newDownload(root string) *download {
+	return &download{root, make([]string, 0), make([]string, 0), make([]string, 0)}
+}
+
+func (dl *download) reject(where string, reason string) {
+	slog.Warn("Rejected entry", "path", where, "reason", reason)
+	dl.rejected = append(dl.rejected, where+": "+reason)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckEntryName(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		ok   bool
+	}{
+		{"file.txt", true},
+		{".hidden", true},
+		{"été ☀", true},
+		{"CONSOLE", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"/", false},
+		{"../etc", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"a\x00b", false},
+		{"a\nb", false},
+		{"a\x7fb", false},
+		{"\xff\xfe", false},
+		{"CON", false},
+		{"nul.txt", false},
+		{"Com1", false},
+		{"lpt9.tar.gz", false},
+	} {
+		if err := checkEntryName(c.name); (err == nil) != c.ok {
+			t.Errorf("%q: checkEntryName = %v", c.name, err)
+		}
+	}
+}
+
+func TestFilterEntries(t *testing.T) {
+	entries := make([]dirEntry, 0)
+	for _, name := range []string{"a", "..", "b", "a", "A", "c/d", "B.txt", "b.TXT"} {
+		entries = append(entries, dirEntry{Name: name, Hash: make([]byte, 32)})
+	}
+	ok, rejected := filterEntries(entries)
+	names := make([]string, 0, len(ok))
+	for _, e := range ok {
+		names = append(names, e.Name)
+	}
+	if fmt.Sprint(names) != "[a b B.txt]" {
+		t.Fatalf("kept %v", names)
+	}
+	if len(rejected) != 5 {
+		t.Fatalf("rejected %v, want 5 entries", rejected)
+	}
+}
+
+func TestInsideDir(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, d := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Skipf("symlinks not available: %v", err)
+	}
+	for _, c := range []struct {
+		path string
+		ok   bool
+	}{
+		{root, true},
+		{filepath.Join(root, "file"), true},
+		{filepath.Join(root, "sub", "file"), true},
+		{filepath.Join(root, "new", "dir", "file"), true}, //parents pas encore créés
+		{filepath.Join(root, "..", "file"), false},
+		{filepath.Join(root, "sub", "..", "..", "outside", "file"), false},
+		{outside, false},
+		{filepath.Join(root, "escape", "file"), false}, //le parent est un lien vers l'extérieur
+		{filepath.Join(root, "escape", "new", "file"), false},
+	} {
+		if err := insideDir(root, c.path); (err == nil) != c.ok {
+			t.Errorf("%v: insideDir = %v", c.path, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+)
+
+//===================================================================================================
+//                                REPONSES AUX GETDATUM
+//===================================================================================================
+
+// serveRequest traite un paquet reçu pendant que l'on attend autre chose : si c'est un GetDatum,
+// on répond Datum avec ce que l'on exporte ou ce que l'on a dans le stockage (si la politique de redistribution l'autorise),
+// NoDatum sinon ; à un Root, on répond RootReply avec notre racine ; un RootReply à une annonce de notre racine
+// (voir export.go) est absorbé. On renvoie alors vrai pour que l'appelant continue d'attendre sa réponse. Le paquet
+// a déjà passé admitDatagram (voir limits.go) ; une réponse au-delà des octets de Datum de l'adresse, ou de ce qu'on
+// peut envoyer à une adresse non validée, n'est pas envoyée.
+func serveRequest(conn Transport, packet []byte) bool {
+	if len(packet) < 7 {
+		return false
+	}
+	switch packet[4] {
+	case 2: //Root
+		return serveRoot(conn, packet)
+	case 130: //RootReply
+		return announceReplied(packet[:4])
+	case 3: //GetDatum
+	default:
+		return false
+	}
+	from := conn.RemoteAddr()
+	reply, err := getDatumReply(packet)
+	if err != nil {
+		slog.Debug("Ignoring malformed GetDatum", peerAttr(from), idAttr(packet[:4]), "err", err)
+		strike(from, err)
+		return true //GetDatum mal formé, on l'ignore
+	}
+	found := reply.Type[0] == 131
+	slog.Debug("GetDatum", peerAttr(from), idAttr(reply.Id), hashAttr(reply.Body[:32]), "found", found)
+	if found {
+		value := len(reply.Body) - 32
+		if !admitDatum(from, value) {
+			return true
+		}
+	}
+	if !admitReply(from, 7+len(reply.Body)) {
+		return true
+	}
+	if found {
+		metrics.datumsServed.inc("datum")
+		metrics.bytesServed.add("", uint64(len(reply.Body)-32))
+	} else {
+		metrics.datumsServed.inc("nodatum")
+	}
+	MessageSender(conn, reply)
+	return true
+}
+
+// serveRoot répond RootReply à un Root : le pair nous donne sa racine et demande la nôtre
+func serveRoot(conn Transport, packet []byte) bool {
+	from := conn.RemoteAddr()
+	reply := rootReply(packet[:4])
+	slog.Debug("Root", peerAttr(from), idAttr(reply.Id), hashAttr(reply.Body))
+	if !admitReply(from, len(MessageToBytes(reply))) {
+		return true
+	}
+	MessageSender(conn, reply)
+	return true
+}
+
+// awaitsRoot dit si packet est le Root qui suit notre PublicKeyReply dans la poignée de main
+// (Hello, PublicKey, Root) : c'est alors la réponse attendue, pas une requête à servir
+func awaitsRoot(sended Message, packet []byte) bool {
+	return sended.Type[0] == 129 && len(packet) >= 5 && packet[4] == 2
+}
+
+var errBadGetDatum = errors.New("GetDatum body is not a 32-byte hash")
+
+// getDatumReply construit la réponse au GetDatum packet : Datum si on a le noeud et qu'on peut le donner, NoDatum sinon
+func getDatumReply(packet []byte) (Message, error) {
+	length := int(binary.BigEndian.Uint16(packet[5:7]))
+	if length != 32 || len(packet) < 7+32 {
+		return Message{}, errBadGetDatum
+	}
+	id := append([]byte(nil), packet[:4]...) //copies : NewMessage et MessageToBytes ne doivent pas écrire dans le tampon de lecture
+	hash := append([]byte(nil), packet[7:7+32]...)
+
+	Type := make([]byte, 1)
+	value, ok := exports.get(hash) //d'abord ce que l'on exporte, puis ce que l'on a téléchargé
+	if !ok {
+		var peer string
+		value, peer, ok = datums.get(hash)
+		ok = ok && reserveAllowed(peer)
+	}
+	if !ok {
+		Type[0] = 132 //NoDatum
+		return NewMessage(id, Type, hash, nil), nil
+	}
+	Type[0] = 131 //Datum
+	body := append(append(make([]byte, 0, 32+len(value)), hash...), value...)
+	return NewMessage(id, Type, body, nil), nil
+}
+
+// serveFor répond aux requêtes reçues sur conn pendant d, à la place d'un simple time.Sleep ;
+// rend la main plus tôt si ctx est annulé (la socket est alors fermée par son propriétaire)
+func serveFor(ctx context.Context, conn Transport, d time.Duration) {
+	end := clock.Now().Add(d)
+	messB := make([]byte, 1064+64)
+	for clock.Now().Before(end) && ctx.Err() == nil {
+		err := conn.SetReadDeadline(end)
+		if err != nil {
+			if ctx.Err() == nil {
+				clock.Sleep(end.Sub(clock.Now()))
+			}
+			return
+		}
+		n, err := conn.Read(messB)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() || ctx.Err() != nil {
+				return
+			}
+			clock.Sleep(end.Sub(clock.Now())) //socket en erreur : on se contente d'attendre
+			return
+		}
+		countDatagram(metrics.received, messB[:n])
+		if admitDatagram(conn.RemoteAddr(), messB[:n]) {
+			serveRequest(conn, messB[:n])
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//===================================================================================================
+//                                ARRET PROPRE
+//===================================================================================================
+
+// SIGINT ou SIGTERM annule le contexte donné aux boucles (Hello périodiques, navigation, téléchargements,
+// mirror, swarm, passerelle). Les sockets sont fermées, ce qui interrompt les lectures en cours ; les
+// téléchargements s'arrêtent en gardant ce qui a été reçu (.part, manifeste, stockage des Datum) et le
+// processus sort avec le code 128 + numéro du signal. Un second signal le termine immédiatement.
+
+type signalError struct {
+	sig os.Signal
+}
+
+func (e signalError) Error() string {
+	return "interrupted by " + e.sig.String()
+}
+
+// shutdownContext renvoie un contexte annulé au premier SIGINT ou SIGTERM, ou par cancel
+func shutdownContext() (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			slog.Info("Shutting down", "signal", sig.String())
+			cancel(signalError{sig})
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs) //le signal suivant a son effet par défaut
+	}()
+	return ctx, cancel
+}
+
+// exitStatus renvoie 128 + numéro du signal si ctx a été annulé par un signal, status sinon
+func exitStatus(ctx context.Context, status int) int {
+	var se signalError
+	if errors.As(context.Cause(ctx), &se) {
+		if sig, ok := se.sig.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+	}
+	return status
+}
+
+// closeOnCancel ferme conn dès que ctx est annulé, ce qui débloque une lecture en cours ;
+// la fonction renvoyée l'empêche si la session est fermée normalement avant
+func closeOnCancel(ctx context.Context, conn Transport) func() bool {
+	return context.AfterFunc(ctx, func() { conn.Close() })
+}
+
+// sleepContext attend d, renvoie faux si ctx est annulé avant
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+//===================================================================================================
+// lecture interruptible de l'entrée standard
+
+// Une lecture de os.Stdin ne peut pas être annulée : un seul goroutine lit les lignes et les menus
+// les attendent avec readLine, qui rend la main à l'annulation du contexte.
+
+var stdin struct {
+	once  sync.Once
+	lines chan string
+}
+
+func readLine(ctx context.Context) (string, error) {
+	stdin.once.Do(func() {
+		stdin.lines = make(chan string)
+		go func() {
+			scanner := bufio.NewScanner(os.Stdin)
+			for scanner.Scan() {
+				stdin.lines <- scanner.Text()
+			}
+			close(stdin.lines)
+		}()
+	})
+	select {
+	case line, ok := <-stdin.lines:
+		if !ok {
+			return "", io.EOF
+		}
+		return line, nil
+	case <-ctx.Done():
+		return "", context.Cause(ctx)
+	}
+}
+
+// readNumber lit un entier sur une ligne, -1 si la ligne n'en est pas un
+func readNumber(ctx context.Context) (int, error) {
+	line, err := readLine(ctx)
+	if err != nil {
+		return -1, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return -1, nil
+	}
+	return n, nil
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//===================================================================================================
+//                                RESEAU SIMULE
+//===================================================================================================
+
+// simNet est un réseau UDP en mémoire piloté par des événements : un paquet envoyé est programmé pour
+// arriver à now+latence, et le temps n'avance que lorsqu'un lecteur attend (Read) ou dort (Sleep).
+// Les pertes, doublons, retards et réordonnancements sont tirés d'un générateur initialisé par seed :
+// deux exécutions avec la même graine voient exactement le même réseau.
+
+type simNet struct {
+	mu  sync.Mutex
+	now time.Time
+	rng *rand.Rand
+
+	Loss    float64       //probabilité de perdre un paquet
+	Dup     float64       //probabilité de le dupliquer
+	Reorder float64       //probabilité de le retarder de 3 latences, après ceux envoyés ensuite
+	Latency time.Duration //délai d'acheminement
+	Jitter  time.Duration //variation aléatoire ajoutée au délai
+
+	queue     []*simPacket
+	seq       int
+	endpoints map[string]*simEndpoint //clé : adresse interne
+	nats      map[string]*simNAT      //clé : adresse IP publique
+
+	Sent, Dropped, Duplicated, Filtered int
+}
+
+type simPacket struct {
+	at       time.Time
+	seq      int
+	from, to *net.UDPAddr
+	data     []byte
+}
+
+// simHandler reçoit les paquets d'un pair simulé ; send répond à l'expéditeur
+type simHandler func(from *net.UDPAddr, packet []byte, send func(to *net.UDPAddr, data []byte))
+
+type simEndpoint struct {
+	node    *simNode
+	addr    *net.UDPAddr
+	conn    *simConn   //socket connectée de l'implémentation testée
+	handler simHandler //ou pair simulé
+}
+
+func newSimNet(seed int64) *simNet {
+	return &simNet{
+		now:       time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		rng:       rand.New(rand.NewSource(seed)),
+		Latency:   20 * time.Millisecond,
+		endpoints: make(map[string]*simEndpoint),
+		nats:      make(map[string]*simNAT),
+	}
+}
+
+// simNet est aussi l'horloge du protocole pendant les tests
+func (sn *simNet) Now() time.Time {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	return sn.now
+}
+
+func (sn *simNet) Sleep(d time.Duration) {
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	sn.runUntil(sn.now.Add(d), nil)
+	sn.now = sn.now.Add(d)
+}
+
+// simNode est une machine du réseau, éventuellement derrière un NAT
+type simNode struct {
+	sn       *simNet
+	ip       net.IP
+	nat      *simNAT
+	nextPort int
+}
+
+func (sn *simNet) Node(ip string, nat *simNAT) *simNode {
+	if nat != nil {
+		sn.nats[nat.ip.String()] = nat
+	}
+	return &simNode{sn: sn, ip: net.ParseIP(ip), nat: nat, nextPort: 40000}
+}
+
+// Listen installe un pair simulé sur port et renvoie son adresse publique (celle du NAT s'il y en a un,
+// avec un port qui ne sera ouvert qu'au premier paquet sortant)
+func (n *simNode) Listen(port int, h simHandler) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: n.ip, Port: port}
+	n.sn.endpoints[addr.String()] = &simEndpoint{node: n, addr: addr, handler: h}
+	return addr
+}
+
+// Dial ouvre une socket connectée à remote, comme net.DialUDP
+func (n *simNode) Dial(remote string) (Transport, error) {
+	raddr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, err
+	}
+	n.sn.mu.Lock()
+	defer n.sn.mu.Unlock()
+	n.nextPort++
+	addr := &net.UDPAddr{IP: n.ip, Port: n.nextPort}
+	c := &simConn{sn: n.sn, local: addr, remote: raddr}
+	ep := &simEndpoint{node: n, addr: addr, conn: c}
+	c.ep = ep
+	n.sn.endpoints[addr.String()] = ep
+	return c, nil
+}
+
+// send programme l'envoi de data de ep vers to, sn.mu doit être pris
+func (sn *simNet) send(ep *simEndpoint, to *net.UDPAddr, data []byte) {
+	from := ep.addr
+	if ep.node.nat != nil {
+		from = ep.node.nat.outbound(ep.addr, to)
+	}
+	sn.Sent++
+	if sn.rng.Float64() < sn.Loss {
+		sn.Dropped++
+		return
+	}
+	copies := 1
+	if sn.rng.Float64() < sn.Dup {
+		sn.Duplicated++
+		copies = 2
+	}
+	for i := 0; i < copies; i++ {
+		delay := sn.Latency
+		if sn.Jitter > 0 {
+			delay += time.Duration(sn.rng.Int63n(int64(sn.Jitter)))
+		}
+		if sn.rng.Float64() < sn.Reorder {
+			delay += 3 * sn.Latency
+		}
+		sn.seq++
+		sn.queue = append(sn.queue, &simPacket{sn.now.Add(delay), sn.seq, from, to, append([]byte(nil), data...)})
+	}
+	sort.Slice(sn.queue, func(i, j int) bool {
+		if sn.queue[i].at.Equal(sn.queue[j].at) {
+			return sn.queue[i].seq < sn.queue[j].seq
+		}
+		return sn.queue[i].at.Before(sn.queue[j].at)
+	})
+}
+
+// deliver remet un paquet à son destinataire, sn.mu doit être pris
+func (sn *simNet) deliver(p *simPacket) {
+	to := p.to
+	if nat, ok := sn.nats[p.to.IP.String()]; ok {
+		inside, ok := nat.inbound(p.to.Port, p.from)
+		if !ok {
+			sn.Filtered++
+			return
+		}
+		to = inside
+	}
+	ep, ok := sn.endpoints[to.String()]
+	if !ok {
+		return
+	}
+	if ep.conn != nil {
+		if ep.conn.closed || ep.conn.remote.String() != p.from.String() { //socket connectée : on ignore les autres
+			return
+		}
+		ep.conn.inbox = append(ep.conn.inbox, p.data)
+		return
+	}
+	ep.handler(p.from, p.data, func(to *net.UDPAddr, data []byte) { sn.send(ep, to, data) })
+}
+
+// runUntil délivre les paquets jusqu'à end, ou jusqu'à ce que c ait un paquet à lire ; sn.mu doit être pris
+func (sn *simNet) runUntil(end time.Time, c *simConn) {
+	for len(sn.queue) > 0 && !sn.queue[0].at.After(end) {
+		if c != nil && len(c.inbox) > 0 {
+			return
+		}
+		p := sn.queue[0]
+		sn.queue = sn.queue[1:]
+		if p.at.After(sn.now) {
+			sn.now = p.at
+		}
+		sn.deliver(p)
+	}
+}
+
+// simConn est le Transport donné à l'implémentation testée
+type simConn struct {
+	sn       *simNet
+	ep       *simEndpoint
+	local    *net.UDPAddr
+	remote   *net.UDPAddr
+	inbox    [][]byte
+	deadline time.Time
+	closed   bool
+}
+
+type simTimeout struct{}
+
+func (simTimeout) Error() string   { return "i/o timeout (simulated)" }
+func (simTimeout) Timeout() bool   { return true }
+func (simTimeout) Temporary() bool { return true }
+
+var errSimIdle = errors.New("read without deadline on an idle simulated network")
+
+func (c *simConn) Read(b []byte) (int, error) {
+	c.sn.mu.Lock()
+	defer c.sn.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	end := c.deadline
+	if end.IsZero() {
+		end = c.sn.now.Add(time.Hour) //personne ne répondra plus tard que ça
+	}
+	c.sn.runUntil(end, c)
+	if len(c.inbox) > 0 {
+		n := copy(b, c.inbox[0])
+		c.inbox = c.inbox[1:]
+		return n, nil
+	}
+	if c.deadline.IsZero() {
+		return 0, errSimIdle
+	}
+	if c.sn.now.Before(end) {
+		c.sn.now = end
+	}
+	return 0, simTimeout{}
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	c.sn.mu.Lock()
+	defer c.sn.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.sn.send(c.ep, c.remote, b)
+	return len(b), nil
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *simConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *simConn) Close() error {
+	c.sn.mu.Lock()
+	defer c.sn.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+//===================================================================================================
+//                                NAT SIMULE
+//===================================================================================================
+
+// Comportements d'un NAT (RFC 4787) pour l'attribution des ports publics et le filtrage des paquets entrants
+const (
+	natEndpointIndependent = "endpoint" //même port public quelle que soit la destination / tout paquet entrant accepté
+	natAddressDependent    = "address"  //selon l'adresse IP distante
+	natPortDependent       = "port"     //selon l'adresse IP et le port distants
+)
+
+type simNAT struct {
+	ip        net.IP
+	mapping   string
+	filtering string
+	nextPort  int
+	out       map[string]*simMapping
+	in        map[int]*simMapping
+}
+
+type simMapping struct {
+	inside    *net.UDPAddr
+	public    *net.UDPAddr
+	contacted map[string]bool //adresses (ou adresses:ports) vers lesquelles on a envoyé
+}
+
+func newSimNAT(ip string, mapping, filtering string) *simNAT {
+	return &simNAT{ip: net.ParseIP(ip), mapping: mapping, filtering: filtering, nextPort: 50000,
+		out: make(map[string]*simMapping), in: make(map[int]*simMapping)}
+}
+
+func natKey(behaviour string, addr *net.UDPAddr) string {
+	switch behaviour {
+	case natAddressDependent:
+		return addr.IP.String()
+	case natPortDependent:
+		return addr.String()
+	}
+	return ""
+}
+
+// outbound renvoie l'adresse publique d'un paquet de inside vers remote, en créant la correspondance
+func (nat *simNAT) outbound(inside, remote *net.UDPAddr) *net.UDPAddr {
+	key := inside.String() + "|" + natKey(nat.mapping, remote)
+	m, ok := nat.out[key]
+	if !ok {
+		nat.nextPort++
+		m = &simMapping{inside: inside, public: &net.UDPAddr{IP: nat.ip, Port: nat.nextPort}, contacted: make(map[string]bool)}
+		nat.out[key] = m
+		nat.in[m.public.Port] = m
+	}
+	m.contacted[natKey(nat.filtering, remote)] = true
+	return m.public
+}
+
+// inbound renvoie l'adresse interne d'un paquet arrivé de remote sur le port public, s'il passe le filtrage
+func (nat *simNAT) inbound(port int, remote *net.UDPAddr) (*net.UDPAddr, bool) {
+	m, ok := nat.in[port]
+	if !ok {
+		return nil, false
+	}
+	if nat.filtering != natEndpointIndependent && !m.contacted[natKey(nat.filtering, remote)] {
+		return nil, false
+	}
+	return m.inside, true
+}
+
+//===================================================================================================
+//                                PAIR SIMULE
+//===================================================================================================
+
+// simPeer répond comme un pair du protocole à partir d'un arbre de Merkle en mémoire
+type simPeer struct {
+	root    []byte
+	values  map[string][]byte //hash -> valeur
+	greet   bool              //envoie son propre Hello avant le HelloReply aux adresses qui ont demandé une traversée de NAT
+	server  *net.UDPAddr      //serveur dont il accepte les demandes de traversée de NAT
+	punched map[string]bool   //adresses IP vers lesquelles on a ouvert le NAT
+
+	Requests int //GetDatum reçus
+}
+
+func newSimPeer(tree *MerkleNode) *simPeer {
+	index := make(map[string]*MerkleNode)
+	IndexTree(tree, index)
+	values := make(map[string][]byte, len(index))
+	for h, n := range index {
+		values[h] = n.Value
+	}
+	return &simPeer{root: tree.Hash, values: values}
+}
+
+func simMessage(id []byte, typ byte, body []byte) []byte {
+	return MessageToBytes(NewMessage(append([]byte(nil), id...), []byte{typ}, body, nil))
+}
+
+func (p *simPeer) handle(from *net.UDPAddr, packet []byte, send func(*net.UDPAddr, []byte)) {
+	if len(packet) < 7 {
+		return
+	}
+	id, typ := packet[:4], packet[4]
+	length := int(binary.BigEndian.Uint16(packet[5:7]))
+	if len(packet) < 7+length {
+		return
+	}
+	body := packet[7 : 7+length]
+	switch typ {
+	case 0: //Hello
+		if p.greet && p.punched[from.IP.String()] { //NATTravMessage attend notre Hello, puis sa réponse
+			send(from, simMessage([]byte{1, 2, 3, 4}, 0, append(make([]byte, 4), "sim"...)))
+			send(from, simMessage(id, 128, body))
+			return
+		}
+		send(from, simMessage(id, 128, body))
+		send(from, simMessage([]byte{5, 6, 7, 8}, 1, make([]byte, 64))) //PublicKey
+	case 129: //PublicKeyReply
+		send(from, simMessage([]byte{9, 10, 11, 12}, 2, p.root)) //Root
+	case 2: //Root
+		send(from, simMessage(id, 130, p.root))
+	case 3: //GetDatum
+		p.Requests++
+		if value, ok := p.values[string(body)]; ok {
+			send(from, simMessage(id, 131, append(append([]byte(nil), body...), value...)))
+		} else {
+			send(from, simMessage(id, 132, body))
+		}
+	case 134: //demande de traversée relayée par le serveur : on ouvre notre NAT vers le demandeur
+		to, err := parseNATAddress(body)
+		if p.server != nil && from.String() == p.server.String() && err == nil {
+			if p.punched == nil {
+				p.punched = make(map[string]bool)
+			}
+			p.punched[to.IP.String()] = true
+			send(to, simMessage([]byte{1, 2, 3, 4}, 0, append(make([]byte, 4), "sim"...)))
+		}
+	}
+}
+
+// simServer relaie les demandes de traversée de NAT (133) au pair visé, avec l'adresse du demandeur (134)
+func simServer(from *net.UDPAddr, packet []byte, send func(*net.UDPAddr, []byte)) {
+	if len(packet) < 7 || packet[4] != 133 {
+		return
+	}
+	mess, err := parseMessage(packet, nil)
+	if err != nil {
+		return
+	}
+	target, err := parseNATAddress(mess.Body)
+	if err != nil {
+		return
+	}
+	requester := append(append([]byte(nil), from.IP.To4()...), byte(from.Port>>8), byte(from.Port))
+	send(target, simMessage(packet[:4], 134, requester))
+}
+
+// simDirectory est l'annuaire REST des pairs simulés : liste des noms dans l'ordre donné, racine et adresse
+type simDirectory struct {
+	names []string
+	roots map[string]func() []byte
+	addrs map[string]*net.UDPAddr
+}
+
+func (d *simDirectory) add(name string, addr *net.UDPAddr, root func() []byte) {
+	d.names = append(d.names, name)
+	d.roots[name] = root
+	d.addrs[name] = addr
+}
+
+func (d *simDirectory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, what, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/peers/"), "/")
+	switch {
+	case r.URL.Path == "/peers/":
+		for _, n := range d.names {
+			fmt.Fprintf(w, "%v\n", n)
+		}
+	case what == "root" && d.roots[name] != nil:
+		w.Write(d.roots[name]())
+	case what == "addresses" && d.addrs[name] != nil:
+		fmt.Fprintf(w, "%v\n", d.addrs[name])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// useSimDirectory sert un annuaire REST et y dirige jchPeersAddr jusqu'à la fin du test ; le client
+// renvoyé sait lui parler
+func useSimDirectory(t *testing.T) (*simDirectory, http.Client) {
+	d := &simDirectory{roots: make(map[string]func() []byte), addrs: make(map[string]*net.UDPAddr)}
+	server := httptest.NewServer(d)
+	saved := jchPeersAddr
+	jchPeersAddr = server.URL + "/peers/"
+	t.Cleanup(func() {
+		jchPeersAddr = saved
+		server.Close()
+	})
+	return d, *server.Client()
+}
+
+// useSimNet remplace le transport et l'horloge du protocole par sn, pour les connexions ouvertes depuis
+// node, et remet à zéro ce qui a été appris des pairs ; la fonction renvoyée rétablit l'état précédent
+func useSimNet(sn *simNet, node *simNode) func() {
+	oldDial, oldClock, oldAttempts := dialTransport, clock, *maxAttempts
+	dialTransport = node.Dial
+	clock = sn
+	rttTable.Lock()
+	rttTable.peers = make(map[string]*rttEstimator)
+	rttTable.Unlock()
+	windowTable.Lock()
+	windowTable.peers = make(map[string]*congestionWindow)
+	windowTable.Unlock()
+	inbound.Lock()
+	inbound.sources = make(map[string]*sourceState)
+	inbound.bandwidth = tokenBucket{}
+	inbound.Unlock()
+	return func() {
+		dialTransport, clock, *maxAttempts = oldDial, oldClock, oldAttempts
+	}
+}
+
+func (sn *simNet) String() string {
+	return fmt.Sprintf("%d sent, %d dropped, %d duplicated, %d filtered, t=%v", sn.Sent, sn.Dropped, sn.Duplicated, sn.Filtered, sn.now.Format("15:04:05.000"))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===================================================================================================
+//                                STOCKAGE DES DATUM
+//===================================================================================================
+
+// Tous les Datum reçus pendant un téléchargement sont gardés dans <store-dir>/<pair>/<hash en hexa>,
+// ce qui nous permet de répondre à notre tour aux GetDatum pour ces hash (voir server.go). Un fichier
+// modifié sur le disque n'est jamais redonné : son contenu est revérifié contre son nom à chaque lecture.
+// La place occupée est limitée par -store-quota : les Datum utilisés le moins récemment sont supprimés.
+
+var storeDir = flag.String("store-dir", ".datums", "directory where received datums are kept")
+var storeQuota = flag.Int64("store-quota", 64<<20, "maximum size in bytes of the datum store (0 disables it)")
+var reservePeers = flag.String("reserve", "all", "comma separated peers whose data we serve again, \"all\" or \"none\"")
+
+type storedDatum struct {
+	peer    string //pair dont vient le Datum
+	size    int64
+	lastUse time.Time
+}
+
+type datumStore struct {
+	mu     sync.Mutex
+	dir    string
+	quota  int64
+	total  int64
+	datums map[string]*storedDatum //clé : string(hash)
+}
+
+// datums est le stockage utilisé par les téléchargements et par le serveur, nil s'il est désactivé
+var datums *datumStore
+
+// openDatumStore charge l'index des Datum déjà présents dans dir
+func openDatumStore(dir string, quota int64) *datumStore {
+	st := &datumStore{dir: dir, quota: quota, datums: make(map[string]*storedDatum)}
+	peers, err := os.ReadDir(dir)
+	if err != nil {
+		return st
+	}
+	for _, p := range peers {
+		if !p.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(dir + "/" + p.Name())
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			hash, err := hex.DecodeString(f.Name())
+			info, errInfo := f.Info()
+			if err != nil || len(hash) != 32 || errInfo != nil {
+				continue
+			}
+			st.datums[string(hash)] = &storedDatum{p.Name(), info.Size(), info.ModTime()}
+			st.total += info.Size()
+		}
+	}
+	st.mu.Lock()
+	st.evict()
+	st.mu.Unlock()
+	return st
+}
+
+func (st *datumStore) path(peer string, hash []byte) string {
+	return st.dir + "/" + peer + "/" + hex.EncodeToString(hash)
+}
+
+// put garde la valeur (octet de type compris) du noeud hash reçu de peer
+func (st *datumStore) put(peer string, hash []byte, value []byte) {
+	if st == nil || checkEntryName(peer) != nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if d, ok := st.datums[string(hash)]; ok {
+		d.lastUse = clock.Now()
+		return
+	}
+	err := os.MkdirAll(st.dir+"/"+peer, 0755)
+	if err == nil {
+		err = os.WriteFile(st.path(peer, hash), value, 0644)
+	}
+	if err != nil {
+		slog.Warn("Datum store", "peer", peer, hashAttr(hash), "err", err)
+		return
+	}
+	st.datums[string(hash)] = &storedDatum{peer, int64(len(value)), clock.Now()}
+	st.total += int64(len(value))
+	st.evict()
+}
+
+// get renvoie la valeur du noeud hash et le pair d'où elle vient
+func (st *datumStore) get(hash []byte) ([]byte, string, bool) {
+	if st == nil {
+		return nil, "", false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d, ok := st.datums[string(hash)]
+	if !ok {
+		return nil, "", false
+	}
+	value, err := os.ReadFile(st.path(d.peer, hash))
+	if err == nil {
+		if sum := sha256.Sum256(value); !bytes.Equal(sum[:], hash) {
+			slog.Warn("Datum store: corrupted file removed", "peer", d.peer, hashAttr(hash))
+			err = errBadHash
+		}
+	}
+	if err != nil {
+		st.remove(string(hash), d)
+		return nil, "", false
+	}
+	d.lastUse = clock.Now()
+	return value, d.peer, true
+}
+
+// remove supprime le Datum h du disque et de l'index, st.mu doit être pris
+func (st *datumStore) remove(h string, d *storedDatum) {
+	os.Remove(st.path(d.peer, []byte(h)))
+	st.total -= d.size
+	delete(st.datums, h)
+}
+
+// evict supprime les Datum les moins récemment utilisés jusqu'à repasser sous le quota, st.mu doit être pris
+func (st *datumStore) evict() {
+	if st.total <= st.quota {
+		return
+	}
+	hashes := make([]string, 0, len(st.datums))
+	for h := range st.datums {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return st.datums[hashes[i]].lastUse.Before(st.datums[hashes[j]].lastUse)
+	})
+	for _, h := range hashes {
+		if st.total <= st.quota {
+			break
+		}
+		st.remove(h, st.datums[h])
+	}
+}
+
+// reserveAllowed indique si l'on accepte de redistribuer les données venant de peer
+func reserveAllowed(peer string) bool {
+	switch *reservePeers {
+	case "all":
+		return true
+	case "none", "":
+		return false
+	}
+	for _, p := range strings.Split(*reservePeers, ",") {
+		if strings.TrimSpace(p) == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// initDatumStore ouvre le stockage selon les options de la ligne de commande
+func initDatumStore() {
+	if *storeQuota > 0 {
+		datums = openDatumStore(*storeDir, *storeQuota)
+	}
+}
+
+var peerNames = struct {
+	sync.Mutex
+	byAddr map[string]string
+}{byAddr: make(map[string]string)}
+
+// setPeerName retient le nom du pair joint à l'adresse addr
+func setPeerName(addr net.Addr, name string) {
+	peerNames.Lock()
+	defer peerNames.Unlock()
+	peerNames.byAddr[addr.String()] = name
+}
+
+// peerNameOf renvoie le nom du pair joint à l'adresse addr, ou l'adresse si on ne le connaît pas
+func peerNameOf(addr net.Addr) string {
+	peerNames.Lock()
+	defer peerNames.Unlock()
+	if name, ok := peerNames.byAddr[addr.String()]; ok {
+		return name
+	}
+	return strings.NewReplacer(":", "_", "[", "", "]", "").Replace(addr.String())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"testing"
+	"time"
+)
+
+func chunkValue(content string) ([]byte, []byte) {
+	value := append([]byte{chunkType}, content...)
+	hash := sha256.Sum256(value)
+	return hash[:], value
+}
+
+func TestDatumStoreLRU(t *testing.T) {
+	clk := &stepClock{time.Unix(1700000000, 0)}
+	saved := clock
+	clock = clk
+	defer func() { clock = saved }()
+	dir := t.TempDir()
+	hA, a := chunkValue("aaaaaaaaa")
+	hB, b := chunkValue("bbbbbbbbb")
+	hC, c := chunkValue("ccccccccc")
+	st := openDatumStore(dir, 20) //deux valeurs de 10 octets
+	st.put("alice", hA, a)
+	clk.Sleep(time.Second)
+	st.put("bob", hB, b)
+	clk.Sleep(time.Second)
+	if _, peer, ok := st.get(hA); !ok || peer != "alice" { //a devient la plus récemment utilisée
+		t.Fatalf("a not found (%v, %q)", ok, peer)
+	}
+	clk.Sleep(time.Second)
+	st.put("alice", hC, c)
+	if _, _, ok := st.get(hB); ok {
+		t.Fatalf("least recently used datum kept over the quota")
+	}
+	if _, err := os.Stat(st.path("bob", hB)); !os.IsNotExist(err) {
+		t.Fatalf("evicted datum still on disk: %v", err)
+	}
+	for _, h := range [][]byte{hA, hC} {
+		if _, _, ok := st.get(h); !ok {
+			t.Fatalf("%x evicted", h[:4])
+		}
+	}
+	if st.total != 20 {
+		t.Fatalf("total %d, want 20", st.total)
+	}
+
+	//l'index est relu au démarrage, et le quota appliqué
+	reopened := openDatumStore(dir, 10)
+	if len(reopened.datums) != 1 || reopened.total != 10 {
+		t.Fatalf("reopened with %d datums, %d bytes", len(reopened.datums), reopened.total)
+	}
+}
+
+func TestDatumStoreCorruption(t *testing.T) {
+	st := openDatumStore(t.TempDir(), 1<<20)
+	h, value := chunkValue("content")
+	st.put("alice", h, value)
+	if err := os.WriteFile(st.path("alice", h), []byte("\x00tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := st.get(h); ok {
+		t.Fatalf("tampered datum served")
+	}
+	if _, err := os.Stat(st.path("alice", h)); !os.IsNotExist(err) {
+		t.Fatalf("tampered file not removed: %v", err)
+	}
+	if st.total != 0 || len(st.datums) != 0 {
+		t.Fatalf("index still counts %d datums, %d bytes", len(st.datums), st.total)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	saved, savedExports, savedReserve := datums, exports, *reservePeers
+	defer func() { datums, exports, *reservePeers = saved, savedExports, savedReserve }()
+	exports = newExporter()
+	datums = openDatumStore(t.TempDir(), 1<<20)
+	h, value := chunkValue("from alice")
+	datums.put("alice", h, value)
+
+	for _, c := range []struct {
+		reserve string
+		served  bool
+	}{
+		{"all", true},
+		{"none", false},
+		{"", false},
+		{"bob, alice", true},
+		{"bob", false},
+	} {
+		*reservePeers = c.reserve
+		reply, err := getDatumReply(getDatumPacket(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (reply.Type[0] == 131) != c.served {
+			t.Errorf("-reserve %q: reply of type %d", c.reserve, reply.Type[0])
+		}
+	}
+}
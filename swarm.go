@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//===================================================================================================
+//                                TELECHARGEMENT MULTI-SOURCES
+//===================================================================================================
+
+// Un arbre de Merkle est entièrement désigné par son hash racine : n'importe quel pair qui a la même racine
+// peut fournir n'importe quel noeud. On répartit donc les GetDatum entre tous les pairs qui ont l'arbre,
+// selon leur débit mesuré, et un hash refusé (NoDatum) ou sans réponse est redemandé à un autre pair.
+
+type swarmSource struct {
+	name       string
+	conn       Transport
+	throughput float64 //octets/s, moyenne glissante (0 tant que l'on n'a pas de mesure)
+	received   int     //octets reçus de ce pair
+	dead       bool
+}
+
+// swarmMain implémente "swarm <root-hash> <dir>"
+func swarmMain(ctx context.Context, args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: swarm <root-hash> <dir>\n")
+		return 2
+	}
+	root, err := hex.DecodeString(strings.TrimSpace(args[0]))
+	if err != nil || len(root) != 32 {
+		fmt.Fprintf(os.Stderr, "Invalid root hash %q\n", args[0])
+		return 2
+	}
+	dir := strings.TrimRight(args[1], "/")
+
+	privK, pubK := newKeys()
+	initDatumStore()
+	initExports(privK)
+	var bobK *ecdsa.PublicKey
+	client := restClient()
+	conn := registerToServer(privK, pubK, bobK, ourRoot())
+	if conn == nil {
+		slog.Error("Cannot register with the server")
+		return 1
+	}
+	defer conn.Close()
+	closeOnCancel(ctx, conn)
+	go HelloRepeater(ctx, conn, privK, bobK)
+
+	sources := discoverSources(*client, root, privK, bobK, pubK)
+	if len(sources) == 0 {
+		slog.Error("No peer has the tree", hashAttr(root))
+		return 1
+	}
+	for _, src := range sources {
+		defer src.conn.Close()
+		closeOnCancel(ctx, src.conn)
+	}
+
+	out := humanOutput()
+	resetProgress()
+	dl := newDownload(dir)
+	err = swarmDownload(ctx, sources, root, dir, privK, bobK, dl)
+	doneProgress()
+	for _, src := range sources {
+		fmt.Fprintf(out, "%v: %d bytes, %.0f B/s\n", src.name, src.received, src.throughput)
+	}
+	if err != nil {
+		slog.Error("Swarm download failed", "err", err)
+		return 1
+	}
+	for _, r := range dl.rejected {
+		fmt.Fprintf(out, "Entrée refusée : %v\n", r)
+	}
+	err = writeManifest(dir, dl.manifest)
+	if err != nil || len(dl.failed) > 0 {
+		slog.Error("Could not write the tree completely", "dir", dir)
+		return 1
+	}
+	return 0
+}
+
+// discoverSources ouvre une session avec chaque pair qui annonce root par REST, puis avec ceux qui,
+// sans l'annoncer, répondent à un GetDatum pour root
+func discoverSources(client http.Client, root []byte, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, pubK []byte) []*swarmSource {
+	body, err := HttpRequest("GET", jchPeersAddr, client)
+	if err != nil {
+		return nil
+	}
+	advertising := make([]string, 0)
+	others := make([]string, 0)
+	for _, p := range ParseREST(body) {
+		peerRoot, err := HttpRequest("GET", jchPeersAddr+string(p)+"/root", client)
+		if err == nil && bytes.Equal(peerRoot, root) {
+			advertising = append(advertising, string(p))
+		} else {
+			others = append(others, string(p))
+		}
+	}
+
+	sources := make([]*swarmSource, 0)
+	open := func(name string) Transport {
+		addrs, err := HttpRequest("GET", jchPeersAddr+name+"/addresses", client)
+		if err != nil {
+			return nil
+		}
+		return connectPeer(name, ParseREST(addrs), privK, bobK, pubK, ourRoot())
+	}
+	for _, name := range advertising {
+		if conn := open(name); conn != nil {
+			slog.Info("Peer advertises the tree", "peer", name, hashAttr(root))
+			sources = append(sources, &swarmSource{name: name, conn: conn})
+		}
+	}
+	for _, name := range others {
+		conn := open(name)
+		if conn == nil {
+			continue
+		}
+		if _, err := getDatum(conn, root, privK, bobK); err != nil {
+			conn.Close()
+			continue
+		}
+		slog.Info("Peer can serve the tree", "peer", name, hashAttr(root))
+		sources = append(sources, &swarmSource{name: name, conn: conn})
+	}
+	return sources
+}
+
+// swarmNode est un noeud de l'arbre à récupérer
+type swarmNode struct {
+	hash []byte
+	path string     //chemin sur le disque d'un répertoire ou d'un fichier
+	file *swarmFile //fichier dont c'est un noeud interne ou un chunk (nil pour un répertoire ou la racine d'un fichier)
+}
+
+// swarmFile garde les valeurs d'un fichier jusqu'à ce que tous ses chunks soient arrivés
+type swarmFile struct {
+	root    []byte
+	path    string
+	values  map[string][]byte
+	pending int  //noeuds du fichier demandés et pas encore reçus
+	bad     bool //un noeud du fichier est un directory
+}
+
+// swarmDownload récupère l'arbre de racine root niveau par niveau et écrit chaque fichier sous dir dès que
+// tous ses chunks sont arrivés : on ne garde en mémoire que les fichiers incomplets, pas tout l'arbre.
+// Les Datum reçus avant une annulation de ctx restent dans le stockage (voir store.go).
+func swarmDownload(ctx context.Context, sources []*swarmSource, root []byte, dir string, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, dl *download) error {
+	level := []swarmNode{{hash: root, path: dir}}
+	for len(level) > 0 {
+		hashes := make([][]byte, 0, len(level))
+		seen := make(map[string]bool, len(level))
+		for _, n := range level {
+			if !seen[string(n.hash)] { //un même chunk peut apparaître plusieurs fois
+				seen[string(n.hash)] = true
+				hashes = append(hashes, n.hash)
+			}
+		}
+		fetched, err := fetchFromSwarm(ctx, sources, hashes, privK, bobK)
+		if err != nil {
+			return err
+		}
+		next := make([]swarmNode, 0)
+		for _, n := range level {
+			value := fetched[string(n.hash)].Body[32:]
+			if n.file == nil {
+				if err := insideDir(dl.root, n.path); err != nil {
+					dl.reject(n.path, err.Error())
+					continue
+				}
+				dl.manifest = append(dl.manifest, manifestLine(n.hash, n.path, dl.root))
+				if value[0] == directoryType {
+					next = append(next, swarmDirectory(n.path, value, dl)...)
+					continue
+				}
+				n.file = &swarmFile{root: n.hash, path: n.path, values: make(map[string][]byte), pending: 1}
+				emitProgress(progressFile, n.hash, 0, n.path)
+			} else if value[0] == directoryType {
+				n.file.bad = true
+			}
+			f := n.file
+			f.values[string(n.hash)] = value
+			f.pending--
+			if value[0] == bigFileType {
+				for _, child := range childHashes(value) {
+					next = append(next, swarmNode{hash: child, file: f})
+					f.pending++
+				}
+			}
+			if f.pending == 0 {
+				writeSwarmFile(f, dl)
+			}
+		}
+		level = next
+	}
+	return nil
+}
+
+// swarmDirectory crée le répertoire path et renvoie ses entrées à récupérer
+func swarmDirectory(path string, value []byte, dl *download) []swarmNode {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		slog.Warn("Cannot create directory", "path", path, "err", err)
+	}
+	entries, err := parseDirectory(value)
+	if err != nil {
+		dl.reject(path, err.Error())
+		return nil
+	}
+	entries, rejected := filterEntries(entries)
+	for _, r := range rejected {
+		dl.reject(path, r)
+	}
+	nodes := make([]swarmNode, 0, len(entries))
+	for _, e := range entries {
+		nodes = append(nodes, swarmNode{hash: e.Hash, path: path + "/" + e.Name})
+	}
+	return nodes
+}
+
+// writeSwarmFile écrit un fichier complet et libère ses valeurs
+func writeSwarmFile(f *swarmFile, dl *download) {
+	defer func() { f.values = nil }()
+	if f.bad {
+		dl.reject(f.path, "directory inside a file")
+		return
+	}
+	out := make([]byte, 0)
+	chunks := make([]fileChunk, 0)
+	storeFileData(f.values, f.root, &out, &chunks)
+	if err := writeFileAtomic(f.path, out, chunks); err != nil {
+		slog.Warn("Write failed", "path", f.path, "err", err)
+		dl.failed = append(dl.failed, f.path)
+	}
+}
+
+// childHashes renvoie les hash des fils d'un noeud (entrées d'un directory ou fils d'un BigFile)
+func childHashes(value []byte) [][]byte {
+	children := make([][]byte, 0)
+	if len(value) == 0 {
+		return children
+	}
+	switch value[0] {
+	case directoryType:
+		entries, err := parseDirectory(value)
+		if err != nil {
+			return children
+		}
+		for _, e := range entries {
+			children = append(children, e.Hash)
+		}
+	case bigFileType:
+		for i := 1; i+32 <= len(value); i += 32 {
+			children = append(children, value[i:i+32])
+		}
+	}
+	return children
+}
+
+type swarmBatch struct {
+	src     *swarmSource
+	results map[string]Message
+	missing []missingDatum
+}
+
+// fetchFromSwarm répartit les hash entre les sources selon leur débit, les demande en parallèle,
+// et redemande à une autre source ce qui n'a pas pu être obtenu
+func fetchFromSwarm(ctx context.Context, sources []*swarmSource, hashes [][]byte, privK *ecdsa.PrivateKey, bobK *ecdsa.PublicKey) (map[string]Message, error) {
+	results := make(map[string]Message, len(hashes))
+	tried := make(map[string]map[*swarmSource]bool)
+	remaining := hashes
+	for len(remaining) > 0 {
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		assignment, err := assignHashes(sources, remaining, tried)
+		if err != nil {
+			return nil, err
+		}
+
+		batches := make(chan swarmBatch, len(assignment))
+		var wg sync.WaitGroup
+		for src, hs := range assignment {
+			wg.Add(1)
+			go func(src *swarmSource, hs [][]byte) {
+				defer wg.Done()
+				start := time.Now()
+				res, missing := fetchDatumsPartial(ctx, src.conn, hs, privK, bobK)
+				n := 0
+				for _, m := range res {
+					n += len(m.Body)
+				}
+				src.measure(n, time.Since(start))
+				if len(res) == 0 && len(missing) > 0 && missing[0].Err == errTimeout {
+					src.dead = true //plus aucune réponse de ce pair
+					slog.Warn("Peer stopped answering", "peer", src.name)
+				}
+				batches <- swarmBatch{src, res, missing}
+			}(src, hs)
+		}
+		wg.Wait()
+		close(batches)
+
+		remaining = make([][]byte, 0)
+		for b := range batches {
+			for h, m := range b.results {
+				results[h] = m
+			}
+			for _, m := range b.missing {
+				slog.Info("Datum missing, asking another peer", "peer", b.src.name, hashAttr(m.Hash), "err", m.Err)
+				if tried[string(m.Hash)] == nil {
+					tried[string(m.Hash)] = make(map[*swarmSource]bool)
+				}
+				tried[string(m.Hash)][b.src] = true
+				remaining = append(remaining, m.Hash)
+			}
+		}
+	}
+	return results, nil
+}
+
+// measure met à jour le débit estimé de la source
+func (src *swarmSource) measure(n int, elapsed time.Duration) {
+	src.received += n
+	if elapsed <= 0 || n == 0 {
+		return
+	}
+	rate := float64(n) / elapsed.Seconds()
+	if src.throughput == 0 {
+		src.throughput = rate
+	} else {
+		src.throughput = 0.7*src.throughput + 0.3*rate
+	}
+}
+
+// assignHashes donne à chaque source une part des hash proportionnelle à son débit,
+// sans redonner un hash à une source qui l'a déjà refusé
+func assignHashes(sources []*swarmSource, hashes [][]byte, tried map[string]map[*swarmSource]bool) (map[*swarmSource][][]byte, error) {
+	//les sources sans mesure sont traitées comme la plus rapide, pour leur donner une chance
+	best := 1.0
+	for _, src := range sources {
+		if src.throughput > best {
+			best = src.throughput
+		}
+	}
+	rate := func(src *swarmSource) float64 {
+		if src.throughput == 0 {
+			return best
+		}
+		return src.throughput
+	}
+
+	assignment := make(map[*swarmSource][][]byte)
+	for _, h := range hashes {
+		var chosen *swarmSource
+		for _, src := range sources {
+			if src.dead || tried[string(h)][src] {
+				continue
+			}
+			if chosen == nil || float64(len(assignment[src])+1)/rate(src) < float64(len(assignment[chosen])+1)/rate(chosen) {
+				chosen = src
+			}
+		}
+		if chosen == nil {
+			return nil, fmt.Errorf("no peer can give %x", h)
+		}
+		assignment[chosen] = append(assignment[chosen], h)
+	}
+	return assignment, nil
+}
+
+// storeFileData reconstitue un File ou BigFile à partir de store
+func storeFileData(store map[string][]byte, hash []byte, out *[]byte, chunks *[]fileChunk) {
+	value := store[string(hash)]
+	if value[0] == chunkType {
+		*out = append(*out, value[1:]...)
+		*chunks = append(*chunks, fileChunk{hash, len(value) - 1})
+		return
+	}
+	for _, child := range childHashes(value) {
+		storeFileData(store, child, out, chunks)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwarmDownload(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 6)
+	tree := buildTestTree(t, src)
+	out := filepath.Join(t.TempDir(), "out")
+	sn := newSimNet(6)
+
+	//full a tout l'arbre ; partial n'annonce pas la racine et a perdu big.bin ; other a un autre arbre
+	full, partial, other := newSimPeer(tree), newSimPeer(tree), newSimPeer(buildTestTree(t, t.TempDir()))
+	big := make(map[string]*MerkleNode)
+	IndexTree(nodeAt(t, tree, "big.bin"), big)
+	for h := range big {
+		delete(partial.values, h)
+	}
+	//les chunks de big.bin ne sont demandés qu'une fois small.txt écrit sur le disque
+	streamed := true
+	fullHandler := func(from *net.UDPAddr, packet []byte, send func(*net.UDPAddr, []byte)) {
+		if len(packet) >= 7+32 && packet[4] == 3 {
+			if n := big[string(packet[7:7+32])]; n != nil && n.Type() == chunkType {
+				if _, err := os.Stat(filepath.Join(out, "small.txt")); err != nil {
+					streamed = false
+				}
+			}
+		}
+		full.handle(from, packet, send)
+	}
+	directory, client := useSimDirectory(t)
+	directory.add("other", sn.Node("192.0.2.12", nil).Listen(8443, other.handle), func() []byte { return other.root })
+	directory.add("partial", sn.Node("192.0.2.11", nil).Listen(8443, partial.handle), emptyRootHash)
+	directory.add("full", sn.Node("192.0.2.10", nil).Listen(8443, fullHandler), func() []byte { return tree.Hash })
+	defer useSimNet(sn, sn.Node("198.51.100.7", nil))()
+
+	sources := discoverSources(client, tree.Hash, nil, nil, make([]byte, 64))
+	defer func() {
+		for _, src := range sources {
+			src.conn.Close()
+		}
+	}()
+	names := make([]string, 0, len(sources))
+	for _, src := range sources {
+		names = append(names, src.name)
+	}
+	if fmt.Sprint(names) != "[full partial]" { //ceux qui annoncent la racine d'abord, puis ceux qui l'ont quand même
+		t.Fatalf("sources %v (%v)", names, sn)
+	}
+
+	dl := newDownload(out)
+	if err := swarmDownload(context.Background(), sources, tree.Hash, out, nil, nil, dl); err != nil {
+		t.Fatalf("%v (%v)", err, sn)
+	}
+	if len(dl.failed) > 0 || len(dl.rejected) > 0 {
+		t.Fatalf("failed %v, rejected %v", dl.failed, dl.rejected)
+	}
+	if !bytes.Equal(buildTestTree(t, out).Hash, tree.Hash) {
+		t.Fatalf("downloaded tree differs")
+	}
+	//le travail est partagé, et ce que partial n'a pas est redemandé à full
+	if sources[0].received == 0 || sources[1].received == 0 {
+		t.Fatalf("full received %d bytes, partial %d", sources[0].received, sources[1].received)
+	}
+	if !streamed {
+		t.Fatalf("chunks of big.bin requested before small.txt was written")
+	}
+	if err := writeManifest(out, dl.manifest); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readManifest(out)
+	if err != nil || len(entries) != len(treeManifest(tree)) {
+		t.Fatalf("manifest of %d entries (%v), want %d", len(entries), err, len(treeManifest(tree)))
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+//===================================================================================================
+//                                TRANSPORT ET HORLOGE
+//===================================================================================================
+
+// Le protocole n'utilise d'une socket UDP que ce qui est décrit par Transport : un *net.UDPConn connecté
+// à un pair en est un. Les tests utilisent à la place un réseau simulé (voir simnet_test.go), avec pertes,
+// doublons, réordonnancement et NAT, et une horloge virtuelle pour que chaque exécution soit identique.
+
+type Transport interface {
+	Read(b []byte) (int, error)
+	Write(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// dialTransport ouvre un Transport vers addr ("hôte:port")
+var dialTransport = func(addr string) (Transport, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Clock donne l'heure utilisée pour les délais d'attente, les mesures de RTT et la fenêtre de congestion
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+var clock Clock = realClock{}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//===================================================================================================
+//                                NAVIGATEUR EN PLEIN ECRAN
+//===================================================================================================
+
+// Avec -tui, l'invite de dataReceiver est remplacée par un navigateur dans le terminal :
+//   haut/bas (ou k/j)        déplacer le curseur
+//   entrée/droite (ou l)     ouvrir un pair ou un répertoire, télécharger un fichier
+//   gauche/retour (ou h)     revenir à l'écran précédent
+//   espace                   marquer ou démarquer une entrée
+//   d                        télécharger les entrées marquées (ou celle sous le curseur)
+//   r                        revenir à la racine du pair
+//   q                        quitter
+// Les sessions et le cache des noeuds sont ceux de la passerelle HTTP (voir gateway.go).
+
+var tuiMode = flag.Bool("tui", false, "browse peers with a full-screen terminal interface instead of the prompt")
+
+type tuiItem struct {
+	name string
+	hash []byte
+	kind string //peer, dir, file ou bigfile
+	size int64  //-1 si inconnue
+}
+
+// tuiView est un écran : la liste des pairs (peer vide) ou un répertoire d'un pair
+type tuiView struct {
+	peer   string
+	path   []string
+	items  []tuiItem
+	cursor int
+	marked map[int]bool
+}
+
+type browser struct {
+	g           *gateway
+	history     []*tuiView //le dernier est l'écran affiché
+	status      string
+	item        string    //entrée en cours de téléchargement
+	downloading int32     //1 pendant downloadItems : la progression est affichée dans la ligne d'état
+	out         io.Writer //écran, voir humanOutput
+	logs        *lastLine
+	keys        *bufio.Reader
+}
+
+// lastLine garde la dernière ligne de journal pour l'afficher en bas de l'écran
+type lastLine struct {
+	mu   sync.Mutex
+	line string
+}
+
+func (l *lastLine) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.line = strings.TrimSpace(string(p))
+	return len(p), nil
+}
+
+func (l *lastLine) get() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.line
+}
+
+// tuiBrowser remplace dataReceiver quand -tui est donné ; rend la main quand on quitte (q) ou que ctx est annulé
+func tuiBrowser(ctx context.Context, out io.Writer, client http.Client, privateKey *ecdsa.PrivateKey, bobK *ecdsa.PublicKey, pubK []byte) {
+	b := &browser{g: newGateway(ctx, client, privateKey, bobK, pubK), out: out, logs: &lastLine{}, keys: bufio.NewReader(os.Stdin)}
+	setLogOutput(b.logs)
+	defer setLogOutput(os.Stderr)
+	addProgressSink(b.showProgress())
+	setRawTerminal(true)
+	defer setRawTerminal(false)
+	defer b.g.closeSessions()
+	sizeCtx, stopSize := context.WithCancel(ctx)
+	defer stopSize()
+	watchTerminalSize(sizeCtx)
+
+	//la lecture du clavier ne peut pas être interrompue : elle se fait dans un goroutine à part
+	keys := make(chan string)
+	go func() {
+		for {
+			key := b.readKey()
+			select {
+			case keys <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	b.push(b.peersView())
+	for {
+		b.draw()
+		var key string
+		select {
+		case key = <-keys:
+		case <-ctx.Done():
+			fmt.Fprintf(b.out, "\x1b[H\x1b[2J")
+			return
+		}
+		v := b.current()
+		switch key {
+		case "up", "k":
+			if v.cursor > 0 {
+				v.cursor--
+			}
+		case "down", "j":
+			if v.cursor < len(v.items)-1 {
+				v.cursor++
+			}
+		case "enter", "right", "l":
+			b.open()
+		case "left", "backspace", "h":
+			b.back()
+		case " ":
+			if len(v.items) > 0 && v.items[v.cursor].name != ".." && v.peer != "" {
+				v.marked[v.cursor] = !v.marked[v.cursor]
+				if v.cursor < len(v.items)-1 {
+					v.cursor++
+				}
+			}
+		case "d":
+			b.download()
+		case "r":
+			if v.peer != "" {
+				for len(b.history) > 1 && len(b.current().path) > 0 {
+					b.history = b.history[:len(b.history)-1]
+				}
+			}
+		case "q":
+			fmt.Fprintf(b.out, "\x1b[H\x1b[2J")
+			return
+		}
+	}
+}
+
+// setRawTerminal passe le terminal en lecture touche par touche, sans écho
+func setRawTerminal(raw bool) {
+	args := []string{"sane"}
+	if raw {
+		args = []string{"-icanon", "-echo", "min", "1"}
+	}
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
+// termRows est le nombre de lignes du terminal, relu au lancement et à chaque SIGWINCH
+var termRows int32
+
+// terminalRows renvoie le nombre de lignes du terminal, sans relancer stty à chaque affichage
+func terminalRows() int {
+	if rows := atomic.LoadInt32(&termRows); rows > 0 {
+		return int(rows)
+	}
+	return 24
+}
+
+// watchTerminalSize lit la taille du terminal, puis la relit quand elle change, jusqu'à l'annulation de ctx
+func watchTerminalSize(ctx context.Context) {
+	atomic.StoreInt32(&termRows, int32(queryTerminalRows()))
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		defer signal.Stop(winch)
+		for {
+			select {
+			case <-winch:
+				atomic.StoreInt32(&termRows, int32(queryTerminalRows()))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// queryTerminalRows demande à stty le nombre de lignes du terminal, 24 si on ne peut pas le savoir
+func queryTerminalRows() int {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return 24
+	}
+	var rows, cols int
+	_, err = fmt.Sscanf(string(out), "%d %d", &rows, &cols)
+	if err != nil || rows < 8 {
+		return 24
+	}
+	return rows
+}
+
+// readKey lit une touche et traduit les séquences des flèches
+func (b *browser) readKey() string {
+	c, err := b.keys.ReadByte()
+	if err != nil {
+		return "q"
+	}
+	switch c {
+	case '\r', '\n':
+		return "enter"
+	case 127, 8:
+		return "backspace"
+	case 0x1b:
+		if next, _ := b.keys.Peek(2); len(next) == 2 && next[0] == '[' {
+			b.keys.Discard(2)
+			switch next[1] {
+			case 'A':
+				return "up"
+			case 'B':
+				return "down"
+			case 'C':
+				return "right"
+			case 'D':
+				return "left"
+			}
+		}
+		return "esc"
+	}
+	return string(c)
+}
+
+func (b *browser) current() *tuiView {
+	return b.history[len(b.history)-1]
+}
+
+func (b *browser) push(v *tuiView) {
+	if v != nil {
+		b.history = append(b.history, v)
+	}
+}
+
+func (b *browser) back() {
+	if len(b.history) > 1 {
+		b.history = b.history[:len(b.history)-1]
+	}
+}
+
+func (b *browser) peersView() *tuiView {
+	v := &tuiView{marked: make(map[int]bool)}
+	names, err := b.g.peerList()
+	if err != nil {
+		b.status = fmt.Sprintf("Error get peers : %v", err)
+	}
+	for _, name := range names {
+		v.items = append(v.items, tuiItem{name: name, kind: "peer", size: -1})
+	}
+	return v
+}
+
+// dirView récupère le répertoire path du pair peer, avec le type et la taille de chaque entrée
+func (b *browser) dirView(peer string, path []string) *tuiView {
+	b.status = "Chargement de " + peer + "/" + strings.Join(path, "/") + "..."
+	b.draw()
+	s, err := b.g.session(peer)
+	if err != nil {
+		b.status = err.Error()
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, value, err := b.g.resolve(s, path)
+	if err == nil && value[0] != directoryType {
+		err = fmt.Errorf("not a directory")
+	}
+	var entries []dirEntry
+	var values map[string][]byte
+	if err == nil {
+		entries, values, err = b.g.children(s, value)
+	}
+	if err != nil {
+		b.g.drop(s)
+		b.status = err.Error()
+		return nil
+	}
+
+	v := &tuiView{peer: peer, path: path, marked: make(map[int]bool)}
+	v.items = append(v.items, tuiItem{name: "..", kind: "dir", size: -1})
+	for _, e := range entries {
+		item := tuiItem{name: e.Name, hash: e.Hash, kind: "file", size: b.g.fileSize(s, e.Hash, values[string(e.Hash)])}
+		switch values[string(e.Hash)][0] {
+		case directoryType:
+			item.kind = "dir"
+		case bigFileType:
+			item.kind = "bigfile"
+		}
+		v.items = append(v.items, item)
+	}
+	b.status = ""
+	return v
+}
+
+// open agit sur l'entrée sous le curseur
+func (b *browser) open() {
+	v := b.current()
+	if len(v.items) == 0 {
+		return
+	}
+	item := v.items[v.cursor]
+	switch {
+	case item.name == "..":
+		b.back()
+	case item.kind == "peer":
+		if err := checkEntryName(item.name); err != nil { //le nom du pair sert de nom de dossier
+			b.status = fmt.Sprintf("Peer name %q refused : %v", item.name, err)
+			return
+		}
+		b.push(b.dirView(item.name, nil))
+	case item.kind == "dir":
+		b.push(b.dirView(v.peer, append(append([]string(nil), v.path...), item.name)))
+	default:
+		b.downloadItems(v, []tuiItem{item})
+	}
+}
+
+// download télécharge les entrées marquées, ou celle sous le curseur
+func (b *browser) download() {
+	v := b.current()
+	if v.peer == "" || len(v.items) == 0 {
+		return
+	}
+	items := make([]tuiItem, 0)
+	for i, item := range v.items {
+		if v.marked[i] {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 && v.items[v.cursor].name != ".." {
+		items = append(items, v.items[v.cursor])
+	}
+	b.downloadItems(v, items)
+	v.marked = make(map[int]bool)
+}
+
+func (b *browser) downloadItems(v *tuiView, items []tuiItem) {
+	s, err := b.g.session(v.peer)
+	if err != nil {
+		b.status = err.Error()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stop := closeOnCancel(b.g.ctx, s.conn) //interrompt le téléchargement à l'arrêt
+	defer stop()
+	resetProgress()
+	atomic.StoreInt32(&b.downloading, 1)
+	defer atomic.StoreInt32(&b.downloading, 0)
+	failed := 0
+	for i, item := range items {
+		if b.g.ctx.Err() != nil {
+			break
+		}
+		b.item = fmt.Sprintf("[%d/%d] %v", i+1, len(items), item.name)
+		b.status = b.item + "..."
+		b.draw()
+		//le chemin parcouru est gardé : deux dossiers de même nom sous des parents différents ne se mélangent pas
+		name := strings.Join(append(append([]string(nil), v.path...), item.name), "/")
+		fetched, err := fetchDatums(b.g.ctx, s.conn, [][]byte{item.hash}, b.g.privK, b.g.bobK)
+		if err == nil {
+			response := fetched[string(item.hash)]
+			if item.kind == "dir" {
+				err = downloadDirectory(b.g.ctx, b.logs, s.conn, response, v.peer, name, b.g.privK, b.g.bobK)
+			} else {
+				err = downloadFile(b.g.ctx, s.conn, response, v.peer, name, b.g.privK, b.g.bobK)
+			}
+		}
+		if err != nil {
+			failed++
+			slog.Warn("Download failed", "path", name, "err", err)
+		}
+	}
+	b.status = fmt.Sprintf("%d/%d téléchargés dans downlaod_from_%v (%v)", len(items)-failed, len(items), v.peer, sessionStats(s.conn.RemoteAddr()))
+}
+
+// showProgress affiche la progression dans la ligne d'état pendant un téléchargement lancé depuis le navigateur
+func (b *browser) showProgress() progressSink {
+	var last time.Time
+	return func(e progressEvent, st progressStats) {
+		if atomic.LoadInt32(&b.downloading) == 0 || time.Since(last) < 100*time.Millisecond {
+			return
+		}
+		last = time.Now()
+		b.status = b.item + "  " + st.line()
+		b.draw()
+	}
+}
+
+func (b *browser) draw() {
+	v := b.current()
+	rows := terminalRows() - 4 //titre, ligne vide, état et journal
+	var out strings.Builder
+	out.WriteString("\x1b[H\x1b[2J")
+	if v.peer == "" {
+		out.WriteString("Pairs\r\n\r\n")
+	} else {
+		fmt.Fprintf(&out, "%v:/%v\r\n\r\n", v.peer, strings.Join(v.path, "/"))
+	}
+	first := 0
+	if v.cursor >= rows {
+		first = v.cursor - rows + 1
+	}
+	for i := first; i < len(v.items) && i < first+rows; i++ {
+		item := v.items[i]
+		cursor, mark := " ", " "
+		if i == v.cursor {
+			cursor = ">"
+		}
+		if v.marked[i] {
+			mark = "*"
+		}
+		size := ""
+		if item.size >= 0 {
+			size = humanSize(item.size)
+		}
+		kind := item.kind
+		if item.name == ".." || kind == "peer" {
+			kind = ""
+		}
+		fmt.Fprintf(&out, "%v%v %-34v %-8v %10v\r\n", cursor, mark, item.name, kind, size)
+	}
+	fmt.Fprintf(&out, "\x1b[%d;1H\x1b[7m%v\x1b[0m\r\n%v", rows+3, b.status, b.logs.get())
+	fmt.Fprint(b.out, out.String())
+}
+
+func humanSize(n int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %v", f, units[i])
+}
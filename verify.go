@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+//===================================================================================================
+//                                VERIFICATION HORS LIGNE
+//===================================================================================================
+
+// Lors d'un téléchargement complet, collectDirectory note le hash de chaque entrée reçue.
+// On écrit ces hash à côté du dossier téléchargé (<dossier>.merkle), une ligne "hash<TAB>chemin" par entrée,
+// dans l'ordre du directory distant, ce qui permet ensuite de localiser les fichiers qui ne correspondent pas.
+
+const manifestSuffix = ".merkle"
+
+type manifestEntry struct {
+	Path string
+	Hash []byte
+}
+
+// manifestLine formate une entrée de manifeste pour le noeud filePath, base étant le dossier racine du téléchargement
+func manifestLine(hash []byte, filePath string, base string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(filePath, base), "/")
+	if rel == "" {
+		rel = "."
+	}
+	return fmt.Sprintf("%x\t%s", hash, rel)
+}
+
+func writeManifest(dir string, lines []string) error {
+	return os.WriteFile(strings.TrimRight(dir, "/")+manifestSuffix, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// treeManifest donne les lignes de manifeste d'un arbre (répertoires et fichiers, pas les noeuds internes des BigFile)
+func treeManifest(n *MerkleNode) []string {
+	lines := []string{fmt.Sprintf("%x\t%s", n.Hash, n.Path)}
+	if n.Type() == directoryType {
+		for _, child := range n.Children {
+			lines = append(lines, treeManifest(child)...)
+		}
+	}
+	return lines
+}
+
+func readManifest(dir string) ([]manifestEntry, error) {
+	f, err := os.Open(strings.TrimRight(dir, "/") + manifestSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]manifestEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		hash, err := hex.DecodeString(fields[0])
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("bad hash in manifest: %q", fields[0])
+		}
+		entries = append(entries, manifestEntry{fields[1], hash})
+	}
+	return entries, scanner.Err()
+}
+
+// manifestOrder donne, pour chaque répertoire du manifeste, l'ordre de ses entrées
+func manifestOrder(entries []manifestEntry) map[string][]string {
+	order := make(map[string][]string)
+	for _, e := range entries {
+		if e.Path == "." {
+			continue
+		}
+		parent := treeParent(e.Path)
+		order[parent] = append(order[parent], strings.TrimPrefix(e.Path, parent+"/"))
+	}
+	return order
+}
+
+type treeMismatch struct {
+	Path   string
+	Reason string
+}
+
+// compareWithManifest parcourt l'arbre local et le compare aux hash attendus,
+// sans descendre dans les sous-arbres dont le hash correspond
+func compareWithManifest(local *MerkleNode, expected map[string][]byte) []treeMismatch {
+	mismatches := make([]treeMismatch, 0)
+	seen := make(map[string]bool)
+
+	var walk func(n *MerkleNode)
+	walk = func(n *MerkleNode) {
+		seen[n.Path] = true
+		hash, ok := expected[n.Path]
+		if !ok {
+			mismatches = append(mismatches, treeMismatch{n.Path, "not in remote tree"})
+			return
+		}
+		if bytes.Equal(hash, n.Hash) {
+			markSeen(n, seen)
+			return
+		}
+		if n.Type() != directoryType {
+			mismatches = append(mismatches, treeMismatch{n.Path, "content differs"})
+			return
+		}
+		mismatches = append(mismatches, treeMismatch{n.Path, "subtree differs"})
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(local)
+
+	missing := make([]string, 0)
+	for path := range expected {
+		if !seen[path] && seen[treeParent(path)] { //on ne signale que le plus haut élément manquant
+			missing = append(missing, path)
+		}
+	}
+	sort.Strings(missing)
+	for _, path := range missing {
+		mismatches = append(mismatches, treeMismatch{path, "missing locally"})
+	}
+	return mismatches
+}
+
+// markSeen marque tout un sous-arbre identique comme vu
+func markSeen(n *MerkleNode, seen map[string]bool) {
+	if n.Type() != directoryType {
+		return
+	}
+	for _, child := range n.Children {
+		seen[child.Path] = true
+		markSeen(child, seen)
+	}
+}
+
+// treeParent renvoie le chemin du répertoire contenant path
+func treeParent(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return "."
+}
+
+// verifyMain implémente la commande "verify <dir> <root-hash>", renvoie le code de sortie
+func verifyMain(args []string) int {
+	if len(args) != 2 {
+		fmt.Fprintf(os.Stderr, "usage: verify <dir> <root-hash>\n")
+		return 2
+	}
+	dir := strings.TrimRight(args[0], "/")
+	root, err := hex.DecodeString(strings.TrimSpace(args[1]))
+	if err != nil || len(root) != 32 {
+		fmt.Fprintf(os.Stderr, "Invalid root hash %q\n", args[1])
+		return 2
+	}
+
+	entries, errManifest := readManifest(dir)
+	var order map[string][]string
+	if errManifest == nil {
+		order = manifestOrder(entries)
+	}
+
+	local, err := BuildMerkleTree(dir, order)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot build tree of %v: %v\n", dir, err)
+		return 2
+	}
+
+	fmt.Printf("local root : %x\n", local.Hash)
+	fmt.Printf("remote root: %x\n", root)
+	if bytes.Equal(local.Hash, root) {
+		fmt.Printf("OK\n")
+		return 0
+	}
+
+	if errManifest != nil {
+		fmt.Printf("MISMATCH (no manifest %v%v, cannot locate differing files)\n", dir, manifestSuffix)
+		return 1
+	}
+	expected := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		expected[e.Path] = e.Hash
+	}
+	if !bytes.Equal(expected["."], root) {
+		fmt.Printf("Warning: manifest was written for root %x, not %x\n", expected["."], root)
+	}
+	for _, m := range compareWithManifest(local, expected) {
+		fmt.Printf("MISMATCH %v: %v\n", m.Path, m.Reason)
+	}
+	return 1
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//===================================================================================================
+//                                WEBDAV EN LECTURE SEULE
+//===================================================================================================
+
+// /dav/<pair>/chemin permet de monter l'arbre d'un pair dans un gestionnaire de fichiers :
+// PROPFIND liste un Directory, GET reconstitue un fichier. Rien ne peut être écrit.
+// Les noeuds passent par le cache de la passerelle, une liste relue ne redemande donc rien au pair.
+
+const davMethods = "OPTIONS, GET, HEAD, PROPFIND"
+
+// davProp décrit une ressource dans une réponse PROPFIND, size < 0 si la taille n'est pas connue
+type davProp struct {
+	href  string
+	name  string
+	isDir bool
+	hash  []byte
+	size  int64
+}
+
+func (g *gateway) serveDAV(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", davMethods)
+		return
+	case "PROPFIND", http.MethodGet, http.MethodHead:
+	default:
+		w.Header().Set("Allow", davMethods)
+		http.Error(w, "read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == "PROPFIND" && strings.EqualFold(r.Header.Get("Depth"), "infinity") {
+		//lister tout un arbre demanderait tous ses noeuds au pair : refusé, comme le permet la RFC 4918 (9.1)
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<D:error xmlns:D=\"DAV:\"><D:propfind-finite-depth/></D:error>\n")
+		return
+	}
+	if len(parts) == 0 || parts[0] == "" {
+		g.davPeers(w, r)
+		return
+	}
+
+	peer, path := parts[0], parts[1:]
+	s, hash, value, ok := g.lookup(w, r, peer, path)
+	if !ok {
+		return
+	}
+	defer s.mu.Unlock()
+
+	if r.Method != "PROPFIND" {
+		w.Header().Set("ETag", etag(hash))
+		if value[0] == directoryType {
+			http.Error(w, "collection", http.StatusMethodNotAllowed)
+			return
+		}
+		g.serveFile(w, r, s, path, hash)
+		return
+	}
+
+	href := "/dav/" + url.PathEscape(peer)
+	for _, name := range path {
+		if name != "" {
+			href += "/" + url.PathEscape(name)
+		}
+	}
+	self := davProp{href: href, name: peer, hash: hash, size: g.fileSize(s, hash, value)}
+	if len(path) > 0 {
+		self.name = path[len(path)-1]
+	}
+	props := []davProp{self}
+	if value[0] == directoryType {
+		props[0].isDir = true
+		props[0].href += "/"
+		if r.Header.Get("Depth") != "0" { //sans Depth, on liste comme avec Depth: 1
+			entries, values, err := g.children(s, value)
+			if err != nil {
+				g.drop(s)
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			for _, e := range entries {
+				v := values[string(e.Hash)]
+				p := davProp{href: props[0].href + url.PathEscape(e.Name), name: e.Name, hash: e.Hash, size: g.fileSize(s, e.Hash, v)}
+				if v[0] == directoryType {
+					p.isDir = true
+					p.href += "/"
+				}
+				props = append(props, p)
+			}
+		}
+	}
+	writeMultistatus(w, props)
+}
+
+// davPeers répond à PROPFIND sur /dav/ : un dossier par pair
+func (g *gateway) davPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PROPFIND" {
+		http.Redirect(w, r, "/peers", http.StatusFound)
+		return
+	}
+	props := []davProp{{href: "/dav/", name: "peers", isDir: true, size: -1}}
+	if r.Header.Get("Depth") != "0" {
+		names, err := g.peerList()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		for _, name := range names {
+			props = append(props, davProp{href: "/dav/" + url.PathEscape(name) + "/", name: name, isDir: true, size: -1})
+		}
+	}
+	writeMultistatus(w, props)
+}
+
+// fileSize renvoie la taille du fichier hash, -1 pour un répertoire ou si on ne peut pas la connaître sans
+// lire tout le fichier (découpage autre que celui de BuildFileTree) : la liste d'un dossier reste légère
+func (g *gateway) fileSize(s *peerSession, hash []byte, value []byte) int64 {
+	if value[0] == directoryType {
+		return -1
+	}
+	size, err := g.reader(s).SizeFromShape(hash)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+func writeMultistatus(w http.ResponseWriter, props []davProp) {
+	var b bytes.Buffer
+	b.WriteString("<?xml version=\"1.0\" encoding=\"utf-8\"?>\n<D:multistatus xmlns:D=\"DAV:\">\n")
+	for _, p := range props {
+		b.WriteString("<D:response><D:href>")
+		xml.EscapeText(&b, []byte(p.href))
+		b.WriteString("</D:href><D:propstat><D:prop><D:displayname>")
+		xml.EscapeText(&b, []byte(p.name))
+		b.WriteString("</D:displayname>")
+		if p.isDir {
+			b.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+		} else {
+			b.WriteString("<D:resourcetype/><D:getcontenttype>application/octet-stream</D:getcontenttype>")
+		}
+		if p.size >= 0 {
+			fmt.Fprintf(&b, "<D:getcontentlength>%d</D:getcontentlength>", p.size)
+		}
+		if p.hash != nil {
+			b.WriteString("<D:getetag>")
+			xml.EscapeText(&b, []byte(etag(p.hash)))
+			b.WriteString("</D:getetag>")
+		}
+		b.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>\n")
+	}
+	b.WriteString("</D:multistatus>\n")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207) //Multi-Status
+	w.Write(b.Bytes())
+}
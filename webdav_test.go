@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type davMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+		Prop struct {
+			Name       string    `xml:"displayname"`
+			Collection *struct{} `xml:"resourcetype>collection"`
+			Length     *int64    `xml:"getcontentlength"`
+			ETag       string    `xml:"getetag"`
+		} `xml:"propstat>prop"`
+	} `xml:"response"`
+}
+
+// useSimGateway renvoie une passerelle qui joint le pair "sim" à travers un réseau simulé
+func useSimGateway(t *testing.T, peer *simPeer) *gateway {
+	sn := newSimNet(8)
+	directory, client := useSimDirectory(t)
+	directory.add("sim", sn.Node("192.0.2.10", nil).Listen(8443, peer.handle), func() []byte { return peer.root })
+	t.Cleanup(useSimNet(sn, sn.Node("198.51.100.7", nil)))
+	g := newGateway(context.Background(), client, nil, nil, make([]byte, 64))
+	t.Cleanup(g.closeSessions)
+	return g
+}
+
+// propfind envoie un PROPFIND à g et renvoie le code, le corps et la réponse décodée
+func propfind(t *testing.T, g *gateway, path, depth string) (int, string, davMultistatus) {
+	t.Helper()
+	r := httptest.NewRequest("PROPFIND", path, nil)
+	if depth != "" {
+		r.Header.Set("Depth", depth)
+	}
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	var ms davMultistatus
+	if w.Code == 207 {
+		if err := xml.Unmarshal(w.Body.Bytes(), &ms); err != nil {
+			t.Fatalf("%v: %v\n%s", path, err, w.Body.Bytes())
+		}
+	}
+	return w.Code, w.Body.String(), ms
+}
+
+// describeDAV résume chaque ressource : "href dir", "href taille", "href unknown size", ou "href ?" si ses
+// propriétés sont incohérentes
+func describeDAV(ms davMultistatus) string {
+	lines := make([]string, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		switch {
+		case r.Prop.Collection != nil && r.Prop.Length == nil:
+			lines = append(lines, r.Href+" dir")
+		case r.Prop.Collection == nil && r.Prop.Length != nil && r.Prop.ETag != "":
+			lines = append(lines, fmt.Sprintf("%v %d", r.Href, *r.Prop.Length))
+		case r.Prop.Collection == nil && r.Prop.Length == nil:
+			lines = append(lines, r.Href+" unknown size")
+		default:
+			lines = append(lines, r.Href+" ?")
+		}
+	}
+	return strings.Join(lines, ", ")
+}
+
+func TestPropfind(t *testing.T) {
+	quietLog(t)
+	src := t.TempDir()
+	writeTestTree(t, src, 9)
+	g := useSimGateway(t, newSimPeer(buildTestTree(t, src)))
+	code, _, ms := propfind(t, g, "/dav/sim/", "0")
+	if code != 207 || describeDAV(ms) != "/dav/sim/ dir" {
+		t.Fatalf("Depth 0: %d %v", code, describeDAV(ms))
+	}
+	want := "/dav/sim/ dir, /dav/sim/big.bin 33809, /dav/sim/docs/ dir, /dav/sim/exact.bin 1024, /dav/sim/images/ dir, /dav/sim/small.txt 100"
+	for _, depth := range []string{"1", ""} { //sans Depth, comme Depth: 1
+		if code, _, ms := propfind(t, g, "/dav/sim/", depth); code != 207 || describeDAV(ms) != want {
+			t.Fatalf("Depth %q: %d %v", depth, code, describeDAV(ms))
+		}
+	}
+	code, _, ms = propfind(t, g, "/dav/sim/images/photo.raw", "1")
+	if code != 207 || describeDAV(ms) != fmt.Sprintf("/dav/sim/images/photo.raw %d", 40*chunkSize) {
+		t.Fatalf("file: %d %v", code, describeDAV(ms))
+	}
+	if code, _, _ := propfind(t, g, "/dav/sim/missing", "1"); code != 404 {
+		t.Fatalf("missing entry: %d", code)
+	}
+	code, body, _ := propfind(t, g, "/dav/sim/", "infinity")
+	if code != 403 || !strings.Contains(body, "propfind-finite-depth") {
+		t.Fatalf("Depth infinity: %d %v", code, body)
+	}
+}
+
+func TestPropfindIrregular(t *testing.T) {
+	quietLog(t)
+	values := make(map[string][]byte)
+	chunk := putNode(values, chunkType, make([]byte, 600))
+	odd := putNode(values, bigFileType, chunk, chunk) //1200 octets, mais 1624 d'après la forme
+	name := make([]byte, nameSize)
+	copy(name, "odd")
+	root := putNode(values, directoryType, name, odd)
+	g := useSimGateway(t, &simPeer{root: root, values: values})
+
+	//la liste ne lit pas tout le fichier : taille omise plutôt que fausse
+	if code, _, ms := propfind(t, g, "/dav/sim/", "1"); code != 207 || describeDAV(ms) != "/dav/sim/ dir, /dav/sim/odd unknown size" {
+		t.Fatalf("listing: %d %v", code, describeDAV(ms))
+	}
+	r := httptest.NewRequest("GET", "/dav/sim/odd", nil)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, r)
+	if w.Code != 200 || w.Body.Len() != 1200 || w.Header().Get("Content-Length") != "1200" {
+		t.Fatalf("GET: %d, %d bytes, Content-Length %v", w.Code, w.Body.Len(), w.Header().Get("Content-Length"))
+	}
+}